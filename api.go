@@ -38,6 +38,9 @@ var (
 	ErrNotImplemented = "not_implemented"
 	ErrInvalidObject = "invalid_object"
 	ErrInvalidArgument = "invalid_argument"
+	ErrBusy = "busy"
+	ErrMethodNotAllowed = "method_not_allowed"
+	ErrForbidden = "forbidden"
 )
 
 func jsonResponse(data interface{}, code int) ([]byte, int) {
@@ -58,6 +61,85 @@ func jsonResponse(data interface{}, code int) ([]byte, int) {
 	}
 }
 
+// argumentError generates the reply to a missing, malformed or out-of-range
+// numeric argument.
+func argumentError(name string, from float64, to float64) ([]byte, int) {
+	return jsonResponse(map[string]interface{}{
+		"error": ErrInvalidArgument,
+		"args": []interface{}{
+			map[string]interface{}{
+				"name": name,
+				"type": "float",
+				"range_from": from,
+				"range_to": to,
+			},
+		},
+	}, http.StatusBadRequest)
+}
+
+// jobResponse generates the reply to a submitted command.
+// The command is only queued, so the job ID is returned for later reference.
+func jobResponse(job *Job, err error) ([]byte, int) {
+	if err != nil {
+		log.Print(err)
+		switch err {
+			case ErrPositionRange:
+				return argumentError("position", PositionMin, PositionMax)
+			case ErrAngleRange:
+				return argumentError("angle", AngleMin, AngleMax)
+			case ErrQueueFull, ErrShutdown:
+				return jsonResponse(map[string]interface{}{
+					"error": ErrBusy,
+				}, http.StatusServiceUnavailable)
+			case ErrUnknownShutter:
+				return jsonResponse(map[string]interface{}{
+					"error": ErrInvalidObject,
+				}, http.StatusNotFound)
+			default:
+				return jsonResponse(map[string]interface{}{
+					"error": ErrInternal,
+				}, http.StatusInternalServerError)
+		}
+	}
+	return jsonResponse(map[string]interface{}{
+		"name": job.Shutter,
+		"job": job.ID,
+		"status": job.Status(),
+	}, http.StatusAccepted)
+}
+
+// stopResponse generates the reply to a stop command, which reports the
+// position where the shutter came to a halt.
+func stopResponse(shutter *Shutter, err error) ([]byte, int) {
+	if err != nil {
+		log.Print(err)
+		return jsonResponse(map[string]interface{}{
+			"error": ErrInternal,
+		}, http.StatusInternalServerError)
+	}
+	status := shutter.Status()
+	return jsonResponse(map[string]interface{}{
+		"name": shutter.Name,
+		"position": status.Position,
+		"angle": status.Angle,
+	}, http.StatusOK)
+}
+
+// shutterReport returns a serialisable summary of the state of a shutter.
+func shutterReport(shutter *Shutter) map[string]interface{} {
+	status := shutter.Status()
+	return map[string]interface{}{
+		"name": shutter.Name,
+		"position": status.Position,
+		"angle": status.Angle,
+		"queued": status.Queued,
+		"calibration": status.Calibration,
+		"moving": status.Moving,
+		"direction": status.Direction.String(),
+		"eta": status.Remaining.Seconds(),
+	}
+}
+
 type Endpoint interface {
 	Handle(path []string, query url.Values) ([]byte, int)
 }
@@ -130,19 +212,17 @@ func NewShutterEndpoint(state *ShutterState, name string) *ShutterEndpoint {
 	}
 	ep.children["flip"] = NewFlipEndpoint(state, name)
 	ep.children["move"] = NewMoveEndpoint(state, name)
+	ep.children["stop"] = NewStopEndpoint(state, name)
+	ep.children["jobs"] = NewJobsEndpoint(state, name)
 	return ep
 }
 
 func (ep *ShutterEndpoint) Handle(path []string, query url.Values) ([]byte, int) {
 	//log.Printf("len(path)=%d path[0]=%s path[1]=%s\n", len(path), path[0], path[1])
 	if path == nil || len(path) == 0 || path[0] == "" {
-		shutter := ep.state.Shutters[ep.name]
-		return jsonResponse(map[string]interface{}{
-			"name": shutter.Name,
-			"children": ep.Children(),
-			"position": shutter.Position,
-			"angle": shutter.Angle,
-		}, http.StatusOK)
+		report := shutterReport(ep.state.Shutters[ep.name])
+		report["children"] = ep.Children()
+		return jsonResponse(report, http.StatusOK)
 	} else {
 		return ep.TreeEndpoint.Handle(path, query)
 	}
@@ -171,28 +251,18 @@ func NewFlipEndpoint(state *ShutterState, name string) *FlipEndpoint {
 func (ep *FlipEndpoint) Handle(path []string, query url.Values) ([]byte, int) {
 	//log.Printf("len(path)=%d path[0]=%s path[1]=%s\n", len(path), path[0], path[1])
 	if path == nil || len(path) == 0 || path[0] == "" {
-		shutter := ep.state.Shutters[ep.name]
 		angle, err := strconv.ParseFloat(query.Get("angle"), 32)
-		if err == nil {
-			// TODO use a queue instead of just running this synchronously
-			shutter.Flip(float32(angle))
-			return jsonResponse(map[string]interface{}{
-				"name": shutter.Name,
-				"angle": shutter.Angle,
-			}, http.StatusOK)
+		if err == nil && ValidAngle(float32(angle)) {
+			job, err := ep.state.Dispatch(ep.name, Command{
+				Action: ActionFlip,
+				Angle: float32(angle),
+			})
+			return jobResponse(job, err)
 		} else {
-			log.Print(err)
-			return jsonResponse(map[string]interface{}{
-				"error": ErrInvalidArgument,
-				"args": []interface{}{
-					map[string]interface{}{
-						"name": "angle",
-						"type": "float",
-						"range_from": 0.0,
-						"range_to": 1.0,
-					},
-				},
-			}, http.StatusBadRequest)
+			if err != nil {
+				log.Print(err)
+			}
+			return argumentError("angle", AngleMin, AngleMax)
 		}
 	} else {
 		log.Printf("restreamer: unknown child %s\n", path[0])
@@ -217,28 +287,18 @@ func NewMoveEndpoint(state *ShutterState, name string) *MoveEndpoint {
 func (ep *MoveEndpoint) Handle(path []string, query url.Values) ([]byte, int) {
 	//log.Printf("len(path)=%d path[0]=%s path[1]=%s\n", len(path), path[0], path[1])
 	if path == nil || len(path) == 0 || path[0] == "" {
-		shutter := ep.state.Shutters[ep.name]
 		position, err := strconv.ParseFloat(query.Get("position"), 32)
-		if err == nil {
-			// TODO use a queue instead of just running this synchronously
-			shutter.Move(float32(position))
-			return jsonResponse(map[string]interface{}{
-				"name": shutter.Name,
-				"position": shutter.Position,
-			}, http.StatusOK)
+		if err == nil && ValidPosition(float32(position)) {
+			job, err := ep.state.Dispatch(ep.name, Command{
+				Action: ActionMove,
+				Position: float32(position),
+			})
+			return jobResponse(job, err)
 		} else {
-			log.Print(err)
-			return jsonResponse(map[string]interface{}{
-				"error": ErrInvalidArgument,
-				"args": []interface{}{
-					map[string]interface{}{
-						"name": "position",
-						"type": "float",
-						"range_from": 0.0,
-						"range_to": 100.0,
-					},
-				},
-			}, http.StatusBadRequest)
+			if err != nil {
+				log.Print(err)
+			}
+			return argumentError("position", PositionMin, PositionMax)
 		}
 	} else {
 		log.Printf("restreamer: unknown child %s\n", path[0])
@@ -247,3 +307,66 @@ func (ep *MoveEndpoint) Handle(path []string, query url.Values) ([]byte, int) {
 		}, http.StatusNotFound)
 	}
 }
+
+type StopEndpoint struct {
+	state *ShutterState
+	name string
+}
+
+func NewStopEndpoint(state *ShutterState, name string) *StopEndpoint {
+	return &StopEndpoint{
+		state: state,
+		name: name,
+	}
+}
+
+func (ep *StopEndpoint) Handle(path []string, query url.Values) ([]byte, int) {
+	if path == nil || len(path) == 0 || path[0] == "" {
+		_, err := ep.state.Dispatch(ep.name, Command{ Action: ActionStop })
+		return stopResponse(ep.state.Shutters[ep.name], err)
+	} else {
+		log.Printf("unknown child %s\n", path[0])
+		return jsonResponse(map[string]interface{}{
+			"error": ErrInvalidObject,
+		}, http.StatusNotFound)
+	}
+}
+
+type JobsEndpoint struct {
+	state *ShutterState
+	name string
+}
+
+func NewJobsEndpoint(state *ShutterState, name string) *JobsEndpoint {
+	return &JobsEndpoint{
+		state: state,
+		name: name,
+	}
+}
+
+func (ep *JobsEndpoint) Handle(path []string, query url.Values) ([]byte, int) {
+	shutter := ep.state.Shutters[ep.name]
+	if path == nil || len(path) == 0 || path[0] == "" {
+		return jsonResponse(map[string]interface{}{
+			"name": shutter.Name,
+			"jobs": shutter.Jobs(),
+		}, http.StatusOK)
+	} else if len(path) == 1 || path[1] == "" {
+		id, err := strconv.ParseUint(path[0], 10, 64)
+		if err == nil {
+			job := shutter.Job(id)
+			if job != nil {
+				return jsonResponse(job.Report(), http.StatusOK)
+			}
+		}
+		log.Printf("unknown job %s\n", path[0])
+		return jsonResponse(map[string]interface{}{
+			"error": ErrInvalidObject,
+		}, http.StatusNotFound)
+	} else {
+		log.Printf("unknown child %s\n", path[1])
+		return jsonResponse(map[string]interface{}{
+			"error": ErrInvalidObject,
+		}, http.StatusNotFound)
+	}
+}
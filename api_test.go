@@ -0,0 +1,101 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// checkArgumentError verifies that a reply rejects the named argument with
+// its valid range.
+func checkArgumentError(t *testing.T, response []byte, code int, name string, from float64, to float64) {
+	if code != http.StatusBadRequest {
+		t.Errorf("status is %d, expected %d", code, http.StatusBadRequest)
+	}
+	var reply struct {
+		Error string
+		Args []struct {
+			Name string
+			Type string
+			Range_From float64
+			Range_To float64
+		}
+	}
+	if err := json.Unmarshal(response, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Error != ErrInvalidArgument {
+		t.Errorf("error is %s, expected %s", reply.Error, ErrInvalidArgument)
+	}
+	if len(reply.Args) != 1 || reply.Args[0].Name != name || reply.Args[0].Type != "float" || reply.Args[0].Range_From != from || reply.Args[0].Range_To != to {
+		t.Errorf("arguments are %+v, expected %s from %f to %f", reply.Args, name, from, to)
+	}
+}
+
+func TestJobResponseErrors(t *testing.T) {
+	tests := []struct {
+		err error
+		name string
+		from, to float64
+	}{
+		{ ErrPositionRange, "position", PositionMin, PositionMax },
+		{ ErrAngleRange, "angle", AngleMin, AngleMax },
+	}
+	for _, test := range tests {
+		response, code := jobResponse(nil, test.err)
+		checkArgumentError(t, response, code, test.name, test.from, test.to)
+	}
+}
+
+func TestLegacyInvalidArguments(t *testing.T) {
+	state := &ShutterState{
+		Shutters: map[string]*Shutter{},
+	}
+	tests := []struct {
+		endpoint Endpoint
+		query string
+		name string
+		from, to float64
+	}{
+		{ NewMoveEndpoint(state, "1"), "position=150", "position", PositionMin, PositionMax },
+		{ NewMoveEndpoint(state, "1"), "position=-1", "position", PositionMin, PositionMax },
+		{ NewMoveEndpoint(state, "1"), "position=half", "position", PositionMin, PositionMax },
+		{ NewMoveEndpoint(state, "1"), "", "position", PositionMin, PositionMax },
+		{ NewFlipEndpoint(state, "1"), "angle=2", "angle", AngleMin, AngleMax },
+		{ NewFlipEndpoint(state, "1"), "angle=", "angle", AngleMin, AngleMax },
+	}
+	for _, test := range tests {
+		query, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, code := test.endpoint.Handle(nil, query)
+		checkArgumentError(t, response, code, test.name, test.from, test.to)
+	}
+}
@@ -0,0 +1,126 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"log"
+)
+
+// Calibration modes select how the position of a shutter is determined at
+// startup.
+const (
+	// CalibrationHome drives the shutter fully up to establish position 0
+	CalibrationHome = "home"
+	// CalibrationRestore uses the position from the state file, and homes
+	// the shutter if there is none or if it is uncertain
+	CalibrationRestore = "restore"
+	// CalibrationAssume assumes that the shutter is at position 0
+	CalibrationAssume = "assume"
+)
+
+// Calibration states report how trustworthy the position of a shutter is.
+const (
+	CalibrationUnknown = "unknown"
+	CalibrationHoming = "homing"
+	CalibrationHomed = "homed"
+	CalibrationRestored = "restored"
+	CalibrationAssumed = "assumed"
+	CalibrationUncertain = "uncertain"
+	CalibrationFailed = "failed"
+)
+
+// HomingOverrun is the fraction of the up time that the motor keeps running
+// during homing, to make sure the end position is reached.
+const HomingOverrun = 0.2
+
+// ValidCalibrationMode checks if a calibration mode is known.
+func ValidCalibrationMode(mode string) bool {
+	switch mode {
+		case CalibrationHome, CalibrationRestore, CalibrationAssume:
+			return true
+		default:
+			return false
+	}
+}
+
+// Start initialises the GPIO lines of all shutters and calibrates their
+// positions according to the configured mode.
+// Homing runs are queued, so Start returns before they have completed.
+// Afterwards, the wall switches and the automation are started.
+func (state *ShutterState) Start() {
+	for _, shutter := range state.Shutters {
+		if err := shutter.Init(); err != nil {
+			log.Printf("Can't initialize shutter %s: %s\n", shutter.Name, err)
+			shutter.setCalibration(CalibrationFailed)
+			continue
+		}
+		shutter.calibrate()
+	}
+	state.Inputs.Init()
+	go state.Inputs.Run()
+	go state.Schedules.Run()
+	go state.Shade.Run()
+}
+
+func (shutter *Shutter) calibrate() {
+	mode := shutter.CalibrationMode
+	if mode == CalibrationRestore {
+		if shutter.Calibration() == CalibrationRestored {
+			log.Printf("Restored position %f of shutter %s\n", shutter.Status().Position, shutter.Name)
+			return
+		}
+		log.Printf("No reliable saved position for shutter %s, homing instead\n", shutter.Name)
+		mode = CalibrationHome
+	}
+	switch mode {
+		case CalibrationHome:
+			shutter.setCalibration(CalibrationHoming)
+			if _, err := shutter.Submit(Command{ Action: ActionReset }); err != nil {
+				log.Printf("Can't home shutter %s: %s\n", shutter.Name, err)
+				shutter.setCalibration(CalibrationFailed)
+			}
+		default:
+			shutter.setPosition(PositionMin, AngleMin)
+			shutter.setCalibration(CalibrationAssumed)
+	}
+}
+
+// Calibration returns the calibration state of the shutter.
+func (shutter *Shutter) Calibration() string {
+	shutter.lock.Lock()
+	defer shutter.lock.Unlock()
+	return shutter.calibration
+}
+
+func (shutter *Shutter) setCalibration(calibration string) {
+	shutter.lock.Lock()
+	changed := shutter.calibration != calibration
+	shutter.calibration = calibration
+	shutter.lock.Unlock()
+	if changed {
+		shutter.publish(EventCalibration, nil, "", nil)
+	}
+}
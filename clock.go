@@ -0,0 +1,187 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for everything that is timing-sensitive.
+// The system clock is used in production, while tests can substitute a
+// FakeClock that only advances when told to.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer creates a timer that fires once after the given duration.
+	NewTimer(duration time.Duration) Timer
+	// Sleep blocks for the given duration.
+	Sleep(duration time.Duration)
+}
+
+// Timer is a single-shot timer created by a Clock.
+type Timer interface {
+	// C returns the channel on which the expiry time is delivered.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing.
+	// Returns false if the timer has already fired or been stopped.
+	Stop() bool
+}
+
+// SystemClock is the Clock based on the system time.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(duration time.Duration) Timer {
+	return systemTimer{ time.NewTimer(duration) }
+}
+
+func (systemClock) Sleep(duration time.Duration) {
+	time.Sleep(duration)
+}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// FakeClock is a Clock that stands still until it is advanced manually.
+// Timers fire when the clock is advanced past their deadline.
+type FakeClock struct {
+	lock sync.Mutex
+	// cond is signalled when the set of pending timers changes
+	cond *sync.Cond
+	now time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	deadline time.Time
+	c chan time.Time
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	clock := &FakeClock{
+		now: start,
+	}
+	clock.cond = sync.NewCond(&clock.lock)
+	return clock
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+func (clock *FakeClock) NewTimer(duration time.Duration) Timer {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	timer := &fakeTimer{
+		clock: clock,
+		deadline: clock.now.Add(duration),
+		c: make(chan time.Time, 1),
+	}
+	if duration <= 0 {
+		timer.c <- clock.now
+	} else {
+		clock.timers = append(clock.timers, timer)
+		clock.cond.Broadcast()
+	}
+	return timer
+}
+
+func (clock *FakeClock) Sleep(duration time.Duration) {
+	<-clock.NewTimer(duration).C()
+}
+
+// Advance moves the clock forward and fires all timers whose deadline has
+// been reached, in chronological order.
+func (clock *FakeClock) Advance(duration time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	target := clock.now.Add(duration)
+	sort.Slice(clock.timers, func(i, j int) bool {
+		return clock.timers[i].deadline.Before(clock.timers[j].deadline)
+	})
+	for len(clock.timers) > 0 && !clock.timers[0].deadline.After(target) {
+		timer := clock.timers[0]
+		clock.timers = clock.timers[1:]
+		clock.now = timer.deadline
+		timer.c <- timer.deadline
+	}
+	clock.now = target
+	clock.cond.Broadcast()
+}
+
+// Pending returns the number of timers that have not fired yet.
+func (clock *FakeClock) Pending() int {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return len(clock.timers)
+}
+
+// BlockUntil waits until at least the given number of timers are pending.
+// This allows tests to synchronise with goroutines that are about to sleep.
+func (clock *FakeClock) BlockUntil(pending int) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	for len(clock.timers) < pending {
+		clock.cond.Wait()
+	}
+}
+
+func (timer *fakeTimer) C() <-chan time.Time {
+	return timer.c
+}
+
+func (timer *fakeTimer) Stop() bool {
+	clock := timer.clock
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	for i, pending := range clock.timers {
+		if pending == timer {
+			clock.timers = append(clock.timers[:i], clock.timers[i + 1:]...)
+			clock.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
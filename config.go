@@ -0,0 +1,290 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Configuration is the structure of the JSON configuration file.
+// Global timings are specified in seconds, per-shutter timings in
+// milliseconds.
+type Configuration struct {
+	Listen string
+	UpTime int
+	DownTime int
+	FlipTime int
+	// DeadTime is the pause before reversing a motor, in milliseconds
+	DeadTime int
+	// Calibration is the default startup calibration mode of all shutters
+	Calibration string
+	// StateFile is where shutter positions are saved, optional
+	StateFile string
+	// GpioBackend selects the implementation for plain GPIO line numbers
+	GpioBackend string
+	// LegacyApi enables the unversioned API, which accepts commands as GET
+	// requests
+	LegacyApi bool
+	// Mqtt connects to an MQTT broker, if set
+	Mqtt *MqttConfiguration
+	Shutters []ShutterConfiguration
+	// Groups are named sets of shutters and other groups
+	Groups map[string][]string
+	// Scenes are the initial set of scenes
+	Scenes map[string]Scene
+	// SceneFile is where scenes are saved when they are changed, optional
+	SceneFile string
+	// Schedules are the initial set of schedule rules
+	Schedules map[string]ScheduleRule
+	// ScheduleFile is where schedule rules are saved when they are changed,
+	// optional
+	ScheduleFile string
+	// Latitude and Longitude are the location of the shutters, in degrees,
+	// for solar events. North and east are positive.
+	Latitude *float64
+	Longitude *float64
+	// ShadeInterval is the time between updates of the shade automation, in
+	// minutes
+	ShadeInterval int
+	// DebounceMs is how long wall switch inputs must be stable, in
+	// milliseconds
+	DebounceMs int
+	// LongPressMs is how long a wall switch must be held to run the shutter
+	// to the end, in milliseconds
+	LongPressMs int
+}
+
+// ShutterConfiguration describes a single shutter.
+// Timings that are zero or absent are inherited from the global
+// configuration.
+type ShutterConfiguration struct {
+	Name string
+	GpioUp string
+	GpioDown string
+	// GpioUpActiveLow and GpioDownActiveLow invert the respective line, for
+	// relays that switch on when their input is low
+	GpioUpActiveLow bool
+	GpioDownActiveLow bool
+	UpTimeMs int
+	DownTimeMs int
+	FlipUpTimeMs int
+	FlipDownTimeMs int
+	Calibration string
+	// Azimuth is the direction that the window faces, in degrees clockwise
+	// from north, for the shade automation
+	Azimuth *float64
+	// TiltMode selects how the slats are turned against the sun, off by
+	// default
+	TiltMode string
+	// InputUp and InputDown are the GPIO lines of wall switch buttons,
+	// optional
+	InputUp string
+	InputDown string
+	InputUpActiveLow bool
+	InputDownActiveLow bool
+}
+
+// LoadConfiguration parses and validates a JSON configuration.
+func LoadConfiguration(reader io.Reader) (*Configuration, error) {
+	decoder := json.NewDecoder(reader)
+	config := &Configuration{}
+	if err := decoder.Decode(config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks the configuration for consistency.
+func (config *Configuration) Validate() error {
+	if config.UpTime < 0 || config.DownTime < 0 || config.FlipTime < 0 {
+		return errors.New("timings cannot be negative")
+	}
+	if config.ShadeInterval < 0 {
+		return errors.New("shade interval cannot be negative")
+	}
+	if config.DebounceMs < 0 || config.LongPressMs < 0 {
+		return errors.New("wall switch timings cannot be negative")
+	}
+	if config.DeadTime < 0 {
+		return errors.New("dead time cannot be negative")
+	}
+	switch config.GpioBackend {
+		case "", GpioBackendSysfs, GpioBackendCdev, GpioBackendSim:
+		default:
+			return fmt.Errorf("unknown GPIO backend %s", config.GpioBackend)
+	}
+	if config.Calibration != "" && !ValidCalibrationMode(config.Calibration) {
+		return fmt.Errorf("unknown calibration mode %s", config.Calibration)
+	}
+	if config.Mqtt != nil && config.Mqtt.Broker == "" {
+		return errors.New("mqtt needs a broker")
+	}
+	names := make(map[string]bool)
+	for _, shutter := range config.Shutters {
+		if shutter.Name == "" {
+			return errors.New("shutter name cannot be empty")
+		}
+		if strings.Contains(shutter.Name, "/") {
+			return fmt.Errorf("shutter name %s cannot contain /", shutter.Name)
+		}
+		if config.Mqtt != nil && strings.ContainsAny(shutter.Name, "+#") {
+			return fmt.Errorf("shutter name %s cannot contain MQTT wildcards", shutter.Name)
+		}
+		if names[shutter.Name] {
+			return fmt.Errorf("duplicate shutter %s", shutter.Name)
+		}
+		names[shutter.Name] = true
+		if shutter.GpioUp == "" || shutter.GpioDown == "" {
+			return fmt.Errorf("shutter %s needs both gpioup and gpiodown", shutter.Name)
+		}
+		if shutter.GpioUp == shutter.GpioDown {
+			return fmt.Errorf("shutter %s uses the same GPIO line for up and down", shutter.Name)
+		}
+		if shutter.InputUp != "" && shutter.InputUp == shutter.InputDown {
+			return fmt.Errorf("shutter %s uses the same GPIO line for both wall switch buttons", shutter.Name)
+		}
+		if shutter.UpTimeMs < 0 || shutter.DownTimeMs < 0 || shutter.FlipUpTimeMs < 0 || shutter.FlipDownTimeMs < 0 {
+			return fmt.Errorf("timings of shutter %s cannot be negative", shutter.Name)
+		}
+		if shutter.Calibration != "" && !ValidCalibrationMode(shutter.Calibration) {
+			return fmt.Errorf("unknown calibration mode %s for shutter %s", shutter.Calibration, shutter.Name)
+		}
+		if shutter.TiltMode != "" && !ValidTiltMode(shutter.TiltMode) {
+			return fmt.Errorf("unknown tilt mode %s for shutter %s", shutter.TiltMode, shutter.Name)
+		}
+		if shutter.TiltMode != "" && shutter.TiltMode != TiltModeOff {
+			if shutter.Azimuth == nil || config.Latitude == nil || config.Longitude == nil {
+				return fmt.Errorf("tilt mode of shutter %s needs its azimuth, and the latitude and longitude", shutter.Name)
+			}
+		}
+		if shutter.Azimuth != nil && (*shutter.Azimuth < 0 || *shutter.Azimuth >= 360) {
+			return fmt.Errorf("azimuth of shutter %s out of range", shutter.Name)
+		}
+		up, down, _, _ := shutter.Timings(config)
+		if up <= 0 || down <= 0 {
+			return fmt.Errorf("shutter %s has no up or down time", shutter.Name)
+		}
+	}
+	if (config.Latitude == nil) != (config.Longitude == nil) {
+		return errors.New("latitude and longitude must be set together")
+	}
+	coordinates := config.Coordinates()
+	if coordinates != nil {
+		if err := coordinates.Validate(); err != nil {
+			return err
+		}
+	}
+	expanded, err := config.ExpandGroups()
+	if err != nil {
+		return err
+	}
+	groups := make(map[string]bool)
+	for name := range expanded {
+		groups[name] = true
+	}
+	for name, scene := range config.Scenes {
+		if err := ValidSceneName(name); err != nil {
+			return err
+		}
+		if err := scene.Validate(names); err != nil {
+			return fmt.Errorf("scene %s: %s", name, err)
+		}
+	}
+	for name, rule := range config.Schedules {
+		if err := ValidScheduleName(name); err != nil {
+			return err
+		}
+		if err := rule.Validate(names, groups, coordinates); err != nil {
+			return fmt.Errorf("schedule %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Coordinates returns the configured location, or nil if there is none.
+func (config *Configuration) Coordinates() *Coordinates {
+	if config.Latitude == nil || config.Longitude == nil {
+		return nil
+	}
+	return &Coordinates{
+		Latitude: *config.Latitude,
+		Longitude: *config.Longitude,
+	}
+}
+
+// Timings returns the effective travel and slat times of a shutter.
+// Values that are not set on the shutter fall back to the global ones.
+func (shutter *ShutterConfiguration) Timings(config *Configuration) (up time.Duration, down time.Duration, flipup time.Duration, flipdown time.Duration) {
+	up = overrideDuration(shutter.UpTimeMs, config.UpTime)
+	down = overrideDuration(shutter.DownTimeMs, config.DownTime)
+	flipup = overrideDuration(shutter.FlipUpTimeMs, config.FlipTime)
+	flipdown = overrideDuration(shutter.FlipDownTimeMs, config.FlipTime)
+	return
+}
+
+// CalibrationMode returns the effective startup calibration mode of a shutter.
+func (shutter *ShutterConfiguration) CalibrationMode(config *Configuration) string {
+	if shutter.Calibration != "" {
+		return shutter.Calibration
+	}
+	if config.Calibration != "" {
+		return config.Calibration
+	}
+	if config.StateFile != "" {
+		return CalibrationRestore
+	}
+	return CalibrationAssume
+}
+
+// SwitchTimings returns the debounce and long press times of wall switches.
+func (config *Configuration) SwitchTimings() (debounce time.Duration, longpress time.Duration) {
+	debounce = DefaultDebounce
+	if config.DebounceMs > 0 {
+		debounce = time.Duration(config.DebounceMs) * time.Millisecond
+	}
+	longpress = DefaultLongPress
+	if config.LongPressMs > 0 {
+		longpress = time.Duration(config.LongPressMs) * time.Millisecond
+	}
+	return
+}
+
+// overrideDuration picks a millisecond value if it is set, or a value in
+// seconds otherwise.
+func overrideDuration(milliseconds int, seconds int) time.Duration {
+	if milliseconds > 0 {
+		return time.Duration(milliseconds) * time.Millisecond
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,108 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutterTimings(t *testing.T) {
+	config := &Configuration{
+		UpTime: 20,
+		DownTime: 18,
+		FlipTime: 2,
+	}
+	tests := []struct {
+		name string
+		shutter ShutterConfiguration
+		up, down, flipup, flipdown time.Duration
+	}{
+		{ "global", ShutterConfiguration{}, 20 * time.Second, 18 * time.Second, 2 * time.Second, 2 * time.Second },
+		{ "override up", ShutterConfiguration{ UpTimeMs: 12500 }, 12500 * time.Millisecond, 18 * time.Second, 2 * time.Second, 2 * time.Second },
+		{ "override all", ShutterConfiguration{ UpTimeMs: 1, DownTimeMs: 2, FlipUpTimeMs: 3, FlipDownTimeMs: 4 }, time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond, 4 * time.Millisecond },
+		{ "separate flip", ShutterConfiguration{ FlipDownTimeMs: 1500 }, 20 * time.Second, 18 * time.Second, 2 * time.Second, 1500 * time.Millisecond },
+		{ "zero falls back", ShutterConfiguration{ UpTimeMs: 0, DownTimeMs: 0 }, 20 * time.Second, 18 * time.Second, 2 * time.Second, 2 * time.Second },
+	}
+	for _, test := range tests {
+		up, down, flipup, flipdown := test.shutter.Timings(config)
+		if up != test.up || down != test.down || flipup != test.flipup || flipdown != test.flipdown {
+			t.Errorf("%s: timings are %s %s %s %s, expected %s %s %s %s", test.name, up, down, flipup, flipdown, test.up, test.down, test.flipup, test.flipdown)
+		}
+	}
+}
+
+func TestLoadConfiguration(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		// err is a part of the expected error message, empty if the
+		// configuration is valid
+		err string
+	}{
+		{ "global timings", `{"uptime": 20, "downtime": 20, "shutters": [{"name": "1", "gpioup": "sim:1u", "gpiodown": "sim:1d"}]}`, "" },
+		{ "shutter timings", `{"shutters": [{"name": "1", "gpioup": "sim:1u", "gpiodown": "sim:1d", "uptimems": 15000, "downtimems": 14000}]}`, "" },
+		{ "missing up time", `{"downtime": 20, "shutters": [{"name": "1", "gpioup": "sim:1u", "gpiodown": "sim:1d"}]}`, "has no up or down time" },
+		{ "negative global", `{"uptime": -1, "downtime": 20}`, "timings cannot be negative" },
+		{ "negative shutter", `{"uptime": 20, "downtime": 20, "shutters": [{"name": "1", "gpioup": "sim:1u", "gpiodown": "sim:1d", "flipuptimems": -5}]}`, "cannot be negative" },
+		{ "negative dead time", `{"deadtime": -1}`, "dead time cannot be negative" },
+		{ "empty name", `{"uptime": 20, "downtime": 20, "shutters": [{"gpioup": "sim:1u", "gpiodown": "sim:1d"}]}`, "name cannot be empty" },
+		{ "duplicate", `{"uptime": 20, "downtime": 20, "shutters": [{"name": "1", "gpioup": "sim:1u", "gpiodown": "sim:1d"}, {"name": "1", "gpioup": "sim:2u", "gpiodown": "sim:2d"}]}`, "duplicate shutter" },
+		{ "same line", `{"uptime": 20, "downtime": 20, "shutters": [{"name": "1", "gpioup": "sim:1", "gpiodown": "sim:1"}]}`, "same GPIO line" },
+		{ "missing line", `{"uptime": 20, "downtime": 20, "shutters": [{"name": "1", "gpioup": "sim:1"}]}`, "needs both gpioup and gpiodown" },
+		{ "calibration", `{"uptime": 20, "downtime": 20, "shutters": [{"name": "1", "gpioup": "sim:1u", "gpiodown": "sim:1d", "calibration": "sometimes"}]}`, "unknown calibration mode" },
+		{ "backend", `{"gpiobackend": "parport"}`, "unknown GPIO backend" },
+		{ "syntax", `{"uptime": }`, "invalid character" },
+	}
+	for _, test := range tests {
+		_, err := LoadConfiguration(strings.NewReader(test.json))
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: error is %v, expected %s", test.name, err, test.err)
+		}
+	}
+}
+
+func TestOverrideDuration(t *testing.T) {
+	tests := []struct {
+		milliseconds int
+		seconds int
+		expected time.Duration
+	}{
+		{ 0, 0, 0 },
+		{ 0, 5, 5 * time.Second },
+		{ 250, 5, 250 * time.Millisecond },
+		{ -1, 5, 5 * time.Second },
+	}
+	for _, test := range tests {
+		if duration := overrideDuration(test.milliseconds, test.seconds); duration != test.expected {
+			t.Errorf("overrideDuration(%d, %d) is %s, expected %s", test.milliseconds, test.seconds, duration, test.expected)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronField describes one field of a cron expression.
+type cronField struct {
+	name string
+	min int
+	max int
+	// names are symbolic values, starting at min
+	names []string
+}
+
+var cronFields = []cronField{
+	{ "minute", 0, 59, nil },
+	{ "hour", 0, 23, nil },
+	{ "day of month", 1, 31, nil },
+	{ "month", 1, 12, []string{ "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec" } },
+	// 7 is accepted as Sunday as well
+	{ "day of week", 0, 7, []string{ "sun", "mon", "tue", "wed", "thu", "fri", "sat" } },
+}
+
+// cronMacros are shorthands for common expressions.
+var cronMacros = map[string]string{
+	"@yearly": "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly": "0 0 * * 0",
+	"@daily": "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly": "0 * * * *",
+}
+
+// CronSchedule is a parsed cron expression, with the usual five fields:
+// minute, hour, day of month, month and day of week.
+// Each field is a comma-separated list of values, ranges (1-5), steps (*/15
+// or 0-30/10) or *. Months and weekdays can also be given by their
+// three-letter English names.
+type CronSchedule struct {
+	// fields are bit sets of the allowed values of each field
+	fields [5]uint64
+	// restricted records which fields are not *, to match days the way cron
+	// does: if both day fields are restricted, either of them may match
+	restricted [5]bool
+}
+
+// ParseCron parses a cron expression.
+func ParseCron(expression string) (*CronSchedule, error) {
+	expression = strings.TrimSpace(expression)
+	if macro, ok := cronMacros[strings.ToLower(expression)]; ok {
+		expression = macro
+	}
+	parts := strings.Fields(expression)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression %q needs %d fields", expression, len(cronFields))
+	}
+	schedule := &CronSchedule{}
+	for i, part := range parts {
+		bits, err := cronFields[i].parse(part)
+		if err != nil {
+			return nil, err
+		}
+		schedule.fields[i] = bits
+		schedule.restricted[i] = !strings.HasPrefix(part, "*")
+	}
+	// Sunday is both 0 and 7
+	if schedule.fields[4] & (1 << 7) != 0 {
+		schedule.fields[4] |= 1
+	}
+	return schedule, nil
+}
+
+// parse converts a field into a bit set of allowed values.
+func (field *cronField) parse(spec string) (uint64, error) {
+	var bits uint64
+	for _, element := range strings.Split(spec, ",") {
+		step := 1
+		if slash := strings.Index(element, "/"); slash >= 0 {
+			var err error
+			step, err = strconv.Atoi(element[slash + 1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s field %q", field.name, spec)
+			}
+			element = element[:slash]
+		}
+		from, to := field.min, field.max
+		if element != "*" {
+			bounds := strings.SplitN(element, "-", 2)
+			var err error
+			from, err = field.value(bounds[0])
+			if err != nil {
+				return 0, err
+			}
+			to = from
+			if len(bounds) == 2 {
+				to, err = field.value(bounds[1])
+				if err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// 5/10 means starting at 5
+				to = field.max
+			}
+			if to < from {
+				return 0, fmt.Errorf("invalid range in %s field %q", field.name, spec)
+			}
+		}
+		for value := from; value <= to; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+// value parses a single number or name of a field.
+func (field *cronField) value(spec string) (int, error) {
+	for i, name := range field.names {
+		if strings.EqualFold(spec, name) {
+			return field.min + i, nil
+		}
+	}
+	value, err := strconv.Atoi(spec)
+	if err != nil || value < field.min || value > field.max {
+		return 0, fmt.Errorf("invalid %s %q", field.name, spec)
+	}
+	return value, nil
+}
+
+func (schedule *CronSchedule) matches(field int, value int) bool {
+	return schedule.fields[field] & (1 << uint(value)) != 0
+}
+
+// matchesDay checks the day of month and day of week fields.
+func (schedule *CronSchedule) matchesDay(t time.Time) bool {
+	dom := schedule.matches(2, t.Day())
+	dow := schedule.matches(4, int(t.Weekday()))
+	if schedule.restricted[2] && schedule.restricted[4] {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// Next returns the first time after the given one that matches the schedule,
+// in the same time zone. If there is none within the next few years, as for
+// the 30th of February, the zero time is returned.
+func (schedule *CronSchedule) Next(after time.Time) time.Time {
+	location := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		var next time.Time
+		switch {
+			case !schedule.matches(3, int(t.Month())):
+				next = time.Date(t.Year(), t.Month() + 1, 1, 0, 0, 0, 0, location)
+			case !schedule.matchesDay(t):
+				next = time.Date(t.Year(), t.Month(), t.Day() + 1, 0, 0, 0, 0, location)
+			case !schedule.matches(1, t.Hour()):
+				next = time.Date(t.Year(), t.Month(), t.Day(), t.Hour() + 1, 0, 0, 0, location)
+			case !schedule.matches(0, t.Minute()):
+				next = t.Add(time.Minute)
+			default:
+				return t
+		}
+		// daylight saving time changes can move the result backwards
+		if !next.After(t) {
+			next = t.Add(time.Minute)
+		}
+		t = next
+	}
+	return time.Time{}
+}
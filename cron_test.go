@@ -0,0 +1,149 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	after := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC) // a Thursday
+	tests := []struct {
+		expression string
+		next time.Time
+	}{
+		{ "* * * * *", time.Date(2017, 6, 1, 12, 1, 0, 0, time.UTC) },
+		{ "*/15 * * * *", time.Date(2017, 6, 1, 12, 15, 0, 0, time.UTC) },
+		{ "5/20 * * * *", time.Date(2017, 6, 1, 12, 5, 0, 0, time.UTC) },
+		{ "0-30/10 13 * * *", time.Date(2017, 6, 1, 13, 0, 0, 0, time.UTC) },
+		{ "0 7,19 * * *", time.Date(2017, 6, 1, 19, 0, 0, 0, time.UTC) },
+		{ "0 7 * * mon-fri", time.Date(2017, 6, 2, 7, 0, 0, 0, time.UTC) },
+		{ "0 7 * * SAT,sun", time.Date(2017, 6, 3, 7, 0, 0, 0, time.UTC) },
+		{ "0 7 * * 7", time.Date(2017, 6, 4, 7, 0, 0, 0, time.UTC) },
+		{ "0 0 1 jan *", time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC) },
+		// either day field may match if both are restricted
+		{ "0 0 15 * mon", time.Date(2017, 6, 5, 0, 0, 0, 0, time.UTC) },
+		{ "0 0 29 feb *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC) },
+		{ "0 0 30 feb *", time.Time{} },
+		{ "@hourly", time.Date(2017, 6, 1, 13, 0, 0, 0, time.UTC) },
+		{ " @Daily ", time.Date(2017, 6, 2, 0, 0, 0, 0, time.UTC) },
+		{ "@weekly", time.Date(2017, 6, 4, 0, 0, 0, 0, time.UTC) },
+		{ "@monthly", time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC) },
+		{ "@yearly", time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC) },
+	}
+	for _, test := range tests {
+		schedule, err := ParseCron(test.expression)
+		if err != nil {
+			t.Errorf("%q: %s", test.expression, err)
+			continue
+		}
+		if next := schedule.Next(after); !next.Equal(test.next) {
+			t.Errorf("%q: next run is %s, expected %s", test.expression, next, test.next)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		err string
+	}{
+		{ "", "needs 5 fields" },
+		{ "* * * *", "needs 5 fields" },
+		{ "* * * * * *", "needs 5 fields" },
+		{ "@often", "needs 5 fields" },
+		{ "60 * * * *", "invalid minute" },
+		{ "* 24 * * *", "invalid hour" },
+		{ "* * 0 * *", "invalid day of month" },
+		{ "* * * 13 *", "invalid month" },
+		{ "* * * foo *", "invalid month" },
+		{ "* * * * 8", "invalid day of week" },
+		{ "*/0 * * * *", "invalid step" },
+		{ "*/x * * * *", "invalid step" },
+		{ "30-10 * * * *", "invalid range" },
+		{ "1,,2 * * * *", "invalid minute" },
+	}
+	for _, test := range tests {
+		_, err := ParseCron(test.expression)
+		if err == nil {
+			t.Errorf("%q was accepted", test.expression)
+		} else if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: error %q does not contain %q", test.expression, err, test.err)
+		}
+	}
+}
+
+func TestCronDaylightSaving(t *testing.T) {
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Skip("time zone data is not available: ", err)
+	}
+	tests := []struct {
+		expression string
+		after time.Time
+		runs []time.Time
+	}{
+		// 02:30 does not exist when the clocks go forward
+		{ "30 2 * * *", time.Date(2017, 3, 25, 12, 0, 0, 0, zurich), []time.Time{
+			time.Date(2017, 3, 27, 2, 30, 0, 0, zurich),
+			time.Date(2017, 3, 28, 2, 30, 0, 0, zurich),
+		} },
+		{ "0 7 * * *", time.Date(2017, 3, 25, 12, 0, 0, 0, zurich), []time.Time{
+			time.Date(2017, 3, 26, 7, 0, 0, 0, zurich),
+			time.Date(2017, 3, 27, 7, 0, 0, 0, zurich),
+		} },
+		// daily runs happen once when the clocks go back
+		{ "30 2 * * *", time.Date(2017, 10, 28, 12, 0, 0, 0, zurich), []time.Time{
+			time.Date(2017, 10, 29, 1, 30, 0, 0, time.UTC),
+			time.Date(2017, 10, 30, 1, 30, 0, 0, time.UTC),
+		} },
+		// but hourly ones still run every hour
+		{ "0 * * * *", time.Date(2017, 10, 29, 1, 30, 0, 0, zurich), []time.Time{
+			time.Date(2017, 10, 29, 0, 0, 0, 0, time.UTC),
+			time.Date(2017, 10, 29, 1, 0, 0, 0, time.UTC),
+			time.Date(2017, 10, 29, 2, 0, 0, 0, time.UTC),
+		} },
+	}
+	for _, test := range tests {
+		schedule, err := ParseCron(test.expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := test.after
+		for _, expected := range test.runs {
+			next = schedule.Next(next)
+			if !next.Equal(expected) {
+				t.Errorf("%q after %s: next run is %s, expected %s", test.expression, test.after, next, expected)
+				break
+			}
+			if next.Location() != zurich {
+				t.Errorf("%q: next run is in %s, expected the time zone of the start", test.expression, next.Location())
+			}
+		}
+	}
+}
@@ -0,0 +1,194 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types that are published on the event bus.
+const (
+	// EventStarted is published when a job starts executing
+	EventStarted = "started"
+	// EventProgress is published periodically while the motor is running
+	EventProgress = "progress"
+	// EventStopped is published when a job has completed or was cancelled
+	EventStopped = "stopped"
+	// EventError is published when a job has failed
+	EventError = "error"
+	// EventCalibration is published when the calibration state changes
+	EventCalibration = "calibration"
+)
+
+// ProgressInterval is the time between progress events of a running motor.
+const ProgressInterval = time.Second
+
+// EventQueueSize is the number of events that can be buffered per
+// subscriber. Events are dropped for subscribers that don't keep up.
+const EventQueueSize = 64
+
+// Event is a change in the state of a shutter.
+type Event struct {
+	Type string
+	Shutter string
+	Time time.Time
+	// Job is the ID of the job that caused the event, if any
+	Job uint64
+	// Status is the state of the shutter after the event
+	Status ShutterStatus
+	// Result is the final job status of stopped events
+	Result string
+	// Error describes why a job failed
+	Error string
+}
+
+// Report returns a serialisable form of the event.
+func (event *Event) Report() map[string]interface{} {
+	report := map[string]interface{}{
+		"type": event.Type,
+		"shutter": event.Shutter,
+		"time": event.Time,
+		"position": event.Status.Position,
+		"angle": event.Status.Angle,
+		"moving": event.Status.Moving,
+		"direction": event.Status.Direction.String(),
+		"eta": event.Status.Remaining.Seconds(),
+		"calibration": event.Status.Calibration,
+	}
+	if event.Job != 0 {
+		report["job"] = event.Job
+	}
+	if event.Result != "" {
+		report["result"] = event.Result
+	}
+	if event.Error != "" {
+		report["error"] = event.Error
+	}
+	return report
+}
+
+// Subscription receives events from an EventBus.
+// The channel is closed when the subscription ends.
+type Subscription struct {
+	C <-chan Event
+	c chan Event
+	// shutter restricts the subscription to one shutter, if not empty
+	shutter string
+}
+
+// EventBus distributes shutter events to any number of subscribers.
+// Publishing never blocks.
+type EventBus struct {
+	lock sync.Mutex
+	closed bool
+	subscribers map[*Subscription]bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[*Subscription]bool),
+	}
+}
+
+// Subscribe registers a new subscriber for the events of one shutter, or of
+// all shutters if the name is empty.
+func (bus *EventBus) Subscribe(shutter string) *Subscription {
+	c := make(chan Event, EventQueueSize)
+	sub := &Subscription{
+		C: c,
+		c: c,
+		shutter: shutter,
+	}
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	if bus.closed {
+		close(c)
+	} else {
+		bus.subscribers[sub] = true
+	}
+	return sub
+}
+
+// Unsubscribe ends a subscription and closes its channel.
+func (bus *EventBus) Unsubscribe(sub *Subscription) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	if bus.subscribers[sub] {
+		delete(bus.subscribers, sub)
+		close(sub.c)
+	}
+}
+
+// Publish sends an event to all interested subscribers.
+func (bus *EventBus) Publish(event Event) {
+	if bus == nil {
+		return
+	}
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	for sub := range bus.subscribers {
+		if sub.shutter != "" && sub.shutter != event.Shutter {
+			continue
+		}
+		select {
+			case sub.c <- event:
+			default:
+		}
+	}
+}
+
+// Close ends all subscriptions. Further subscriptions are closed immediately.
+func (bus *EventBus) Close() {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	bus.closed = true
+	for sub := range bus.subscribers {
+		close(sub.c)
+	}
+	bus.subscribers = make(map[*Subscription]bool)
+}
+
+// publish sends an event about the shutter with its current state.
+func (shutter *Shutter) publish(kind string, job *Job, result string, err error) {
+	if shutter.Events == nil {
+		return
+	}
+	event := Event{
+		Type: kind,
+		Shutter: shutter.Name,
+		Time: shutter.Clock.Now(),
+		Status: shutter.Status(),
+		Result: result,
+	}
+	if job != nil {
+		event.Job = job.ID
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	shutter.Events.Publish(event)
+}
@@ -25,18 +25,88 @@
 
 package main
 
+import (
+	"strings"
+	"time"
+)
+
+// GPIO backends that can be selected.
+// sysfs and cdev are only available on Linux.
+const (
+	GpioBackendSysfs = "sysfs"
+	GpioBackendCdev = "cdev"
+	GpioBackendSim = "sim"
+)
+
+// GpioBackend selects the implementation that is used for GPIO lines that are
+// specified as a plain number. If it is empty, the best available
+// implementation is chosen.
+// If it is set to GpioBackendSim, all lines are simulated, regardless of
+// their specification.
+var GpioBackend = ""
+
 // Gpio is the abstraction of a single GPIO line.
 // For each supported architecture, a specialised implementation is provided.
 type Gpio interface {
 	// Init sets up the GPIO line for input or output, according to
 	// its platform specific implementation.
+	// Output lines start out in the logical 0 state.
 	Init() error
 	// Set changes the digital state of this GPIO line, either logical 1
-	// (high) or 0 (low).
+	// (high, or low for active-low lines) or 0 (low, or high for active-low
+	// lines).
 	// The exact outcome is machine- and platform-defined.
 	// May cause unexpected results if the GPIO line is configured for input.
 	Set(state bool) error
 	// Get obtains the current logical state of the GPIO line.
 	// The exact result is machine- and platform-defined.
 	Get() (bool, error)
+	// Close releases the GPIO line. The state of the line after closing is
+	// platform-defined. Init must be called again before it can be used.
+	Close() error
+}
+
+// GpioEdgeBuffer is the number of edges that are held for a slow reader.
+const GpioEdgeBuffer = 16
+
+// Edge is a change of the state of an input line.
+type Edge struct {
+	// Time is when the change was detected, as close to the hardware as the
+	// platform allows
+	Time time.Time
+	// Value is the logical state after the change. A rising edge is true,
+	// a falling one false.
+	Value bool
+}
+
+// EdgeGpio is a GPIO line that can report changes of its state, so inputs
+// can be watched without polling.
+// It is implemented by all input lines that support interrupts.
+type EdgeGpio interface {
+	Gpio
+	// Watch starts reporting the edges of an initialized input line.
+	// The channel is closed when the line is closed. A line can only be
+	// watched once.
+	Watch() (<-chan Edge, error)
+}
+
+// NewGpio creates a GPIO handler for a single GPIO line.
+// If activelow is set, the logical state of the line is the inverse of its
+// electrical level: Set(true) drives the line low. This is needed for relay
+// boards that switch on when their input is low.
+// Lines that are specified as sim:name are simulated in memory, and lines
+// such as mcp23017:1:0x20:B3 or pcf8574:1:0x20:3 are on I2C GPIO expanders.
+// The implementation and the line ID format of all other lines is platform
+// specific.
+func NewGpio(spec string, output bool, activelow bool) (Gpio, error) {
+	if strings.HasPrefix(spec, "sim:") {
+		return newSimGpio(strings.TrimPrefix(spec, "sim:"), output, activelow)
+	}
+	if GpioBackend == GpioBackendSim {
+		return newSimGpio(spec, output, activelow)
+	}
+	if isExpanderSpec(spec) {
+		return newExpanderGpio(spec, output, activelow)
+	}
+	return newPlatformGpio(spec, output, activelow)
 }
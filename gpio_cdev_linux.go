@@ -0,0 +1,432 @@
+// +build linux
+
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Definitions from linux/gpio.h, version 2 of the character device ABI.
+const (
+	gpioMaxNameSize = 32
+	gpioV2LinesMax = 64
+	gpioV2LineNumAttrsMax = 10
+
+	gpioV2LineFlagActiveLow = 1 << 1
+	gpioV2LineFlagInput = 1 << 2
+	gpioV2LineFlagOutput = 1 << 3
+	gpioV2LineFlagEdgeRising = 1 << 4
+	gpioV2LineFlagEdgeFalling = 1 << 5
+
+	gpioV2LineAttrIdOutputValues = 2
+
+	gpioV2LineEventRisingEdge = 1
+	gpioV2LineEventFallingEdge = 2
+)
+
+// clockMonotonic is CLOCK_MONOTONIC from linux/time.h
+const clockMonotonic = 1
+
+type gpiochipInfo struct {
+	Name [gpioMaxNameSize]byte
+	Label [gpioMaxNameSize]byte
+	Lines uint32
+}
+
+type gpioV2LineAttribute struct {
+	Id uint32
+	Padding uint32
+	// Value is a union of flags, values and debounce_period_us
+	Value uint64
+}
+
+type gpioV2LineConfigAttribute struct {
+	Attr gpioV2LineAttribute
+	Mask uint64
+}
+
+type gpioV2LineConfig struct {
+	Flags uint64
+	NumAttrs uint32
+	Padding [5]uint32
+	Attrs [gpioV2LineNumAttrsMax]gpioV2LineConfigAttribute
+}
+
+type gpioV2LineRequest struct {
+	Offsets [gpioV2LinesMax]uint32
+	Consumer [gpioMaxNameSize]byte
+	Config gpioV2LineConfig
+	NumLines uint32
+	EventBufferSize uint32
+	Padding [5]uint32
+	Fd int32
+}
+
+type gpioV2LineInfo struct {
+	Name [gpioMaxNameSize]byte
+	Consumer [gpioMaxNameSize]byte
+	Offset uint32
+	NumAttrs uint32
+	Flags uint64
+	Attrs [gpioV2LineNumAttrsMax]gpioV2LineAttribute
+	Padding [4]uint32
+}
+
+type gpioV2LineValues struct {
+	Bits uint64
+	Mask uint64
+}
+
+type gpioV2LineEvent struct {
+	// TimestampNs is taken from CLOCK_MONOTONIC by default
+	TimestampNs uint64
+	Id uint32
+	Offset uint32
+	Seqno uint32
+	LineSeqno uint32
+	Padding [6]uint32
+}
+
+// The kernel structures have no implicit padding, so the Go layout must match
+// on all architectures. These declarations fail to compile if it doesn't.
+var (
+	_ [68]byte = [unsafe.Sizeof(gpiochipInfo{})]byte{}
+	_ [592]byte = [unsafe.Sizeof(gpioV2LineRequest{})]byte{}
+	_ [256]byte = [unsafe.Sizeof(gpioV2LineInfo{})]byte{}
+	_ [16]byte = [unsafe.Sizeof(gpioV2LineValues{})]byte{}
+	_ [272]byte = [unsafe.Sizeof(gpioV2LineConfig{})]byte{}
+	_ [48]byte = [unsafe.Sizeof(gpioV2LineEvent{})]byte{}
+)
+
+var (
+	gpioGetChipInfoIoctl = ioctlRead(0xB4, 0x01, unsafe.Sizeof(gpiochipInfo{}))
+	gpioV2GetLineInfoIoctl = ioctlReadWrite(0xB4, 0x05, unsafe.Sizeof(gpioV2LineInfo{}))
+	gpioV2GetLineIoctl = ioctlReadWrite(0xB4, 0x07, unsafe.Sizeof(gpioV2LineRequest{}))
+	gpioV2LineSetConfigIoctl = ioctlReadWrite(0xB4, 0x0D, unsafe.Sizeof(gpioV2LineConfig{}))
+	gpioV2LineGetValuesIoctl = ioctlReadWrite(0xB4, 0x0E, unsafe.Sizeof(gpioV2LineValues{}))
+	gpioV2LineSetValuesIoctl = ioctlReadWrite(0xB4, 0x0F, unsafe.Sizeof(gpioV2LineValues{}))
+)
+
+// ioctlRead and ioctlReadWrite calculate ioctl request numbers like the
+// _IOR and _IOWR macros of the generic Linux ABI.
+func ioctlRead(kind uintptr, nr uintptr, size uintptr) uintptr {
+	return 2 << 30 | size << 16 | kind << 8 | nr
+}
+
+func ioctlReadWrite(kind uintptr, nr uintptr, size uintptr) uintptr {
+	return 3 << 30 | size << 16 | kind << 8 | nr
+}
+
+func ioctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// cString converts a NUL-terminated byte array to a string.
+func cString(data []byte) string {
+	if end := bytes.IndexByte(data, 0); end >= 0 {
+		return string(data[:end])
+	}
+	return string(data)
+}
+
+// cdevGpio is the implementation of the GPIO interface based on the Linux
+// GPIO character device (/dev/gpiochipN), using version 2 of the ioctl ABI.
+type cdevGpio struct {
+	// Chip is the path of the character device. It is empty if the line is
+	// looked up by name.
+	Chip string
+	// Offset is the line number on the chip.
+	Offset uint32
+	// Name is the name of the line, if it is looked up by name.
+	Name string
+	// Output is the type of interface. If true, the line is configured as output.
+	Output bool
+	// ActiveLow inverts the logical state of the line.
+	ActiveLow bool
+	// line is the file descriptor of the line request
+	line *os.File
+	// watcher reports the edges of a watched line
+	watcher *edgeWatcher
+}
+
+// newCdevGpio parses a line specification of the form chip:offset or a line
+// name.
+func newCdevGpio(spec string, output bool, activelow bool) (Gpio, error) {
+	gpio := &cdevGpio{
+		Output: output,
+		ActiveLow: activelow,
+	}
+	if colon := strings.LastIndex(spec, ":"); colon >= 0 {
+		chip := spec[:colon]
+		offset, err := strconv.ParseUint(spec[colon + 1:], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(chip, "/") {
+			chip = "/dev/" + chip
+		}
+		gpio.Chip = chip
+		gpio.Offset = uint32(offset)
+	} else if spec != "" {
+		gpio.Name = spec
+	} else {
+		return nil, errors.New("GPIO line specification is empty")
+	}
+	return gpio, nil
+}
+
+func (g *cdevGpio) String() string {
+	if g.Name != "" {
+		return g.Name
+	}
+	return g.Chip + ":" + strconv.Itoa(int(g.Offset))
+}
+
+// lookup finds the chip and offset of a named line.
+func (g *cdevGpio) lookup() error {
+	chips, err := filepath.Glob("/dev/gpiochip*")
+	if err != nil {
+		return err
+	}
+	for _, path := range chips {
+		chip, err := os.Open(path)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		info := gpiochipInfo{}
+		err = ioctl(chip.Fd(), gpioGetChipInfoIoctl, unsafe.Pointer(&info))
+		if err != nil {
+			log.Print(err)
+			chip.Close()
+			continue
+		}
+		for offset := uint32(0); offset < info.Lines; offset++ {
+			lineinfo := gpioV2LineInfo{
+				Offset: offset,
+			}
+			if ioctl(chip.Fd(), gpioV2GetLineInfoIoctl, unsafe.Pointer(&lineinfo)) != nil {
+				continue
+			}
+			if cString(lineinfo.Name[:]) == g.Name {
+				chip.Close()
+				g.Chip = path
+				g.Offset = offset
+				log.Printf("Found GPIO line %s at %s:%d", g.Name, path, offset)
+				return nil
+			}
+		}
+		chip.Close()
+	}
+	return errors.New("GPIO line not found: " + g.Name)
+}
+
+func (g *cdevGpio) Init() error {
+	log.Printf("Enabling GPIO line %s as %s", g, map[bool]string{true:"output",false:"input"}[g.Output])
+
+	if g.Chip == "" {
+		if err := g.lookup(); err != nil {
+			return err
+		}
+	}
+
+	chip, err := os.Open(g.Chip)
+	if err != nil {
+		return err
+	}
+	defer chip.Close()
+
+	request := gpioV2LineRequest{
+		NumLines: 1,
+	}
+	request.Offsets[0] = g.Offset
+	copy(request.Consumer[:gpioMaxNameSize - 1], "shudder")
+	if g.Output {
+		request.Config.Flags = gpioV2LineFlagOutput
+		// start with the line switched off, the kernel applies the output
+		// value before changing the direction
+		request.Config.NumAttrs = 1
+		request.Config.Attrs[0] = gpioV2LineConfigAttribute{
+			Attr: gpioV2LineAttribute{
+				Id: gpioV2LineAttrIdOutputValues,
+				Value: 0,
+			},
+			Mask: 1,
+		}
+	} else {
+		request.Config.Flags = gpioV2LineFlagInput
+	}
+	if g.ActiveLow {
+		request.Config.Flags |= gpioV2LineFlagActiveLow
+	}
+	if err := ioctl(chip.Fd(), gpioV2GetLineIoctl, unsafe.Pointer(&request)); err != nil {
+		return err
+	}
+	g.line = os.NewFile(uintptr(request.Fd), g.String())
+	return nil
+}
+
+func (g *cdevGpio) Set(value bool) error {
+	log.Printf("Setting GPIO line %s to %d", g, map[bool]int{true:1,false:0}[value])
+
+	if g.line == nil {
+		return errors.New("GPIO line is not initialized: " + g.String())
+	}
+	values := gpioV2LineValues{
+		Mask: 1,
+	}
+	if value {
+		values.Bits = 1
+	}
+	return ioctl(g.line.Fd(), gpioV2LineSetValuesIoctl, unsafe.Pointer(&values))
+}
+
+func (g *cdevGpio) Get() (bool, error) {
+	// no logging here, inputs are polled every InputPollInterval
+	if g.line == nil {
+		return false, errors.New("GPIO line is not initialized: " + g.String())
+	}
+	values := gpioV2LineValues{
+		Mask: 1,
+	}
+	if err := ioctl(g.line.Fd(), gpioV2LineGetValuesIoctl, unsafe.Pointer(&values)); err != nil {
+		return false, err
+	}
+	return values.Bits & 1 != 0, nil
+}
+
+// Watch enables edge detection on the line request, and reads the line
+// events that the kernel queues for it.
+// Edges are timestamped by the kernel when the interrupt occurs, so the
+// timing is accurate even if the daemon is slow to pick them up.
+func (g *cdevGpio) Watch() (<-chan Edge, error) {
+	if g.line == nil {
+		return nil, errors.New("GPIO line is not initialized: " + g.String())
+	}
+	if g.Output {
+		return nil, errors.New("Can't watch output line: " + g.String())
+	}
+	if g.watcher != nil {
+		return nil, errors.New("GPIO line is already watched: " + g.String())
+	}
+
+	config := gpioV2LineConfig{
+		Flags: gpioV2LineFlagInput | gpioV2LineFlagEdgeRising | gpioV2LineFlagEdgeFalling,
+	}
+	if g.ActiveLow {
+		config.Flags |= gpioV2LineFlagActiveLow
+	}
+	if err := ioctl(g.line.Fd(), gpioV2LineSetConfigIoctl, unsafe.Pointer(&config)); err != nil {
+		return nil, err
+	}
+	watcher, err := newEdgeWatcher()
+	if err != nil {
+		return nil, err
+	}
+	g.watcher = watcher
+	go g.watch(watcher, int(g.line.Fd()))
+	return watcher.Edges, nil
+}
+
+// watch reports edges until the watcher is stopped.
+func (g *cdevGpio) watch(watcher *edgeWatcher, fd int) {
+	defer watcher.finish()
+
+	var events [GpioEdgeBuffer]gpioV2LineEvent
+	buffer := (*[unsafe.Sizeof(events)]byte)(unsafe.Pointer(&events))[:]
+	for watcher.wait(fd, pollIn) {
+		n, err := syscall.Read(fd, buffer)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Printf("Can't read events of GPIO line %s: %s\n", g, err)
+			return
+		}
+		// the timestamps are converted to wall clock time by their distance
+		// from the current monotonic time
+		now := time.Now()
+		monotonic, err := monotonicNow()
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		for i := 0; i < n / int(unsafe.Sizeof(events[0])); i++ {
+			edge := Edge{
+				Time: now.Add(-time.Duration(monotonic - events[i].TimestampNs)),
+			}
+			switch events[i].Id {
+				case gpioV2LineEventRisingEdge:
+					edge.Value = true
+				case gpioV2LineEventFallingEdge:
+					edge.Value = false
+				default:
+					continue
+			}
+			watcher.emit(edge)
+		}
+	}
+}
+
+// monotonicNow returns the current time of CLOCK_MONOTONIC in nanoseconds.
+func monotonicNow() (uint64, error) {
+	var now syscall.Timespec
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&now)), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return uint64(now.Nano()), nil
+}
+
+func (g *cdevGpio) Close() error {
+	log.Printf("Disabling GPIO line %s", g)
+
+	if g.watcher != nil {
+		g.watcher.Stop()
+		g.watcher = nil
+	}
+	if g.line == nil {
+		return nil
+	}
+	err := g.line.Close()
+	g.line = nil
+	return err
+}
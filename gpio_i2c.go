@@ -0,0 +1,397 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// I2C GPIO expanders that are supported.
+const (
+	// ExpanderMcp23017 has 16 lines in two ports, A0-A7 and B0-B7
+	ExpanderMcp23017 = "mcp23017"
+	// ExpanderPcf8574 has 8 quasi-bidirectional lines, 0-7
+	ExpanderPcf8574 = "pcf8574"
+)
+
+// Registers of the MCP23017, in the default IOCON.BANK=0 layout.
+// The register of port B follows the one of port A.
+const (
+	mcp23017Iodir = 0x00
+	mcp23017Gpio = 0x12
+	mcp23017Olat = 0x14
+)
+
+// I2cOpen connects to the device at an address on an I2C bus.
+// All reads and writes on the result are transfers with that device.
+// It can be replaced to talk to a fake device instead of the hardware.
+var I2cOpen func(bus int, address uint16) (io.ReadWriteCloser, error) = openI2cDevice
+
+// i2cChip is an expander that is shared by all of its lines.
+// Each line only changes its own bit. The registers are cached, so lines
+// can be changed without reading the chip first.
+type i2cChip struct {
+	kind string
+	bus int
+	address uint16
+	lock sync.Mutex
+	device io.ReadWriteCloser
+	// claimed has a bit set for each line that is in use
+	claimed uint16
+	// inputs has a bit set for each input line, like the IODIR registers
+	inputs uint16
+	// latch is the output state, like the OLAT registers
+	latch uint16
+}
+
+// i2cChips holds all expanders that have lines in use, by bus and address.
+var i2cChips = struct {
+	lock sync.Mutex
+	chips map[string]*i2cChip
+}{
+	chips: make(map[string]*i2cChip),
+}
+
+// expanderGpio is the implementation of the GPIO interface for a line of an
+// I2C GPIO expander.
+type expanderGpio struct {
+	// Kind is the type of the chip, ExpanderMcp23017 or ExpanderPcf8574
+	Kind string
+	// Bus is the number N of the I2C bus /dev/i2c-N
+	Bus int
+	// Address is the 7-bit address of the chip on the bus
+	Address uint16
+	// Line is the bit of the line, with port B of the MCP23017 starting at 8
+	Line uint
+	// Output is the type of interface. If true, the line is configured as output.
+	Output bool
+	// ActiveLow inverts the logical state of the line.
+	ActiveLow bool
+	// chip is set while the line is initialized
+	chip *i2cChip
+}
+
+// isExpanderSpec reports whether a line specification refers to an I2C GPIO
+// expander.
+func isExpanderSpec(spec string) bool {
+	return strings.HasPrefix(spec, ExpanderMcp23017 + ":") || strings.HasPrefix(spec, ExpanderPcf8574 + ":")
+}
+
+// newExpanderGpio parses a line specification of the form
+// chip:bus:address:line, for example mcp23017:1:0x20:B3 or pcf8574:1:0x20:3.
+func newExpanderGpio(spec string, output bool, activelow bool) (Gpio, error) {
+	fields := strings.Split(spec, ":")
+	if len(fields) != 4 {
+		return nil, errors.New("I2C GPIO line must be chip:bus:address:line: " + spec)
+	}
+	bus, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid I2C bus in %s: %s", spec, err)
+	}
+	address, err := strconv.ParseUint(fields[2], 0, 7)
+	if err != nil {
+		return nil, fmt.Errorf("invalid I2C address in %s: %s", spec, err)
+	}
+	gpio := &expanderGpio{
+		Kind: fields[0],
+		Bus: int(bus),
+		Address: uint16(address),
+		Output: output,
+		ActiveLow: activelow,
+	}
+	line := strings.ToUpper(fields[3])
+	switch gpio.Kind {
+		case ExpanderMcp23017:
+			if len(line) != 2 || (line[0] != 'A' && line[0] != 'B') || line[1] < '0' || line[1] > '7' {
+				return nil, errors.New("MCP23017 line must be A0-A7 or B0-B7: " + spec)
+			}
+			gpio.Line = uint(line[1] - '0')
+			if line[0] == 'B' {
+				gpio.Line += 8
+			}
+		case ExpanderPcf8574:
+			if len(line) != 1 || line[0] < '0' || line[0] > '7' {
+				return nil, errors.New("PCF8574 line must be 0-7: " + spec)
+			}
+			gpio.Line = uint(line[0] - '0')
+	}
+	return gpio, nil
+}
+
+func (g *expanderGpio) String() string {
+	line := strconv.Itoa(int(g.Line))
+	if g.Kind == ExpanderMcp23017 {
+		line = string("AB"[g.Line / 8]) + strconv.Itoa(int(g.Line % 8))
+	}
+	return fmt.Sprintf("%s:%d:%#x:%s", g.Kind, g.Bus, g.Address, line)
+}
+
+func (g *expanderGpio) Init() error {
+	log.Printf("Enabling GPIO line %s as %s", g, map[bool]string{true:"output",false:"input"}[g.Output])
+
+	if g.chip != nil {
+		return errors.New("GPIO line is already initialized: " + g.String())
+	}
+	chip, err := acquireI2cChip(g.Kind, g.Bus, g.Address, g.Line)
+	if err != nil {
+		return err
+	}
+	// output lines start out in the logical 0 state
+	if err := chip.setup(g.Line, g.Output, g.ActiveLow); err != nil {
+		releaseI2cChip(chip, g.Line)
+		return err
+	}
+	g.chip = chip
+	return nil
+}
+
+func (g *expanderGpio) Set(value bool) error {
+	log.Printf("Setting GPIO line %s to %d", g, map[bool]int{true:1,false:0}[value])
+
+	if g.chip == nil {
+		return errors.New("GPIO line is not initialized: " + g.String())
+	}
+	return g.chip.set(g.Line, value != g.ActiveLow)
+}
+
+func (g *expanderGpio) Get() (bool, error) {
+	if g.chip == nil {
+		return false, errors.New("GPIO line is not initialized: " + g.String())
+	}
+	level, err := g.chip.get(g.Line)
+	if err != nil {
+		return false, err
+	}
+	return level != g.ActiveLow, nil
+}
+
+// Close releases the line. Its state is left as it is, and the chip is
+// closed when its last line is released.
+func (g *expanderGpio) Close() error {
+	log.Printf("Disabling GPIO line %s", g)
+
+	if g.chip == nil {
+		return nil
+	}
+	err := releaseI2cChip(g.chip, g.Line)
+	g.chip = nil
+	return err
+}
+
+// acquireI2cChip claims a line of an expander and returns the shared state
+// of the chip. It connects to the chip if none of its lines are in use yet.
+func acquireI2cChip(kind string, bus int, address uint16, line uint) (*i2cChip, error) {
+	i2cChips.lock.Lock()
+	defer i2cChips.lock.Unlock()
+	key := fmt.Sprintf("%d:%#x", bus, address)
+	chip := i2cChips.chips[key]
+	if chip != nil {
+		if chip.kind != kind {
+			return nil, fmt.Errorf("I2C device %#x on bus %d is already used as %s", address, bus, chip.kind)
+		}
+		chip.lock.Lock()
+		defer chip.lock.Unlock()
+		if chip.claimed & (1 << line) != 0 {
+			return nil, fmt.Errorf("line %d of I2C device %#x on bus %d is already in use", line, address, bus)
+		}
+		chip.claimed |= 1 << line
+		return chip, nil
+	}
+	device, err := I2cOpen(bus, address)
+	if err != nil {
+		return nil, err
+	}
+	chip = &i2cChip{
+		kind: kind,
+		bus: bus,
+		address: address,
+		device: device,
+		claimed: 1 << line,
+	}
+	if err := chip.load(); err != nil {
+		device.Close()
+		return nil, err
+	}
+	i2cChips.chips[key] = chip
+	return chip, nil
+}
+
+// releaseI2cChip gives up a line of an expander, and disconnects from the
+// chip if it was the last one.
+func releaseI2cChip(chip *i2cChip, line uint) error {
+	i2cChips.lock.Lock()
+	defer i2cChips.lock.Unlock()
+	chip.lock.Lock()
+	defer chip.lock.Unlock()
+	chip.claimed &^= 1 << line
+	if chip.claimed != 0 {
+		return nil
+	}
+	delete(i2cChips.chips, fmt.Sprintf("%d:%#x", chip.bus, chip.address))
+	return chip.device.Close()
+}
+
+// load fills the register cache with the state of the chip, so lines that
+// are used by others keep their state.
+// The PCF8574 can't report its latch. It is assumed to be in its power-on
+// state, with all lines high.
+func (chip *i2cChip) load() error {
+	switch chip.kind {
+		case ExpanderMcp23017:
+			inputs, err := chip.readRegister(mcp23017Iodir)
+			if err != nil {
+				return err
+			}
+			latch, err := chip.readRegister(mcp23017Olat)
+			if err != nil {
+				return err
+			}
+			chip.inputs = inputs
+			chip.latch = latch
+		case ExpanderPcf8574:
+			chip.inputs = 0xff
+			chip.latch = 0xff
+	}
+	return nil
+}
+
+// setup sets the direction of a line. Output lines are set to level
+// before they are switched to output, so they don't glitch.
+func (chip *i2cChip) setup(line uint, output bool, level bool) error {
+	chip.lock.Lock()
+	defer chip.lock.Unlock()
+	inputs := chip.inputs | 1 << line
+	if output {
+		inputs &^= 1 << line
+	}
+	switch chip.kind {
+		case ExpanderMcp23017:
+			if output {
+				if err := chip.latchLine(line, level); err != nil {
+					return err
+				}
+			}
+			if err := chip.writeRegister(mcp23017Iodir, line / 8, inputs); err != nil {
+				return err
+			}
+		case ExpanderPcf8574:
+			// a line is an input while it is high, its pull-up can then be
+			// overridden from the outside
+			if !output {
+				level = true
+			}
+			if err := chip.latchLine(line, level); err != nil {
+				return err
+			}
+	}
+	chip.inputs = inputs
+	return nil
+}
+
+// set changes the electrical level of an output line.
+func (chip *i2cChip) set(line uint, level bool) error {
+	chip.lock.Lock()
+	defer chip.lock.Unlock()
+	return chip.latchLine(line, level)
+}
+
+// get reads the electrical level of a line.
+func (chip *i2cChip) get(line uint) (bool, error) {
+	chip.lock.Lock()
+	defer chip.lock.Unlock()
+	switch chip.kind {
+		case ExpanderMcp23017:
+			value, err := chip.readRegister(mcp23017Gpio)
+			if err != nil {
+				return false, err
+			}
+			return value & (1 << line) != 0, nil
+		case ExpanderPcf8574:
+			value := make([]byte, 1)
+			if _, err := io.ReadFull(chip.device, value); err != nil {
+				return false, err
+			}
+			return value[0] & (1 << line) != 0, nil
+	}
+	return false, nil
+}
+
+// latchLine changes a bit of the output latch and writes it to the chip.
+// Only the port that contains the line is written. The caller must hold
+// the chip lock.
+func (chip *i2cChip) latchLine(line uint, level bool) error {
+	latch := chip.latch
+	if level {
+		latch |= 1 << line
+	} else {
+		latch &^= 1 << line
+	}
+	var err error
+	switch chip.kind {
+		case ExpanderMcp23017:
+			err = chip.writeRegister(mcp23017Olat, line / 8, latch)
+		case ExpanderPcf8574:
+			err = chip.write([]byte{ byte(latch) })
+	}
+	if err != nil {
+		return err
+	}
+	chip.latch = latch
+	return nil
+}
+
+// readRegister reads a 16-bit register pair of the MCP23017, port A in the
+// low byte.
+func (chip *i2cChip) readRegister(register byte) (uint16, error) {
+	if err := chip.write([]byte{ register }); err != nil {
+		return 0, err
+	}
+	value := make([]byte, 2)
+	if _, err := io.ReadFull(chip.device, value); err != nil {
+		return 0, err
+	}
+	return uint16(value[0]) | uint16(value[1]) << 8, nil
+}
+
+// writeRegister writes one port of a 16-bit register pair of the MCP23017.
+func (chip *i2cChip) writeRegister(register byte, port uint, value uint16) error {
+	return chip.write([]byte{ register + byte(port), byte(value >> (8 * port)) })
+}
+
+// write sends a single transfer to the chip.
+func (chip *i2cChip) write(data []byte) error {
+	n, err := chip.device.Write(data)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
@@ -0,0 +1,312 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// fakeMcp23017 is an MCP23017 in the IOCON.BANK=0 layout, with sequential
+// register access.
+type fakeMcp23017 struct {
+	registers [0x16]byte
+	pointer byte
+	// pins are the levels applied to the input lines from the outside
+	pins uint16
+	// transfers are the writes to the chip
+	transfers [][]byte
+	closed bool
+}
+
+func newFakeMcp23017() *fakeMcp23017 {
+	chip := &fakeMcp23017{}
+	// all lines are inputs after power-on
+	chip.registers[mcp23017Iodir] = 0xff
+	chip.registers[mcp23017Iodir + 1] = 0xff
+	return chip
+}
+
+func (chip *fakeMcp23017) register(register byte) uint16 {
+	return uint16(chip.registers[register]) | uint16(chip.registers[register + 1]) << 8
+}
+
+func (chip *fakeMcp23017) Write(data []byte) (int, error) {
+	if chip.closed {
+		return 0, errors.New("write to closed device")
+	}
+	chip.transfers = append(chip.transfers, append([]byte{}, data...))
+	chip.pointer = data[0]
+	for _, value := range data[1:] {
+		chip.registers[chip.pointer] = value
+		chip.pointer++
+	}
+	return len(data), nil
+}
+
+func (chip *fakeMcp23017) Read(data []byte) (int, error) {
+	if chip.closed {
+		return 0, errors.New("read from closed device")
+	}
+	inputs := chip.register(mcp23017Iodir)
+	levels := chip.pins & inputs | chip.register(mcp23017Olat) &^ inputs
+	for i := range data {
+		switch chip.pointer {
+			case mcp23017Gpio:
+				data[i] = byte(levels)
+			case mcp23017Gpio + 1:
+				data[i] = byte(levels >> 8)
+			default:
+				data[i] = chip.registers[chip.pointer]
+		}
+		chip.pointer++
+	}
+	return len(data), nil
+}
+
+func (chip *fakeMcp23017) Close() error {
+	chip.closed = true
+	return nil
+}
+
+// fakePcf8574 is a PCF8574, whose lines are pulled low from the outside if
+// their bit in pins is clear.
+type fakePcf8574 struct {
+	latch byte
+	pins byte
+	closed bool
+}
+
+func (chip *fakePcf8574) Write(data []byte) (int, error) {
+	if chip.closed {
+		return 0, errors.New("write to closed device")
+	}
+	chip.latch = data[len(data) - 1]
+	return len(data), nil
+}
+
+func (chip *fakePcf8574) Read(data []byte) (int, error) {
+	if chip.closed {
+		return 0, errors.New("read from closed device")
+	}
+	for i := range data {
+		data[i] = chip.latch & chip.pins
+	}
+	return len(data), nil
+}
+
+func (chip *fakePcf8574) Close() error {
+	chip.closed = true
+	return nil
+}
+
+// fakeI2c connects I2C devices on bus 1 to fakes, by address.
+func fakeI2c(t *testing.T, devices map[uint16]io.ReadWriteCloser) {
+	open := I2cOpen
+	I2cOpen = func(bus int, address uint16) (io.ReadWriteCloser, error) {
+		device := devices[address]
+		if bus != 1 || device == nil {
+			return nil, fmt.Errorf("no I2C device %#x on bus %d", address, bus)
+		}
+		return device, nil
+	}
+	t.Cleanup(func() {
+		I2cOpen = open
+	})
+}
+
+// openExpanderLine creates and initializes a line.
+func openExpanderLine(t *testing.T, spec string, output bool, activelow bool) Gpio {
+	t.Helper()
+	gpio, err := NewGpio(spec, output, activelow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gpio.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		gpio.Close()
+	})
+	return gpio
+}
+
+func checkLevel(t *testing.T, gpio Gpio, expected bool) {
+	t.Helper()
+	value, err := gpio.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != expected {
+		t.Errorf("%s is %v, expected %v", gpio, value, expected)
+	}
+}
+
+func TestMcp23017Lines(t *testing.T) {
+	chip := newFakeMcp23017()
+	// B7 is an output that is set by someone else
+	chip.registers[mcp23017Iodir + 1] = 0x7f
+	chip.registers[mcp23017Olat + 1] = 0x80
+	fakeI2c(t, map[uint16]io.ReadWriteCloser{ 0x20: chip })
+
+	// active low outputs are set high before they are switched to output
+	relay := openExpanderLine(t, "mcp23017:1:0x20:A0", true, true)
+	expected := [][]byte{
+		{ mcp23017Iodir },
+		{ mcp23017Olat },
+		{ mcp23017Olat, 0x01 },
+		{ mcp23017Iodir, 0xfe },
+	}
+	if len(chip.transfers) != len(expected) {
+		t.Fatalf("transfers are %x, expected %x", chip.transfers, expected)
+	}
+	for i := range expected {
+		if !bytes.Equal(chip.transfers[i], expected[i]) {
+			t.Errorf("transfer %d is %x, expected %x", i, chip.transfers[i], expected[i])
+		}
+	}
+	checkLevel(t, relay, false)
+
+	led := openExpanderLine(t, "mcp23017:1:0x20:A1", true, false)
+	button := openExpanderLine(t, "mcp23017:1:0x20:b2", false, false)
+	if iodir := chip.register(mcp23017Iodir); iodir != 0x7ffc {
+		t.Errorf("IODIR is %#04x, expected 0x7ffc", iodir)
+	}
+	if olat := chip.register(mcp23017Olat); olat != 0x8001 {
+		t.Errorf("OLAT is %#04x, expected 0x8001", olat)
+	}
+
+	// each line only changes its own bit
+	if err := relay.Set(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := led.Set(true); err != nil {
+		t.Fatal(err)
+	}
+	if olat := chip.register(mcp23017Olat); olat != 0x8002 {
+		t.Errorf("OLAT is %#04x, expected 0x8002", olat)
+	}
+	checkLevel(t, relay, true)
+	checkLevel(t, led, true)
+	if err := led.Set(false); err != nil {
+		t.Fatal(err)
+	}
+	if olat := chip.register(mcp23017Olat); olat != 0x8000 {
+		t.Errorf("OLAT is %#04x, expected 0x8000", olat)
+	}
+
+	checkLevel(t, button, false)
+	chip.pins = 1 << 10
+	checkLevel(t, button, true)
+
+	// the chip is closed with its last line
+	for _, gpio := range []Gpio{ relay, led } {
+		if err := gpio.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if chip.closed {
+		t.Error("chip was closed while a line was in use")
+	}
+	if err := button.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !chip.closed {
+		t.Error("chip was not closed after its last line")
+	}
+}
+
+func TestPcf8574Lines(t *testing.T) {
+	chip := &fakePcf8574{ latch: 0xff, pins: 0xff }
+	fakeI2c(t, map[uint16]io.ReadWriteCloser{ 0x38: chip })
+
+	relay := openExpanderLine(t, "pcf8574:1:0x38:0", true, true)
+	if chip.latch != 0xff {
+		t.Errorf("latch is %#02x, expected 0xff", chip.latch)
+	}
+	led := openExpanderLine(t, "pcf8574:1:0x38:3", true, false)
+	button := openExpanderLine(t, "pcf8574:1:0x38:5", false, false)
+	if chip.latch != 0xf7 {
+		t.Errorf("latch is %#02x, expected 0xf7", chip.latch)
+	}
+
+	if err := relay.Set(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := led.Set(true); err != nil {
+		t.Fatal(err)
+	}
+	if chip.latch != 0xfe {
+		t.Errorf("latch is %#02x, expected 0xfe", chip.latch)
+	}
+	checkLevel(t, relay, true)
+	checkLevel(t, led, true)
+
+	// inputs stay high, so they can be pulled low
+	checkLevel(t, button, true)
+	chip.pins = 0xdf
+	checkLevel(t, button, false)
+}
+
+func TestExpanderErrors(t *testing.T) {
+	fakeI2c(t, map[uint16]io.ReadWriteCloser{
+		0x20: newFakeMcp23017(),
+		0x38: &fakePcf8574{ latch: 0xff, pins: 0xff },
+	})
+	openExpanderLine(t, "mcp23017:1:0x20:A0", true, false)
+	openExpanderLine(t, "pcf8574:1:0x38:0", true, false)
+
+	tests := []struct {
+		spec string
+		err string
+	}{
+		{ "mcp23017:1:0x20:C0", "must be A0-A7 or B0-B7" },
+		{ "mcp23017:1:0x20:A8", "must be A0-A7 or B0-B7" },
+		{ "pcf8574:1:0x38:8", "must be 0-7" },
+		{ "pcf8574:1:0x38", "must be chip:bus:address:line" },
+		{ "pcf8574:x:0x38:0", "invalid I2C bus" },
+		{ "pcf8574:1:0x80:0", "invalid I2C address" },
+		{ "mcp23017:1:0x20:a0", "already in use" },
+		{ "pcf8574:1:0x20:1", "already used as mcp23017" },
+		{ "pcf8574:1:0x39:0", "no I2C device" },
+	}
+	for _, test := range tests {
+		gpio, err := NewGpio(test.spec, true, false)
+		if err == nil {
+			err = gpio.Init()
+		}
+		if err == nil {
+			t.Errorf("%s was accepted", test.spec)
+			gpio.Close()
+		} else if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %q does not contain %q", test.spec, err, test.err)
+		}
+	}
+}
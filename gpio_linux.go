@@ -31,11 +31,15 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"errors"
+	"syscall"
+	"time"
 )
 
-// linuxGpio is the Linux-specific implementation of the GPIO interface.
-type linuxGpio struct {
+// sysfsGpio is the implementation of the GPIO interface based on the
+// deprecated sysfs interface in /sys/class/gpio.
+type sysfsGpio struct {
 	// Line is the GPIO line number.
 	// Linux uses a flat GPIO interface model with continuous numbering.
 	// Which GPIO is accessed, depends on the hardware configuration, usually
@@ -43,13 +47,45 @@ type linuxGpio struct {
 	Line int
 	// Output is the type of interface. If true, the line is configured as output.
 	Output bool
+	// ActiveLow inverts the logical state of the line.
+	ActiveLow bool
+	// watcher reports the edges of a watched line
+	watcher *edgeWatcher
 }
 
-// NewGpio creates a GPIO handler for a single GPIO line.
-// The implementation and the line ID format is platform specific.
-// For example, on Linux, the line is interpreted as an unsigned integer and
-// refers to a device in /sys/class/gpio/
-func NewGpio(spec string, output bool) (Gpio, error) {
+// newPlatformGpio creates a GPIO handler for a hardware GPIO line.
+// On Linux, the following formats are supported:
+//   gpiochip0:17  line 17 of /dev/gpiochip0, using the character device
+//   GPIO17        the line named GPIO17 on any chip, using the character device
+//   sysfs:17      line 17 in /sys/class/gpio/
+//   17            line 17, using the backend selected by GpioBackend
+func newPlatformGpio(spec string, output bool, activelow bool) (Gpio, error) {
+	if strings.HasPrefix(spec, "sysfs:") {
+		return newSysfsGpio(strings.TrimPrefix(spec, "sysfs:"), output, activelow)
+	}
+	if _, err := strconv.Atoi(spec); err != nil {
+		return newCdevGpio(spec, output, activelow)
+	}
+	backend := GpioBackend
+	if backend == "" {
+		// prefer the character device if the kernel supports it
+		if _, err := os.Stat("/dev/gpiochip0"); err == nil {
+			backend = GpioBackendCdev
+		} else {
+			backend = GpioBackendSysfs
+		}
+	}
+	switch backend {
+		case GpioBackendCdev:
+			return newCdevGpio("gpiochip0:" + spec, output, activelow)
+		case GpioBackendSysfs:
+			return newSysfsGpio(spec, output, activelow)
+		default:
+			return nil, errors.New("Unknown GPIO backend: " + backend)
+	}
+}
+
+func newSysfsGpio(spec string, output bool, activelow bool) (Gpio, error) {
 	line, err := strconv.Atoi(spec)
 	if err != nil {
 		return nil, err
@@ -57,13 +93,14 @@ func NewGpio(spec string, output bool) (Gpio, error) {
 	if line < 0 {
 		return nil, errors.New("GPIO line cannot be negative")
 	}
-	return &linuxGpio{
+	return &sysfsGpio{
 		Line: line,
 		Output: output,
+		ActiveLow: activelow,
 	}, nil
 }
 
-func (g *linuxGpio) Init() error {
+func (g *sysfsGpio) Init() error {
 	log.Printf("Enabling GPIO line %d as %s", g.Line, map[bool]string{true:"output",false:"input"}[g.Output])
 	
 	// Write the pin number to /sys/class/gpio/export
@@ -75,24 +112,44 @@ func (g *linuxGpio) Init() error {
 	export.Write([]byte(strconv.Itoa(g.Line)))
 	export.Close()
 	
-	// Write "in" or "out" to /sys/class/gpio/gpio??/direction
+	// Write "1" or "0" to /sys/class/gpio/gpio??/active_low
+	// The kernel inverts the value file accordingly.
+	activelow, err := os.Create("/sys/class/gpio/gpio" + strconv.Itoa(g.Line) + "/active_low")
+	if err != nil {
+		return err
+	}
+	if g.ActiveLow {
+		_, err = activelow.Write([]byte("1"))
+	} else {
+		_, err = activelow.Write([]byte("0"))
+	}
+	activelow.Close()
+	if err != nil {
+		return err
+	}
+
+	// Write "in", "low" or "high" to /sys/class/gpio/gpio??/direction
+	// "low" and "high" switch to output and set the electrical level in one
+	// step, so the line never glitches to the active state.
 	out, err := os.Create("/sys/class/gpio/gpio" + strconv.Itoa(g.Line) + "/direction")
 	if err != nil {
 		return err
 	}
 	defer out.Close()
 
-	if g.Output {
-		out.Write([]byte("out"))
+	if !g.Output {
+		_, err = out.Write([]byte("in"))
+	} else if g.ActiveLow {
+		_, err = out.Write([]byte("high"))
 	} else {
-		out.Write([]byte("in"))
+		_, err = out.Write([]byte("low"))
 	}
-	
-	return nil
+
+	return err
 }
 
-func (g *linuxGpio) Set(value bool) error {
-	log.Printf("Setting GPIO line %d to %s", g.Line, map[bool]int{true:1,false:0}[value])
+func (g *sysfsGpio) Set(value bool) error {
+	log.Printf("Setting GPIO line %d to %d", g.Line, map[bool]int{true:1,false:0}[value])
 
 	// Write "1" or "0" to /sys/class/gpio/gpio??/value
 	gpio, err := os.Create("/sys/class/gpio/gpio" + strconv.Itoa(g.Line) + "/value")
@@ -101,18 +158,17 @@ func (g *linuxGpio) Set(value bool) error {
 	}
 	defer gpio.Close()
 
+	// a failed write must be reported, the relay interlock relies on it
 	if value {
-		gpio.Write([]byte("1"))
+		_, err = gpio.Write([]byte("1"))
 	} else {
-		gpio.Write([]byte("0"))
+		_, err = gpio.Write([]byte("0"))
 	}
-	
-	return nil
+	return err
 }
 
-func (g *linuxGpio) Get() (bool, error) {
-	log.Printf("Getting value of GPIO line %d", g.Line)
-
+func (g *sysfsGpio) Get() (bool, error) {
+	// no logging here, inputs are polled every InputPollInterval
 	// Read from /sys/class/gpio/gpio??/value
 	gpio, err := os.Open("/sys/class/gpio/gpio" + strconv.Itoa(g.Line) + "/value")
 	if err != nil {
@@ -125,10 +181,8 @@ func (g *linuxGpio) Get() (bool, error) {
 	if n > 0 {
 		switch value[0] {
 			case '0':
-				log.Printf("Line is low")
 				return false, nil
 			case '1':
-				log.Printf("Line is high")
 				return true, nil
 			default:
 				return false, errors.New("Invalid state: " + string(value[0]))
@@ -141,3 +195,105 @@ func (g *linuxGpio) Get() (bool, error) {
 		return false, err
 	}
 }
+
+// Watch enables interrupts on both edges, and waits for them with poll(),
+// which reports them as POLLPRI on the value file.
+// Edges are timestamped when the interrupt is received. Changes that are
+// shorter than the interrupt latency may be missed.
+func (g *sysfsGpio) Watch() (<-chan Edge, error) {
+	if g.Output {
+		return nil, errors.New("Can't watch output line: " + strconv.Itoa(g.Line))
+	}
+	if g.watcher != nil {
+		return nil, errors.New("GPIO line is already watched: " + strconv.Itoa(g.Line))
+	}
+
+	// Write "both" to /sys/class/gpio/gpio??/edge
+	edge, err := os.Create("/sys/class/gpio/gpio" + strconv.Itoa(g.Line) + "/edge")
+	if err != nil {
+		return nil, err
+	}
+	_, err = edge.Write([]byte("both"))
+	edge.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := syscall.Open("/sys/class/gpio/gpio" + strconv.Itoa(g.Line) + "/value", syscall.O_RDONLY | syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := newEdgeWatcher()
+	if err != nil {
+		syscall.Close(value)
+		return nil, err
+	}
+	g.watcher = watcher
+	go g.watch(watcher, value)
+	return watcher.Edges, nil
+}
+
+// watch reports edges until the watcher is stopped.
+func (g *sysfsGpio) watch(watcher *edgeWatcher, fd int) {
+	defer watcher.finish()
+	defer syscall.Close(fd)
+
+	// reading the value file acknowledges the interrupt
+	last, err := sysfsValue(fd)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for watcher.wait(fd, pollPri | pollErr) {
+		value, err := sysfsValue(fd)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		if value != last {
+			last = value
+			watcher.emit(Edge{
+				Time: time.Now(),
+				Value: value,
+			})
+		}
+	}
+}
+
+// sysfsValue reads the state of a line from an open value file.
+func sysfsValue(fd int) (bool, error) {
+	value := make([]byte, 1)
+	n, err := syscall.Pread(fd, value, 0)
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, errors.New("Can't read from GPIO line: end of file")
+	}
+	switch value[0] {
+		case '0':
+			return false, nil
+		case '1':
+			return true, nil
+		default:
+			return false, errors.New("Invalid state: " + string(value[0]))
+	}
+}
+
+func (g *sysfsGpio) Close() error {
+	log.Printf("Disabling GPIO line %d", g.Line)
+
+	if g.watcher != nil {
+		g.watcher.Stop()
+		g.watcher = nil
+	}
+
+	// Write the pin number to /sys/class/gpio/unexport
+	unexport, err := os.Create("/sys/class/gpio/unexport")
+	if err != nil {
+		return err
+	}
+	defer unexport.Close()
+	_, err = unexport.Write([]byte(strconv.Itoa(g.Line)))
+	return err
+}
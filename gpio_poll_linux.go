@@ -0,0 +1,136 @@
+// +build linux
+
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"log"
+	"syscall"
+	"unsafe"
+)
+
+// Definitions from poll.h
+const (
+	pollIn = 0x1
+	pollPri = 0x2
+	pollErr = 0x8
+	pollHup = 0x10
+	pollNval = 0x20
+)
+
+type pollFd struct {
+	Fd int32
+	Events int16
+	Revents int16
+}
+
+// ppoll waits until one of the file descriptors is ready, without a timeout.
+func ppoll(fds []pollFd) error {
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&fds[0])), uintptr(len(fds)), 0, 0, 0, 0)
+		switch errno {
+			case 0:
+				return nil
+			case syscall.EINTR:
+				// interrupted by a signal of the Go runtime
+				continue
+			default:
+				return errno
+		}
+	}
+}
+
+// edgeWatcher is the background side of a watched input line.
+// It waits for interrupts on a file descriptor, and can be woken up from
+// another goroutine through a pipe when the line is closed.
+type edgeWatcher struct {
+	Edges chan Edge
+	// wake and stop are the read and write ends of the pipe
+	wake int
+	stop int
+	stopped chan struct{}
+	done chan struct{}
+}
+
+func newEdgeWatcher() (*edgeWatcher, error) {
+	var pipe [2]int
+	if err := syscall.Pipe2(pipe[:], syscall.O_CLOEXEC); err != nil {
+		return nil, err
+	}
+	return &edgeWatcher{
+		Edges: make(chan Edge, GpioEdgeBuffer),
+		wake: pipe[0],
+		stop: pipe[1],
+		stopped: make(chan struct{}),
+		done: make(chan struct{}),
+	}, nil
+}
+
+// wait blocks until one of the events occurs on the file descriptor.
+// Returns false if the watcher was stopped or the file descriptor failed.
+func (w *edgeWatcher) wait(fd int, events int16) bool {
+	fds := []pollFd{
+		{ Fd: int32(fd), Events: events },
+		{ Fd: int32(w.wake), Events: pollIn },
+	}
+	if err := ppoll(fds); err != nil {
+		log.Printf("Can't wait for GPIO edges: %s\n", err)
+		return false
+	}
+	if fds[1].Revents != 0 {
+		return false
+	}
+	if fds[0].Revents & (pollHup | pollNval) != 0 {
+		log.Printf("GPIO line was closed while waiting for edges\n")
+		return false
+	}
+	return true
+}
+
+// emit passes an edge on to the reader. It blocks while the buffer is full,
+// unless the watcher is stopped.
+func (w *edgeWatcher) emit(edge Edge) {
+	select {
+		case w.Edges <- edge:
+		case <-w.stopped:
+	}
+}
+
+// finish must be called by the background goroutine when it ends.
+func (w *edgeWatcher) finish() {
+	close(w.Edges)
+	syscall.Close(w.wake)
+	close(w.done)
+}
+
+// Stop wakes up the background goroutine and waits until it has finished.
+// The watched file descriptor must stay open until Stop returns.
+func (w *edgeWatcher) Stop() {
+	close(w.stopped)
+	syscall.Close(w.stop)
+	<-w.done
+}
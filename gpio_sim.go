@@ -0,0 +1,231 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// SimEvent is a recorded change of a simulated GPIO line.
+// Value is the logical state, Level the electrical one. They differ on
+// active-low lines.
+type SimEvent struct {
+	Time time.Time
+	Line string
+	Value bool
+	Level bool
+}
+
+// simBus holds all simulated GPIO lines and the timeline of their changes.
+// Lines with the same name share their state.
+var simBus = struct {
+	lock sync.Mutex
+	clock Clock
+	lines map[string]*SimGpio
+	timeline []SimEvent
+}{
+	clock: SystemClock,
+	lines: make(map[string]*SimGpio),
+}
+
+// SimGpio is an in-memory implementation of the GPIO interface.
+// It records every change of an output line and allows injecting the state
+// of input lines, so the behaviour of the daemon can be tested and
+// demonstrated without hardware.
+type SimGpio struct {
+	Name string
+	Output bool
+	ActiveLow bool
+	lock sync.Mutex
+	initialized bool
+	value bool
+	history []SimEvent
+	watcher chan Edge
+}
+
+// newSimGpio returns the simulated line with the given name, creating it if
+// necessary.
+func newSimGpio(name string, output bool, activelow bool) (Gpio, error) {
+	if name == "" {
+		return nil, errors.New("simulated GPIO line needs a name")
+	}
+	simBus.lock.Lock()
+	defer simBus.lock.Unlock()
+	gpio := simBus.lines[name]
+	if gpio == nil {
+		gpio = &SimGpio{
+			Name: name,
+		}
+		simBus.lines[name] = gpio
+	}
+	gpio.Output = output
+	gpio.ActiveLow = activelow
+	return gpio, nil
+}
+
+// SimLine looks up a simulated line by name. Returns nil if it doesn't exist.
+func SimLine(name string) *SimGpio {
+	simBus.lock.Lock()
+	defer simBus.lock.Unlock()
+	return simBus.lines[name]
+}
+
+// SimTimeline returns all changes of simulated lines, in chronological order.
+func SimTimeline() []SimEvent {
+	simBus.lock.Lock()
+	defer simBus.lock.Unlock()
+	timeline := make([]SimEvent, len(simBus.timeline))
+	copy(timeline, simBus.timeline)
+	return timeline
+}
+
+// SimReset forgets all simulated lines and the recorded timeline.
+// Subsequent changes are timestamped with the given clock.
+func SimReset(clock Clock) {
+	simBus.lock.Lock()
+	defer simBus.lock.Unlock()
+	simBus.clock = clock
+	simBus.lines = make(map[string]*SimGpio)
+	simBus.timeline = nil
+}
+
+func (g *SimGpio) Init() error {
+	log.Printf("Enabling simulated GPIO line %s as %s", g.Name, map[bool]string{true:"output",false:"input"}[g.Output])
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.initialized = true
+	if g.Output && g.value {
+		g.record(false)
+	}
+	return nil
+}
+
+func (g *SimGpio) Set(value bool) error {
+	log.Printf("Setting simulated GPIO line %s to %d", g.Name, map[bool]int{true:1,false:0}[value])
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if !g.initialized {
+		return errors.New("GPIO line is not initialized: " + g.Name)
+	}
+	g.record(value)
+	return nil
+}
+
+func (g *SimGpio) Get() (bool, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if !g.initialized {
+		return false, errors.New("GPIO line is not initialized: " + g.Name)
+	}
+	return g.value, nil
+}
+
+func (g *SimGpio) Close() error {
+	log.Printf("Disabling simulated GPIO line %s", g.Name)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.initialized = false
+	if g.watcher != nil {
+		close(g.watcher)
+		g.watcher = nil
+	}
+	return nil
+}
+
+// Watch reports changes of an input line, such as the ones caused by Inject.
+// Edges are dropped if the reader falls too far behind.
+func (g *SimGpio) Watch() (<-chan Edge, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if !g.initialized {
+		return nil, errors.New("GPIO line is not initialized: " + g.Name)
+	}
+	if g.Output {
+		return nil, errors.New("Can't watch output line: " + g.Name)
+	}
+	if g.watcher != nil {
+		return nil, errors.New("GPIO line is already watched: " + g.Name)
+	}
+	g.watcher = make(chan Edge, GpioEdgeBuffer)
+	return g.watcher, nil
+}
+
+// Inject changes the state of the line from the outside, like a button or
+// sensor connected to an input would.
+func (g *SimGpio) Inject(value bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.record(value)
+}
+
+// History returns the changes of this line, in chronological order.
+func (g *SimGpio) History() []SimEvent {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	history := make([]SimEvent, len(g.history))
+	copy(history, g.history)
+	return history
+}
+
+// Value returns the current logical state of the line, regardless of
+// initialisation.
+func (g *SimGpio) Value() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.value
+}
+
+// record stores a change of the line. The caller must hold the line lock.
+func (g *SimGpio) record(value bool) {
+	simBus.lock.Lock()
+	defer simBus.lock.Unlock()
+	event := SimEvent{
+		Time: simBus.clock.Now(),
+		Line: g.Name,
+		Value: value,
+		Level: value != g.ActiveLow,
+	}
+	if g.watcher != nil && value != g.value {
+		select {
+			case g.watcher <- Edge{ Time: event.Time, Value: value }:
+			default:
+				log.Printf("Dropping edge of simulated GPIO line %s\n", g.Name)
+		}
+	}
+	g.value = value
+	g.history = append(g.history, event)
+	simBus.timeline = append(simBus.timeline, event)
+}
+
+// Level returns the current electrical state of the line.
+func (g *SimGpio) Level() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.value != g.ActiveLow
+}
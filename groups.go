@@ -0,0 +1,224 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// GroupAll is the implicit group that contains every shutter.
+const GroupAll = "all"
+
+var ErrUnknownGroup = errors.New("unknown group")
+
+// ShutterGroup is a named set of shutters that are controlled together.
+type ShutterGroup struct {
+	Name string
+	// Members are the shutters and groups as configured
+	Members []string
+	// Shutters are all shutters of the group, including those of nested
+	// groups, sorted by name
+	Shutters []string
+}
+
+// ExpandGroups resolves nested groups into the shutters that they contain,
+// including the implicit GroupAll.
+// Unknown members and groups that contain themselves are rejected.
+func (config *Configuration) ExpandGroups() (map[string]*ShutterGroup, error) {
+	shutters := make(map[string]bool)
+	all := &ShutterGroup{
+		Name: GroupAll,
+	}
+	for _, shutter := range config.Shutters {
+		shutters[shutter.Name] = true
+		all.Members = append(all.Members, shutter.Name)
+	}
+	sort.Strings(all.Members)
+	all.Shutters = all.Members
+	groups := map[string]*ShutterGroup{
+		GroupAll: all,
+	}
+
+	// groups that are being expanded, to detect cycles
+	expanding := make(map[string]bool)
+	var expand func(name string) (*ShutterGroup, error)
+	expand = func(name string) (*ShutterGroup, error) {
+		if group := groups[name]; group != nil {
+			return group, nil
+		}
+		if expanding[name] {
+			return nil, fmt.Errorf("group %s contains itself", name)
+		}
+		expanding[name] = true
+		defer delete(expanding, name)
+
+		group := &ShutterGroup{
+			Name: name,
+			Members: config.Groups[name],
+		}
+		contained := make(map[string]bool)
+		for _, member := range group.Members {
+			if shutters[member] {
+				contained[member] = true
+				continue
+			}
+			if _, ok := config.Groups[member]; !ok && member != GroupAll {
+				return nil, fmt.Errorf("unknown member %s of group %s", member, name)
+			}
+			nested, err := expand(member)
+			if err != nil {
+				return nil, err
+			}
+			for _, shutter := range nested.Shutters {
+				contained[shutter] = true
+			}
+		}
+		group.Shutters = make([]string, 0, len(contained))
+		for shutter := range contained {
+			group.Shutters = append(group.Shutters, shutter)
+		}
+		sort.Strings(group.Shutters)
+		groups[name] = group
+		return group, nil
+	}
+
+	for name := range config.Groups {
+		if name == "" {
+			return nil, errors.New("group name cannot be empty")
+		}
+		if name == GroupAll {
+			return nil, fmt.Errorf("group %s is implicit and cannot be configured", GroupAll)
+		}
+		if strings.Contains(name, "/") {
+			return nil, fmt.Errorf("group name %s cannot contain /", name)
+		}
+		if shutters[name] {
+			return nil, fmt.Errorf("group %s has the same name as a shutter", name)
+		}
+		if _, err := expand(name); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+// GroupResult is the outcome of a command on a group.
+type GroupResult struct {
+	// Jobs are the jobs that were queued, by shutter
+	Jobs map[string][]*Job
+	// Errors are the failures, by shutter
+	Errors map[string]error
+}
+
+// DispatchGroup carries out a sequence of commands on all shutters of a
+// group in parallel.
+func (state *ShutterState) DispatchGroup(name string, commands ...Command) (*GroupResult, error) {
+	group := state.Groups[name]
+	if group == nil {
+		return nil, ErrUnknownGroup
+	}
+	targets := make(map[string][]Command)
+	for _, shutter := range group.Shutters {
+		targets[shutter] = commands
+	}
+	return state.dispatchAll("group " + name, targets), nil
+}
+
+// dispatchAll carries out commands on several shutters in parallel.
+// On each shutter, the commands are dispatched in order until one fails.
+// The origin describes the caller in log messages.
+func (state *ShutterState) dispatchAll(origin string, targets map[string][]Command) *GroupResult {
+	result := &GroupResult{
+		Jobs: make(map[string][]*Job),
+		Errors: make(map[string]error),
+	}
+	var lock sync.Mutex
+	var wait sync.WaitGroup
+	for shutter, commands := range targets {
+		wait.Add(1)
+		go func(shutter string, commands []Command) {
+			defer wait.Done()
+			jobs := make([]*Job, 0, len(commands))
+			var err error
+			for _, command := range commands {
+				var job *Job
+				job, err = state.Dispatch(shutter, command)
+				if err != nil {
+					log.Printf("Command %s on shutter %s of %s failed: %s\n", command.Action, shutter, origin, err)
+					break
+				}
+				if job != nil {
+					jobs = append(jobs, job)
+				}
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			result.Jobs[shutter] = jobs
+			if err != nil {
+				result.Errors[shutter] = err
+			}
+		}(shutter, commands)
+	}
+	wait.Wait()
+	return result
+}
+
+// groupReport returns a serialisable summary of the state of a group.
+// Position and angle are averaged over all shutters, and the group counts as
+// moving if any of its shutters is.
+func groupReport(state *ShutterState, group *ShutterGroup) map[string]interface{} {
+	shutters := make([]interface{}, 0, len(group.Shutters))
+	var position, angle float32
+	moving := false
+	queued := 0
+	for _, name := range group.Shutters {
+		shutter := state.Shutters[name]
+		status := shutter.Status()
+		position += status.Position
+		angle += status.Angle
+		moving = moving || status.Moving
+		queued += status.Queued
+		shutters = append(shutters, shutterReport(shutter))
+	}
+	if len(group.Shutters) > 0 {
+		position /= float32(len(group.Shutters))
+		angle /= float32(len(group.Shutters))
+	}
+	return map[string]interface{}{
+		"name": group.Name,
+		"members": group.Members,
+		"position": position,
+		"angle": angle,
+		"moving": moving,
+		"queued": queued,
+		"shutters": shutters,
+	}
+}
@@ -0,0 +1,137 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandGroups(t *testing.T) {
+	tests := []struct {
+		groups map[string][]string
+		// expected are the shutters of each group, or err a part of the
+		// error message
+		expected map[string][]string
+		err string
+	}{
+		{
+			groups: nil,
+			expected: map[string][]string{ GroupAll: { "1", "2", "3" } },
+		},
+		{
+			groups: map[string][]string{
+				"south": { "2", "1" },
+				"ground": { "south", "3" },
+				"both": { "ground", "1" },
+				"everything": { GroupAll },
+			},
+			expected: map[string][]string{
+				GroupAll: { "1", "2", "3" },
+				"south": { "1", "2" },
+				"ground": { "1", "2", "3" },
+				"both": { "1", "2", "3" },
+				"everything": { "1", "2", "3" },
+			},
+		},
+		{
+			groups: map[string][]string{ "empty": {} },
+			expected: map[string][]string{ GroupAll: { "1", "2", "3" }, "empty": {} },
+		},
+		{ groups: map[string][]string{ "loop": { "loop" } }, err: "group loop contains itself" },
+		{ groups: map[string][]string{ "a": { "b" }, "b": { "1", "a" } }, err: "contains itself" },
+		{ groups: map[string][]string{ "a": { "b" }, "b": { "c" }, "c": { "a" } }, err: "contains itself" },
+		{ groups: map[string][]string{ "south": { "1", "4" } }, err: "unknown member 4 of group south" },
+		{ groups: map[string][]string{ "south": { "1" }, "ground": { "north" } }, err: "unknown member north of group ground" },
+		{ groups: map[string][]string{ GroupAll: { "1" } }, err: "is implicit" },
+		{ groups: map[string][]string{ "1": { "2" } }, err: "same name as a shutter" },
+		{ groups: map[string][]string{ "a/b": { "1" } }, err: "cannot contain /" },
+		{ groups: map[string][]string{ "": { "1" } }, err: "cannot be empty" },
+	}
+	for _, test := range tests {
+		config := &Configuration{
+			Shutters: []ShutterConfiguration{ { Name: "3" }, { Name: "1" }, { Name: "2" } },
+			Groups: test.groups,
+		}
+		groups, err := config.ExpandGroups()
+		if test.err != "" {
+			if err == nil {
+				t.Errorf("%v was accepted", test.groups)
+			} else if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%v: error %q does not contain %q", test.groups, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %s", test.groups, err)
+			continue
+		}
+		expanded := make(map[string][]string)
+		for name, group := range groups {
+			expanded[name] = group.Shutters
+		}
+		if !reflect.DeepEqual(expanded, test.expected) {
+			t.Errorf("%v expands to %v, expected %v", test.groups, expanded, test.expected)
+		}
+	}
+}
+
+func TestDispatchGroup(t *testing.T) {
+	state, _ := newTestState(t, "1", "2", "3", "4")
+	state.Groups["south"] = &ShutterGroup{
+		Name: "south",
+		Members: []string{ "1", "2", "3" },
+		Shutters: []string{ "1", "2", "3" },
+	}
+	// commands to a shutter that is gone fail, the others go ahead
+	state.Shutters["3"].Shutdown()
+
+	result, err := state.DispatchGroup("south", Command{ Action: ActionMove, Position: 40 }, Command{ Action: ActionFlip, Angle: 0.5 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shutter := range []string{ "1", "2" } {
+		jobs := result.Jobs[shutter]
+		if len(jobs) != 2 || jobs[0].Command.Action != ActionMove || jobs[1].Command.Action != ActionFlip {
+			t.Errorf("jobs of shutter %s are %v, expected a move and a flip", shutter, jobs)
+		}
+		if result.Errors[shutter] != nil {
+			t.Errorf("shutter %s failed: %s", shutter, result.Errors[shutter])
+		}
+		energised(t, shutter + "d")
+	}
+	if len(result.Jobs["3"]) != 0 || result.Errors["3"] != ErrShutdown {
+		t.Errorf("shutter 3 has jobs %v and error %v, expected %v", result.Jobs["3"], result.Errors["3"], ErrShutdown)
+	}
+	if _, ok := result.Jobs["4"]; ok || SimLine("4d").Value() {
+		t.Error("shutter 4 is not in the group, but got commands")
+	}
+
+	if _, err := state.DispatchGroup("north", Command{ Action: ActionStop }); err != ErrUnknownGroup {
+		t.Errorf("unknown group returned %v, expected %v", err, ErrUnknownGroup)
+	}
+}
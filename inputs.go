@@ -0,0 +1,348 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Default timing of wall switches.
+const (
+	// DefaultDebounce is how long an input must be stable to be accepted
+	DefaultDebounce = 30 * time.Millisecond
+	// DefaultLongPress is how long a button must be held to run the shutter
+	// to the end
+	DefaultLongPress = 600 * time.Millisecond
+)
+
+// InputPollInterval is the time between samples of the input lines.
+const InputPollInterval = 10 * time.Millisecond
+
+// SwitchSlatStep is how far a short press turns the slats.
+const SwitchSlatStep = 0.25
+
+// switchButton is a single wall switch button. It debounces the input and
+// tells short presses from long ones.
+type switchButton struct {
+	shutter string
+	direction Direction
+	line Gpio
+	// watched is set if the line reports its edges, and doesn't need to be
+	// polled
+	watched bool
+	// stable is the debounced state, raw the last sample and changed the
+	// time when raw last changed
+	stable bool
+	raw bool
+	changed time.Time
+	// pressed is when the current press started
+	pressed time.Time
+	// handled is set when the current press has already been acted upon
+	handled bool
+}
+
+// InputController carries out the commands of wall switches.
+// Each shutter can have an up and a down button. A short press turns the
+// slats one step, holding a button runs the shutter to the end, and any
+// press while the shutter is moving stops it.
+type InputController struct {
+	state *ShutterState
+	clock Clock
+	Debounce time.Duration
+	LongPress time.Duration
+	buttons []*switchButton
+	lock sync.Mutex
+	started bool
+	closed bool
+	closing chan struct{}
+	finished chan struct{}
+}
+
+func NewInputController(state *ShutterState, clock Clock, debounce time.Duration, longpress time.Duration) *InputController {
+	return &InputController{
+		state: state,
+		clock: clock,
+		Debounce: debounce,
+		LongPress: longpress,
+		closing: make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+}
+
+// Add registers a button that moves a shutter in a direction.
+// Must be called before Init.
+func (controller *InputController) Add(shutter string, direction Direction, line Gpio) {
+	controller.buttons = append(controller.buttons, &switchButton{
+		shutter: shutter,
+		direction: direction,
+		line: line,
+	})
+}
+
+// Init sets up all input lines. Buttons whose lines fail are removed.
+func (controller *InputController) Init() {
+	buttons := make([]*switchButton, 0, len(controller.buttons))
+	for _, button := range controller.buttons {
+		if err := button.line.Init(); err != nil {
+			log.Printf("Can't initialize %s button of shutter %s: %s\n", button.direction, button.shutter, err)
+			continue
+		}
+		buttons = append(buttons, button)
+	}
+	controller.buttons = buttons
+}
+
+// inputEdge is an edge of the line of a button.
+type inputEdge struct {
+	button *switchButton
+	edge Edge
+}
+
+// Run watches the buttons, until the controller is closed.
+// Lines that report edges are watched without polling. The others are
+// sampled every InputPollInterval.
+func (controller *InputController) Run() {
+	controller.lock.Lock()
+	if controller.closed || len(controller.buttons) == 0 {
+		controller.lock.Unlock()
+		return
+	}
+	controller.started = true
+	controller.lock.Unlock()
+	defer close(controller.finished)
+
+	edges := make(chan inputEdge)
+	polled := 0
+	now := controller.clock.Now()
+	for _, button := range controller.buttons {
+		if watched, ok := button.line.(EdgeGpio); ok {
+			changes, err := watched.Watch()
+			if err == nil {
+				if value, err := button.line.Get(); err == nil {
+					controller.sample(button, value, now)
+				}
+				button.watched = true
+				go controller.forward(button, changes, edges)
+				continue
+			}
+			log.Printf("Can't watch %s button of shutter %s, polling instead: %s\n", button.direction, button.shutter, err)
+		}
+		polled++
+	}
+
+	for {
+		now := controller.clock.Now()
+		for _, button := range controller.buttons {
+			value := button.raw
+			if !button.watched {
+				var err error
+				if value, err = button.line.Get(); err != nil {
+					continue
+				}
+			}
+			controller.sample(button, value, now)
+		}
+
+		// without polled lines, only wake up when the debouncer or a press
+		// has to be checked
+		var timer Timer
+		var timeout <-chan time.Time
+		wait, pending := controller.nextDeadline(now)
+		if polled > 0 && (!pending || wait > InputPollInterval) {
+			wait = InputPollInterval
+			pending = true
+		}
+		if pending {
+			timer = controller.clock.NewTimer(wait)
+			timeout = timer.C()
+		}
+		select {
+			case <-timeout:
+			case change := <-edges:
+				controller.sample(change.button, change.edge.Value, change.edge.Time)
+			case <-controller.closing:
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// forward passes the edges of a button on to Run.
+func (controller *InputController) forward(button *switchButton, changes <-chan Edge, edges chan<- inputEdge) {
+	for edge := range changes {
+		select {
+			case edges <- inputEdge{ button: button, edge: edge }:
+			case <-controller.closing:
+				return
+		}
+	}
+}
+
+// nextDeadline returns how long it takes until a button changes its state
+// without further input: when a change of its line has been stable for long
+// enough, or when a press becomes a long press.
+// pending is false if no button is waiting for either.
+func (controller *InputController) nextDeadline(now time.Time) (wait time.Duration, pending bool) {
+	for _, button := range controller.buttons {
+		var deadline time.Time
+		if button.raw != button.stable {
+			deadline = button.changed.Add(controller.Debounce)
+		} else if button.stable && !button.handled {
+			deadline = button.pressed.Add(controller.LongPress)
+		} else {
+			continue
+		}
+		if !pending || deadline.Sub(now) < wait {
+			wait = deadline.Sub(now)
+			pending = true
+		}
+	}
+	return wait, pending
+}
+
+// Close stops watching the buttons and releases their lines.
+func (controller *InputController) Close() {
+	controller.lock.Lock()
+	if controller.closed {
+		controller.lock.Unlock()
+		return
+	}
+	controller.closed = true
+	started := controller.started
+	close(controller.closing)
+	controller.lock.Unlock()
+	if started {
+		<-controller.finished
+	}
+	for _, button := range controller.buttons {
+		if err := button.line.Close(); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// sample feeds the state of a button at a point in time into the debouncer,
+// and acts on presses, releases and long presses.
+func (controller *InputController) sample(button *switchButton, value bool, now time.Time) {
+	if value != button.raw {
+		button.raw = value
+		button.changed = now
+	}
+	if button.raw != button.stable && now.Sub(button.changed) >= controller.Debounce {
+		button.stable = button.raw
+		if button.stable {
+			controller.press(button, now)
+		} else {
+			controller.release(button)
+		}
+	}
+	if button.stable && !button.handled && now.Sub(button.pressed) >= controller.LongPress {
+		controller.longPress(button)
+	}
+}
+
+// press handles the start of a press. A moving shutter is stopped right
+// away, and nothing else happens until the button is released.
+// Pressing both buttons of a shutter at once also stops it, and neither
+// press does anything else.
+func (controller *InputController) press(button *switchButton, now time.Time) {
+	button.pressed = now
+	button.handled = false
+	for _, other := range controller.buttons {
+		if other != button && other.shutter == button.shutter && other.stable {
+			log.Printf("Both wall switch buttons of shutter %s are pressed, stopping\n", button.shutter)
+			button.handled = true
+			other.handled = true
+			controller.dispatch(button, Command{
+				Action: ActionStop,
+			})
+			return
+		}
+	}
+	shutter := controller.state.Shutters[button.shutter]
+	status := shutter.Status()
+	if status.Moving || status.Queued > 0 {
+		log.Printf("Wall switch stops shutter %s\n", button.shutter)
+		button.handled = true
+		controller.dispatch(button, Command{
+			Action: ActionStop,
+		})
+	}
+}
+
+// release handles the end of a short press, which turns the slats a step.
+func (controller *InputController) release(button *switchButton) {
+	if button.handled {
+		return
+	}
+	button.handled = true
+	angle := controller.state.Shutters[button.shutter].Status().Angle
+	if button.direction == DirectionUp {
+		angle -= SwitchSlatStep
+	} else {
+		angle += SwitchSlatStep
+	}
+	if angle < AngleMin {
+		angle = AngleMin
+	}
+	if angle > AngleMax {
+		angle = AngleMax
+	}
+	log.Printf("Wall switch turns slats of shutter %s to %f\n", button.shutter, angle)
+	controller.dispatch(button, Command{
+		Action: ActionFlip,
+		Angle: angle,
+	})
+}
+
+// longPress runs the shutter to the end in the direction of the button.
+func (controller *InputController) longPress(button *switchButton) {
+	button.handled = true
+	position := float32(PositionMax)
+	if button.direction == DirectionUp {
+		position = PositionMin
+	}
+	log.Printf("Wall switch moves shutter %s %s\n", button.shutter, button.direction)
+	controller.dispatch(button, Command{
+		Action: ActionMove,
+		Position: position,
+	})
+}
+
+// dispatch carries out a command like any other manual one, so the position
+// is tracked and the shade automation is switched off.
+func (controller *InputController) dispatch(button *switchButton, command Command) {
+	if _, err := controller.state.Dispatch(button.shutter, command); err != nil {
+		log.Printf("Wall switch command on shutter %s failed: %s\n", button.shutter, err)
+	}
+}
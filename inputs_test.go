@@ -0,0 +1,293 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestInputs creates a wall switch controller for shutter 1, with an up
+// and a down button on the simulated lines 1up and 1down.
+func newTestInputs(t *testing.T) (*ShutterState, *FakeClock, *InputController) {
+	state, clock := newTestState(t, "1")
+	controller := NewInputController(state, clock, DefaultDebounce, DefaultLongPress)
+	for _, direction := range []Direction{ DirectionUp, DirectionDown } {
+		line, err := NewGpio("sim:1" + direction.String(), false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		controller.Add("1", direction, line)
+	}
+	return state, clock, controller
+}
+
+// inputSample is a state of a button, relative to testEpoch.
+type inputSample struct {
+	At time.Duration
+	Value bool
+}
+
+// feed passes samples of a button to the debouncer.
+func feed(controller *InputController, direction Direction, samples ...inputSample) {
+	for _, button := range controller.buttons {
+		if button.direction != direction {
+			continue
+		}
+		for _, sample := range samples {
+			controller.sample(button, sample.Value, testEpoch.Add(sample.At))
+		}
+	}
+}
+
+// commands returns the commands of all jobs of a shutter, in order.
+func commands(shutter *Shutter) []Command {
+	queued := make([]Command, 0)
+	for _, id := range shutter.Jobs() {
+		if job := shutter.Job(id); job != nil {
+			queued = append(queued, job.Command)
+		}
+	}
+	return queued
+}
+
+func checkCommands(t *testing.T, shutter *Shutter, expected ...Command) {
+	t.Helper()
+	if queued := commands(shutter); !reflect.DeepEqual(queued, append([]Command{}, expected...)) {
+		t.Errorf("commands are %v, expected %v", queued, expected)
+	}
+}
+
+func TestSwitchDebounce(t *testing.T) {
+	state, _, controller := newTestInputs(t)
+	button := controller.buttons[1]
+
+	// bouncing contacts are ignored
+	feed(controller, DirectionDown,
+		inputSample{ 0, true },
+		inputSample{ 10 * time.Millisecond, false },
+		inputSample{ 20 * time.Millisecond, true },
+		inputSample{ 25 * time.Millisecond, false },
+		inputSample{ 54 * time.Millisecond, true },
+		inputSample{ 80 * time.Millisecond, false },
+		inputSample{ 200 * time.Millisecond, false },
+	)
+	if button.stable {
+		t.Error("bouncing button is pressed")
+	}
+	checkCommands(t, state.Shutters["1"])
+
+	// a stable press is recognised after the debounce time
+	feed(controller, DirectionDown,
+		inputSample{ 300 * time.Millisecond, true },
+		inputSample{ 300 * time.Millisecond + DefaultDebounce - time.Millisecond, true },
+	)
+	if button.stable {
+		t.Error("button is pressed before the debounce time")
+	}
+	feed(controller, DirectionDown, inputSample{ 300 * time.Millisecond + DefaultDebounce, true })
+	if !button.stable {
+		t.Error("button is not pressed after the debounce time")
+	}
+	// and so is a release, even if the contact bounces
+	feed(controller, DirectionDown,
+		inputSample{ 400 * time.Millisecond, false },
+		inputSample{ 405 * time.Millisecond, true },
+		inputSample{ 410 * time.Millisecond, false },
+		inputSample{ 439 * time.Millisecond, false },
+	)
+	if !button.stable {
+		t.Error("button is released before the debounce time")
+	}
+	feed(controller, DirectionDown, inputSample{ 440 * time.Millisecond, false })
+	if button.stable {
+		t.Error("button is not released after the debounce time")
+	}
+}
+
+func TestSwitchShortPress(t *testing.T) {
+	state, clock, controller := newTestInputs(t)
+	shutter := state.Shutters["1"]
+
+	feed(controller, DirectionDown,
+		inputSample{ 0, true },
+		inputSample{ 30 * time.Millisecond, true },
+		inputSample{ 200 * time.Millisecond, false },
+	)
+	checkCommands(t, shutter)
+	feed(controller, DirectionDown, inputSample{ 230 * time.Millisecond, false })
+	step := Command{ Action: ActionFlip, Angle: SwitchSlatStep }
+	checkCommands(t, shutter, step)
+
+	// the slats turn back from where they are
+	energised(t, "1u")
+	clock.Advance(time.Second)
+	reversing(t, clock, "1u")
+	clock.Advance(500 * time.Millisecond)
+	energised(t, "1d")
+	clock.Advance(250 * time.Millisecond)
+	finished(t, shutter.Job(shutter.Jobs()[0]))
+	feed(controller, DirectionUp,
+		inputSample{ time.Second, true },
+		inputSample{ time.Second + 30 * time.Millisecond, true },
+		inputSample{ time.Second + 100 * time.Millisecond, false },
+		inputSample{ time.Second + 130 * time.Millisecond, false },
+	)
+	checkCommands(t, shutter, step, Command{ Action: ActionFlip, Angle: AngleMin })
+}
+
+func TestSwitchLongPress(t *testing.T) {
+	state, _, controller := newTestInputs(t)
+	shutter := state.Shutters["1"]
+
+	feed(controller, DirectionDown,
+		inputSample{ 0, true },
+		inputSample{ 30 * time.Millisecond, true },
+		inputSample{ 629 * time.Millisecond, true },
+	)
+	checkCommands(t, shutter)
+	feed(controller, DirectionDown, inputSample{ 630 * time.Millisecond, true })
+	run := Command{ Action: ActionMove, Position: PositionMax }
+	checkCommands(t, shutter, run)
+	energised(t, "1d")
+
+	// releasing the button doesn't turn the slats
+	feed(controller, DirectionDown,
+		inputSample{ time.Second, false },
+		inputSample{ time.Second + 30 * time.Millisecond, false },
+	)
+	checkCommands(t, shutter, run)
+
+	// but the next press stops the shutter
+	feed(controller, DirectionUp,
+		inputSample{ 2 * time.Second, true },
+		inputSample{ 2 * time.Second + 30 * time.Millisecond, true },
+	)
+	job := shutter.Job(shutter.Jobs()[0])
+	finished(t, job)
+	if status := job.Status(); status != JobCancelled {
+		t.Errorf("move is %s, expected %s", status, JobCancelled)
+	}
+	if SimLine("1d").Value() {
+		t.Error("shutter is still moving")
+	}
+	feed(controller, DirectionUp,
+		inputSample{ 3 * time.Second, false },
+		inputSample{ 3 * time.Second + 30 * time.Millisecond, false },
+	)
+	checkCommands(t, shutter, run)
+}
+
+func TestSwitchBothButtons(t *testing.T) {
+	state, _, controller := newTestInputs(t)
+	shutter := state.Shutters["1"]
+
+	feed(controller, DirectionUp, inputSample{ 0, true })
+	feed(controller, DirectionDown, inputSample{ 10 * time.Millisecond, true })
+	feed(controller, DirectionUp, inputSample{ 30 * time.Millisecond, true })
+	feed(controller, DirectionDown, inputSample{ 40 * time.Millisecond, true })
+
+	// holding both runs neither way, and releasing them turns no slats
+	feed(controller, DirectionUp, inputSample{ time.Second, true })
+	feed(controller, DirectionDown, inputSample{ time.Second, true })
+	feed(controller, DirectionUp, inputSample{ 2 * time.Second, false }, inputSample{ 2 * time.Second + 30 * time.Millisecond, false })
+	feed(controller, DirectionDown, inputSample{ 2 * time.Second, false }, inputSample{ 2 * time.Second + 30 * time.Millisecond, false })
+	checkCommands(t, shutter)
+	if SimLine("1u").Value() || SimLine("1d").Value() {
+		t.Error("shutter is moving")
+	}
+}
+
+// pending waits until a number of timers are waiting on the fake clock.
+func pending(t *testing.T, clock *FakeClock, timers int) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("%d timers are pending", timers), func() bool {
+		return clock.Pending() == timers
+	})
+}
+
+func TestSwitchEdges(t *testing.T) {
+	state, clock, controller := newTestInputs(t)
+	shutter := state.Shutters["1"]
+	controller.Init()
+	go controller.Run()
+	t.Cleanup(controller.Close)
+	up, down := SimLine("1up"), SimLine("1down")
+	waitFor(t, "the buttons are watched", func() bool {
+		up.lock.Lock()
+		defer up.lock.Unlock()
+		down.lock.Lock()
+		defer down.lock.Unlock()
+		return up.watcher != nil && down.watcher != nil
+	})
+	// idle buttons are not polled
+	pending(t, clock, 0)
+
+	// holding the button runs the shutter down, after the debounce and long
+	// press times
+	down.Inject(true)
+	pending(t, clock, 1)
+	clock.Advance(DefaultDebounce)
+	pending(t, clock, 1)
+	clock.Advance(DefaultLongPress - time.Millisecond)
+	checkCommands(t, shutter)
+	clock.Advance(time.Millisecond)
+	energised(t, "1d")
+	run := shutter.Job(shutter.Jobs()[0])
+	if expected := testEpoch.Add(DefaultDebounce + DefaultLongPress); !run.Created.Equal(expected) {
+		t.Errorf("shutter started moving at %s, expected %s", run.Created, expected)
+	}
+
+	// while the button is held, only the movement is timed, with its
+	// duration and progress updates
+	pending(t, clock, 2)
+	down.Inject(false)
+	pending(t, clock, 3)
+	clock.Advance(DefaultDebounce)
+	pending(t, clock, 2)
+
+	// a press stops the shutter as soon as it is debounced
+	up.Inject(true)
+	pending(t, clock, 3)
+	clock.Advance(DefaultDebounce)
+	finished(t, run)
+	if status := run.Status(); status != JobCancelled {
+		t.Errorf("move is %s, expected %s", status, JobCancelled)
+	}
+	history := SimLine("1d").History()
+	stopped := history[len(history) - 1]
+	if expected := testEpoch.Add(DefaultDebounce + DefaultLongPress + 2 * DefaultDebounce); stopped.Value || !stopped.Time.Equal(expected) {
+		t.Errorf("last change of 1d is %v, expected off at %s", stopped, expected)
+	}
+	up.Inject(false)
+	pending(t, clock, 1)
+	clock.Advance(DefaultDebounce)
+	pending(t, clock, 0)
+
+	checkCommands(t, shutter, Command{ Action: ActionMove, Position: PositionMax })
+}
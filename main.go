@@ -26,32 +26,46 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
 	"net/http"
-	"encoding/json"
+	"syscall"
+	"time"
 )
 
-type Configuration struct {
-	Listen string
-	UpTime int
-	DownTime int
-	FlipTime int
-	Shutters []struct {
-		Name string
-		GpioUp string
-		GpioDown string
-	}
-}
+// ShutdownTimeout limits the time that pending HTTP requests are given to
+// complete on shutdown.
+const ShutdownTimeout = 5 * time.Second
 
+// MaxRequestSize limits the size of request bodies.
+const MaxRequestSize = 64 * 1024
+
+// ShutterServer dispatches HTTP requests to the versioned API under /api/v1/
+// and, if enabled, to the legacy API that uses GET requests for everything.
 type ShutterServer struct {
 	Root Endpoint
+	Api RestEndpoint
+	// Streams are long-lived endpoints under /api/v1/ that are served
+	// directly, instead of through the Api tree
+	Streams map[string]http.Handler
+	Legacy bool
 }
 
-func NewShutterServer(state *ShutterState) *ShutterServer {
+func NewShutterServer(state *ShutterState, legacy bool) *ShutterServer {
 	return &ShutterServer{
 		Root: NewRootEndpoint(state),
+		Api: NewRestApi(state),
+		Streams: map[string]http.Handler{
+			"events": NewEventStream(state),
+			"ws": NewWebSocketEndpoint(state),
+		},
+		Legacy: legacy,
 	}
 }
 
@@ -62,37 +76,134 @@ func (server *ShutterServer) ServeHTTP(writer http.ResponseWriter, request *http
 		path = path[1:]
 	}
 	//log.Printf("len(path)=%d path[0]=%s path[1]=%s\n", len(path), path[0], path[1])
-	
-	response, status := server.Root.Handle(path, request.URL.Query())
+
+	if len(path) == 3 && path[0] == "api" && path[1] == "v1" && server.Streams[path[2]] != nil {
+		if request.Method == http.MethodGet {
+			server.Streams[path[2]].ServeHTTP(writer, request)
+			return
+		}
+		writer.Header().Set("Allow", http.MethodGet)
+		response, status := jsonResponse(map[string]interface{}{
+			"error": ErrMethodNotAllowed,
+		}, http.StatusMethodNotAllowed)
+		writer.Header().Add("Content-Type", "application/json")
+		writer.WriteHeader(status)
+		writer.Write(response)
+		return
+	}
+
+	var response []byte
+	var status int
+	if len(path) >= 2 && path[0] == "api" && path[1] == "v1" {
+		response, status = server.serveApi(writer, request, path[2:])
+	} else if !server.Legacy {
+		response, status = notFound()
+	} else if request.Method != http.MethodGet {
+		writer.Header().Set("Allow", http.MethodGet)
+		response, status = jsonResponse(map[string]interface{}{
+			"error": ErrMethodNotAllowed,
+		}, http.StatusMethodNotAllowed)
+	} else {
+		response, status = server.Root.Handle(path, request.URL.Query())
+	}
 	writer.Header().Add("Content-Type", "application/json")
 	writer.WriteHeader(status);
 	writer.Write(response)
 }
 
+func (server *ShutterServer) serveApi(writer http.ResponseWriter, request *http.Request, path []string) ([]byte, int) {
+	endpoint := server.Api.Resolve(path)
+	if endpoint == nil {
+		return notFound()
+	}
+	methods := endpoint.Methods()
+	allowed := false
+	for _, method := range methods {
+		if method == request.Method {
+			allowed = true
+		}
+	}
+	if !allowed {
+		writer.Header().Set("Allow", strings.Join(methods, ", "))
+		return jsonResponse(map[string]interface{}{
+			"error": ErrMethodNotAllowed,
+		}, http.StatusMethodNotAllowed)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, MaxRequestSize))
+	if err != nil {
+		return malformedBody(err)
+	}
+	return endpoint.Serve(request.Method, request.URL.Query(), body)
+}
+
 func main() {
-	var configname string
-	if len(os.Args) > 1 {
-		configname = os.Args[1]
-	} else {
-		configname = "config.json"
+	simulate := flag.Bool("simulate", false, "simulate all GPIO lines in memory")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [config.json]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	configname := "config.json"
+	if flag.NArg() > 0 {
+		configname = flag.Arg(0)
 	}
 	
 	configfile, err := os.Open(configname)
 	if err != nil {
-		log.Fatal("Can't read configuration from config.json: ", err)
+		log.Fatal("Can't read configuration from " + configname + ": ", err)
 	}
-	decoder := json.NewDecoder(configfile)
-	config := Configuration{}
-	err = decoder.Decode(&config)
+	config, err := LoadConfiguration(configfile)
 	if err != nil {
 		log.Fatal("Error parsing configuration: ", err)
 	}
 	configfile.Close()
 
-	state, err := NewShutterState(&config)
+	GpioBackend = config.GpioBackend
+	if *simulate {
+		log.Printf("Simulating all GPIO lines")
+		GpioBackend = GpioBackendSim
+	}
+
+	state, err := NewShutterState(config, SystemClock)
 	if err != nil {
 		log.Fatal("Error creating state object: ", err)
 	}
-	server := NewShutterServer(state)
-	log.Fatal(http.ListenAndServe(config.Listen, server))
+	state.Start()
+
+	var bridge *MqttBridge
+	if config.Mqtt != nil {
+		bridge = NewMqttBridge(config.Mqtt, state)
+		go bridge.Run()
+	}
+
+	server := &http.Server{
+		Addr: config.Listen,
+		Handler: NewShutterServer(state, config.LegacyApi),
+	}
+	go func() {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			state.Shutdown()
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %s, shutting down", sig)
+
+	// release the relays first, then wait for pending requests
+	if err := state.Shutdown(); err != nil {
+		log.Print("Error shutting down shutters: ", err)
+	}
+	if bridge != nil {
+		bridge.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Print("Error shutting down HTTP server: ", err)
+	}
 }
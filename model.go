@@ -26,104 +26,691 @@
 package main
 
 import (
+	"errors"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// ShutterQueueSize is the maximum number of commands that can be waiting
+	// for execution on a single shutter.
+	ShutterQueueSize = 16
+	// ShutterJobHistory is the number of jobs that are remembered per shutter,
+	// including the ones that have already finished.
+	ShutterJobHistory = 32
+)
+
+// Positions are expressed in percent of the full travel distance.
+// PositionMin is fully open (up), PositionMax is fully closed (down).
+// Slat angles range from AngleMin (open) to AngleMax (closed).
+const (
+	PositionMin = 0.0
+	PositionMax = 100.0
+	AngleMin = 0.0
+	AngleMax = 1.0
+)
+
+var (
+	ErrStopped = errors.New("movement was stopped")
+	ErrShutdown = errors.New("shutter has been shut down")
+	ErrPositionRange = errors.New("position out of range")
+	ErrAngleRange = errors.New("angle out of range")
+)
+
+// ValidPosition checks if a position is within the travel range.
+func ValidPosition(position float32) bool {
+	return position >= PositionMin && position <= PositionMax
+}
+
+// ValidAngle checks if a slat angle is within range.
+func ValidAngle(angle float32) bool {
+	return angle >= AngleMin && angle <= AngleMax
+}
+
+// clampPosition limits an estimated position to the travel range.
+func clampPosition(position float32) float32 {
+	if position < PositionMin {
+		return PositionMin
+	}
+	if position > PositionMax {
+		return PositionMax
+	}
+	return position
+}
+
+// ShutterStatus is a snapshot of the state of a shutter.
+// While the shutter is moving, Position is estimated from the time that has
+// passed since the motor was started.
+type ShutterStatus struct {
+	Position float32
+	Angle float32
+	Queued int
+	Calibration string
+	Moving bool
+	Direction Direction
+	// Remaining is the estimated time until the motor stops
+	Remaining time.Duration
+}
+
+// movement describes the motor run in progress.
+type movement struct {
+	Direction Direction
+	Started time.Time
+	Duration time.Duration
+	// Origin is the position at the start of the movement
+	Origin float32
+	// Positional is false if only the slats are turned
+	Positional bool
+}
+
 type Shutter struct {
 	Name string
-	GpioUp Gpio
-	GpioDown Gpio
+	Relay *RelayPair
 	Position float32
 	Angle float32
 	UpTime time.Duration
 	DownTime time.Duration
 	FlipUpTime time.Duration
 	FlipDownTime time.Duration
+	// lock protects Position, Angle, the job history and the movement state
+	lock sync.Mutex
+	queue chan *Job
+	jobs map[uint64]*Job
+	history []uint64
+	// current is the job that is being executed, if any
+	current *Job
+	// cancel is closed to interrupt the current job
+	cancel chan struct{}
+	// stopped is the last job ID that was issued before the most recent stop
+	stopped uint64
+	// motion is the motor run in progress, if any
+	motion *movement
+	// CalibrationMode selects how the position is determined at startup
+	CalibrationMode string
+	calibration string
+	// Store keeps the position across restarts, may be nil
+	Store *StateFile
+	// Clock is used for all movement timing
+	Clock Clock
+	// Events receives state changes, may be nil
+	Events *EventBus
+	// Azimuth is the direction that the window faces, in degrees clockwise
+	// from north
+	Azimuth float64
+	// TiltMode selects how the slats are turned against the sun
+	TiltMode string
+	// shade is set while the shade automation is enabled, shading while it
+	// turns the slats against the sun; both are protected by lock
+	shade bool
+	shading bool
+	// closed is set when the shutter doesn't accept commands any more
+	closed bool
+	// running is set while the worker is active, finished is closed when it
+	// has exited
+	running bool
+	finished chan struct{}
+}
+
+func NewShutter(name string, relay *RelayPair, clock Clock) *Shutter {
+	return &Shutter{
+		Name: name,
+		Relay: relay,
+		Clock: clock,
+		Position: 0.0,
+		Angle: 0.0,
+		queue: make(chan *Job, ShutterQueueSize),
+		jobs: make(map[uint64]*Job),
+		CalibrationMode: CalibrationAssume,
+		calibration: CalibrationUnknown,
+		TiltMode: TiltModeOff,
+		finished: make(chan struct{}),
+	}
+}
+
+// Submit places a command into the shutter's queue and returns immediately.
+// Commands are executed in submission order by the shutter's worker.
+func (shutter *Shutter) Submit(command Command) (*Job, error) {
+	switch command.Action {
+		case ActionMove:
+			if !ValidPosition(command.Position) {
+				return nil, ErrPositionRange
+			}
+		case ActionFlip:
+			if !ValidAngle(command.Angle) {
+				return nil, ErrAngleRange
+			}
+		case ActionReset:
+		default:
+			return nil, ErrUnknownAction
+	}
+	job := newJob(shutter.Name, command, shutter.Clock)
+	shutter.lock.Lock()
+	defer shutter.lock.Unlock()
+	if shutter.closed {
+		return nil, ErrShutdown
+	}
+	select {
+		case shutter.queue <- job:
+		default:
+			return nil, ErrQueueFull
+	}
+	shutter.jobs[job.ID] = job
+	shutter.history = append(shutter.history, job.ID)
+	if len(shutter.history) > ShutterJobHistory {
+		delete(shutter.jobs, shutter.history[0])
+		shutter.history = shutter.history[1:]
+	}
+	log.Printf("Queued job %d (%s) on shutter %s\n", job.ID, command.Action, shutter.Name)
+	return job, nil
+}
+
+// Job looks up a recently submitted job by its ID.
+// Returns nil if the job is unknown or has been evicted from the history.
+func (shutter *Shutter) Job(id uint64) *Job {
+	shutter.lock.Lock()
+	defer shutter.lock.Unlock()
+	return shutter.jobs[id]
+}
+
+// Jobs returns the IDs of all remembered jobs, oldest first.
+func (shutter *Shutter) Jobs() []uint64 {
+	shutter.lock.Lock()
+	defer shutter.lock.Unlock()
+	ids := make([]uint64, len(shutter.history))
+	copy(ids, shutter.history)
+	return ids
+}
+
+// Status returns a consistent snapshot of the shutter state.
+func (shutter *Shutter) Status() ShutterStatus {
+	shutter.lock.Lock()
+	defer shutter.lock.Unlock()
+	status := ShutterStatus{
+		Position: shutter.Position,
+		Angle: shutter.Angle,
+		Queued: len(shutter.queue),
+		Calibration: shutter.calibration,
+	}
+	if shutter.motion != nil {
+		elapsed := shutter.Clock.Now().Sub(shutter.motion.Started)
+		if elapsed > shutter.motion.Duration {
+			elapsed = shutter.motion.Duration
+		}
+		status.Moving = true
+		status.Direction = shutter.motion.Direction
+		status.Remaining = shutter.motion.Duration - elapsed
+		if shutter.motion.Positional {
+			status.Position = clampPosition(shutter.motion.Origin + shutter.displacement(shutter.motion.Direction, elapsed))
+		}
+	}
+	return status
+}
+
+// run is the worker loop of the shutter. It executes queued jobs one by one.
+func (shutter *Shutter) run() {
+	shutter.lock.Lock()
+	shutter.running = true
+	shutter.lock.Unlock()
+	defer close(shutter.finished)
+
+	for job := range shutter.queue {
+		shutter.lock.Lock()
+		if job.ID <= shutter.stopped {
+			shutter.lock.Unlock()
+			log.Printf("Skipping job %d on shutter %s, it was stopped\n", job.ID, shutter.Name)
+			job.finish(JobCancelled)
+			continue
+		}
+		shutter.current = job
+		shutter.cancel = make(chan struct{})
+		shutter.lock.Unlock()
+
+		job.start()
+		shutter.save(true)
+		shutter.publish(EventStarted, job, "", nil)
+		var err error
+		switch job.Command.Action {
+			case ActionMove:
+				err = shutter.Move(job.Command.Position)
+			case ActionFlip:
+				err = shutter.Flip(job.Command.Angle)
+			case ActionReset:
+				err = shutter.Reset()
+		}
+		shutter.save(false)
+		shutter.lock.Lock()
+		shutter.current = nil
+		shutter.cancel = nil
+		shutter.lock.Unlock()
+
+		if err == ErrStopped {
+			log.Printf("Job %d on shutter %s was stopped\n", job.ID, shutter.Name)
+			shutter.publish(EventStopped, job, JobCancelled, nil)
+			job.finish(JobCancelled)
+		} else if err != nil {
+			log.Printf("Job %d on shutter %s failed: %s\n", job.ID, shutter.Name, err)
+			shutter.publish(EventError, job, JobFailed, err)
+			job.fail(err)
+		} else {
+			shutter.publish(EventStopped, job, JobDone, nil)
+			job.finish(JobDone)
+			log.Printf("Finished job %d on shutter %s\n", job.ID, shutter.Name)
+		}
+	}
+}
+
+// Stop interrupts the movement in progress and cancels all queued commands.
+// Both relays are released immediately. Stop waits until the worker has
+// recorded the position that was reached before returning.
+func (shutter *Shutter) Stop() error {
+	log.Printf("Stopping shutter %s\n", shutter.Name)
+	shutter.lock.Lock()
+	shutter.stopped = atomic.LoadUint64(&lastJobId)
+	current := shutter.current
+	if shutter.cancel != nil {
+		select {
+			case <-shutter.cancel:
+			default:
+				close(shutter.cancel)
+		}
+	}
+	shutter.lock.Unlock()
+
+	err := shutter.Relay.Release()
+	if current != nil {
+		current.Wait()
+	}
+	return err
+}
+
+// Shutdown stops the shutter for good: The current movement is interrupted,
+// queued commands are cancelled, both relays are released, the position is
+// saved and the GPIO lines are closed.
+// The shutter can't be used afterwards.
+func (shutter *Shutter) Shutdown() error {
+	log.Printf("Shutting down shutter %s\n", shutter.Name)
+	err := shutter.Stop()
+
+	shutter.lock.Lock()
+	running := shutter.running
+	if !shutter.closed {
+		shutter.closed = true
+		close(shutter.queue)
+	}
+	shutter.lock.Unlock()
+	if running {
+		<-shutter.finished
+	}
+
+	if rerr := shutter.Relay.Release(); err == nil {
+		err = rerr
+	}
+	shutter.save(false)
+	if cerr := shutter.Relay.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
-func (shutter *Shutter) Init() {
+// currentJob returns the job that is being executed, if any.
+func (shutter *Shutter) currentJob() *Job {
+	shutter.lock.Lock()
+	defer shutter.lock.Unlock()
+	return shutter.current
+}
+
+// interrupted returns the channel that signals cancellation of the current
+// job. It is nil if the shutter is not controlled by its worker.
+func (shutter *Shutter) interrupted() <-chan struct{} {
+	shutter.lock.Lock()
+	defer shutter.lock.Unlock()
+	return shutter.cancel
+}
+
+func (shutter *Shutter) setPosition(position float32, angle float32) {
+	shutter.lock.Lock()
+	defer shutter.lock.Unlock()
+	shutter.Position = position
+	shutter.Angle = angle
+}
+
+func (shutter *Shutter) Init() error {
 	log.Printf("Initializing GPIO lines of shutter %s\n", shutter.Name)
-	shutter.GpioUp.Init()
-	shutter.GpioUp.Set(false)
-	shutter.GpioDown.Init()
-	shutter.GpioDown.Set(false)
+	return shutter.Relay.Init()
 }
 
-func (shutter *Shutter) Reset() {
-	log.Printf("Moving shutter %s to position 0\n", shutter.Name)
-	shutter.GpioDown.Set(false)
-	shutter.GpioUp.Set(true)
-	time.Sleep(shutter.UpTime)
-	shutter.GpioUp.Set(false)
-	shutter.Position = 0.0
-	shutter.Angle = 0.0
+// drive runs the motor in one direction for the given duration.
+// The relays are always released afterwards, even if energising failed.
+// Returns the time the motor actually ran, which is shorter than the requested
+// duration if the movement was stopped.
+// If positional is set, the shutter position is interpolated during the run.
+func (shutter *Shutter) drive(direction Direction, duration time.Duration, positional bool) (time.Duration, error) {
+	cancel := shutter.interrupted()
+	select {
+		case <-cancel:
+			return 0, ErrStopped
+		default:
+	}
+	var elapsed time.Duration
+	err := shutter.Relay.DriveCancel(direction, cancel)
+	if err == nil {
+		start := shutter.Clock.Now()
+		shutter.lock.Lock()
+		shutter.motion = &movement{
+			Direction: direction,
+			Started: start,
+			Duration: duration,
+			Origin: shutter.Position,
+			Positional: positional,
+		}
+		shutter.lock.Unlock()
+		shutter.publish(EventProgress, shutter.currentJob(), "", nil)
+		timer := shutter.Clock.NewTimer(duration)
+		for running := true; running; {
+			progress := shutter.Clock.NewTimer(ProgressInterval)
+			select {
+				case <-timer.C():
+					running = false
+				case <-cancel:
+					timer.Stop()
+					err = ErrStopped
+					running = false
+				case <-progress.C():
+					shutter.publish(EventProgress, shutter.currentJob(), "", nil)
+			}
+			progress.Stop()
+		}
+		elapsed = shutter.Clock.Now().Sub(start)
+		if elapsed > duration {
+			elapsed = duration
+		}
+	}
+	if rerr := shutter.Relay.Release(); err == nil {
+		err = rerr
+	}
+	shutter.lock.Lock()
+	if shutter.motion != nil && shutter.motion.Positional {
+		// keep the estimate until the caller records the final position
+		shutter.Position = clampPosition(shutter.motion.Origin + shutter.displacement(direction, elapsed))
+	}
+	shutter.motion = nil
+	shutter.lock.Unlock()
+	return elapsed, err
 }
 
-func (shutter *Shutter) Flip(angle float32) {
+// travel returns the distance covered when moving for the given time,
+// in percent of the full travel distance.
+func (shutter *Shutter) travel(direction Direction, elapsed time.Duration) float32 {
+	switch direction {
+		case DirectionUp:
+			return PositionMax * float32(elapsed) / float32(shutter.UpTime)
+		case DirectionDown:
+			return PositionMax * float32(elapsed) / float32(shutter.DownTime)
+		default:
+			return 0.0
+	}
+}
+
+// displacement returns the signed change in position when moving for the
+// given time.
+func (shutter *Shutter) displacement(direction Direction, elapsed time.Duration) float32 {
+	if direction == DirectionUp {
+		return -shutter.travel(direction, elapsed)
+	}
+	return shutter.travel(direction, elapsed)
+}
+
+// travelTime returns the time needed to cover the given distance, which is
+// specified in percent of the full travel distance.
+func (shutter *Shutter) travelTime(direction Direction, distance float32) time.Duration {
+	switch direction {
+		case DirectionUp:
+			return time.Duration(float32(shutter.UpTime) * distance / PositionMax)
+		case DirectionDown:
+			return time.Duration(float32(shutter.DownTime) * distance / PositionMax)
+		default:
+			return 0
+	}
+}
+
+// Reset homes the shutter: It is driven fully up, with some overrun to make
+// sure the end position is reached, and the position is set to 0.
+func (shutter *Shutter) Reset() error {
+	log.Printf("Homing shutter %s\n", shutter.Name)
+	shutter.setCalibration(CalibrationHoming)
+	_, err := shutter.drive(DirectionUp, time.Duration(float64(shutter.UpTime) * (1.0 + HomingOverrun)), true)
+	if err == ErrStopped {
+		shutter.setCalibration(CalibrationUnknown)
+		return err
+	} else if err != nil {
+		shutter.setCalibration(CalibrationFailed)
+		return err
+	}
+	shutter.setPosition(PositionMin, AngleMin)
+	shutter.setCalibration(CalibrationHomed)
+	return nil
+}
+
+func (shutter *Shutter) Flip(angle float32) error {
+	if !ValidAngle(angle) {
+		return ErrAngleRange
+	}
 	log.Printf("Flipping shutter %s to angle %f\n", shutter.Name, angle)
 	// TODO adjust the position as well, or use angle directly
-	shutter.GpioDown.Set(false)
-	shutter.GpioUp.Set(true)
-	time.Sleep(shutter.FlipUpTime)
-	shutter.GpioUp.Set(false)
-	shutter.GpioDown.Set(true)
-	time.Sleep(time.Duration(float32(shutter.FlipDownTime) * angle))
-	shutter.GpioDown.Set(false)
-	shutter.Angle = angle
+	elapsed, err := shutter.drive(DirectionUp, shutter.FlipUpTime, false)
+	if err != nil {
+		if elapsed > 0 && shutter.FlipUpTime > 0 {
+			// the slats open while moving up
+			shutter.setPosition(shutter.Position, shutter.Angle * (1.0 - float32(elapsed) / float32(shutter.FlipUpTime)))
+		}
+		return err
+	}
+	elapsed, err = shutter.drive(DirectionDown, time.Duration(float32(shutter.FlipDownTime) * angle), false)
+	if err != nil {
+		if shutter.FlipDownTime > 0 {
+			shutter.setPosition(shutter.Position, float32(elapsed) / float32(shutter.FlipDownTime))
+		}
+		return err
+	}
+	shutter.setPosition(shutter.Position, angle)
+	return nil
 }
 
-func (shutter *Shutter) Move(position float32) {
+func (shutter *Shutter) Move(position float32) error {
+	if !ValidPosition(position) {
+		return ErrPositionRange
+	}
 	// TODO adjust the angle as well, according to the direction
-	if (position > shutter.Position) {
+	start := shutter.Position
+	if (position > start) {
 		log.Printf("Moving shutter %s down to position %f\n", shutter.Name, position)
-		shutter.GpioUp.Set(false)
-		shutter.GpioDown.Set(true)
-		time.Sleep(time.Duration(float32(shutter.DownTime) * (position - shutter.Position)))
-		shutter.GpioDown.Set(false)
-		shutter.Position = position
-		shutter.Angle = 0.0
-	} else if (position < shutter.Position) {
+		elapsed, err := shutter.drive(DirectionDown, shutter.travelTime(DirectionDown, position - start), true)
+		if err != nil {
+			if elapsed > 0 {
+				// drive has recorded the position that was reached
+				shutter.setPosition(shutter.Position, 0.0)
+			}
+			return err
+		}
+		shutter.setPosition(position, 0.0)
+	} else if (position < start) {
 		log.Printf("Moving shutter %s up to position %f\n", shutter.Name, position)
-		shutter.GpioDown.Set(false)
-		shutter.GpioUp.Set(true)
-		time.Sleep(time.Duration(float32(shutter.UpTime) * (shutter.Position - position)))
-		shutter.GpioUp.Set(false)
-		shutter.Position = position
-		shutter.Angle = 0.0
+		elapsed, err := shutter.drive(DirectionUp, shutter.travelTime(DirectionUp, start - position), true)
+		if err != nil {
+			if elapsed > 0 {
+				shutter.setPosition(shutter.Position, 0.0)
+			}
+			return err
+		}
+		shutter.setPosition(position, 0.0)
+	} else {
+		log.Printf("Not moving shutter %s\n", shutter.Name)
 	}
-	log.Printf("Not moving shutter %s\n", shutter.Name)
+	return nil
 }
 
 type ShutterState struct {
 	Shutters map[string]*Shutter
+	// Groups are the shutter groups, including GroupAll
+	Groups map[string]*ShutterGroup
+	// Scenes are the saved presets
+	Scenes *SceneStore
+	// Schedules runs commands at certain times
+	Schedules *Scheduler
+	// Shade turns the slats against the sun
+	Shade *ShadeController
+	// Inputs are the wall switches
+	Inputs *InputController
+	// Coordinates are the location of the shutters, may be nil
+	Coordinates *Coordinates
+	// Clock is the time source of all shutters
+	Clock Clock
+	// Events receives the state changes of all shutters
+	Events *EventBus
+	// Store is the persistent state, may be nil
+	Store *StateFile
+}
+
+// Dispatch carries out a command on the named shutter.
+// This is the common entry point for all interfaces that control shutters.
+// Stop commands are executed immediately and return no job, all other
+// commands are queued.
+// Manual commands switch off the shade automation of the shutter.
+func (state *ShutterState) Dispatch(name string, command Command) (*Job, error) {
+	shutter := state.Shutters[name]
+	if shutter == nil {
+		return nil, ErrUnknownShutter
+	}
+	if command.Source == SourceManual && shutter.Shade() {
+		log.Printf("Manual command on shutter %s, disabling shade automation\n", name)
+		shutter.SetShade(false)
+	}
+	if command.Action == ActionStop {
+		return nil, shutter.Stop()
+	}
+	return shutter.Submit(command)
+}
+
+// Shutdown stops the automation and shuts down all shutters in parallel.
+// The first error that occurred is returned, but all shutters are processed.
+func (state *ShutterState) Shutdown() error {
+	state.Schedules.Close()
+	state.Shade.Close()
+	state.Inputs.Close()
+	errs := make(chan error, len(state.Shutters))
+	for _, shutter := range state.Shutters {
+		go func(shutter *Shutter) {
+			errs <- shutter.Shutdown()
+		}(shutter)
+	}
+	var err error
+	for range state.Shutters {
+		if serr := <-errs; serr != nil {
+			log.Print(serr)
+			if err == nil {
+				err = serr
+			}
+		}
+	}
+	state.Events.Close()
+	return err
 }
 
-func NewShutterState(config *Configuration) (*ShutterState, error) {
+// NewShutterState creates all configured shutters and starts their workers.
+// All timing is based on the given clock.
+func NewShutterState(config *Configuration, clock Clock) (*ShutterState, error) {
 	state := &ShutterState{
 		Shutters: make(map[string]*Shutter),
+		Events: NewEventBus(),
+		Coordinates: config.Coordinates(),
+		Clock: clock,
+	}
+	debounce, longpress := config.SwitchTimings()
+	state.Inputs = NewInputController(state, clock, debounce, longpress)
+	if config.StateFile != "" {
+		store, err := LoadStateFile(config.StateFile)
+		if err != nil {
+			return nil, err
+		}
+		state.Store = store
+	}
+	groups, err := config.ExpandGroups()
+	if err != nil {
+		return nil, err
 	}
+	state.Groups = groups
+	names := make(map[string]bool)
 	for _, shutter := range config.Shutters {
-		gpioup, err := NewGpio(shutter.GpioUp, true)
+		names[shutter.Name] = true
+	}
+	scenes, err := NewSceneStore(config.SceneFile, config.Scenes, names)
+	if err != nil {
+		return nil, err
+	}
+	state.Scenes = scenes
+	// if a shutter fails, the ones that were already created are shut down
+	complete := false
+	defer func() {
+		if !complete {
+			for _, instance := range state.Shutters {
+				instance.Shutdown()
+			}
+		}
+	}()
+	for _, shutter := range config.Shutters {
+		gpioup, err := NewGpio(shutter.GpioUp, true, shutter.GpioUpActiveLow)
 		if err != nil {
 			return nil, err
 		}
-		gpiodown, err := NewGpio(shutter.GpioDown, true)
+		gpiodown, err := NewGpio(shutter.GpioDown, true, shutter.GpioDownActiveLow)
 		if err != nil {
 			return nil, err
 		}
-		state.Shutters[shutter.Name] = &Shutter{
-			Name: shutter.Name,
-			GpioUp: gpioup,
-			GpioDown: gpiodown,
-			Position: 0.0,
-			Angle: 0.0,
-			DownTime: time.Duration(config.DownTime) * time.Second,
-			UpTime: time.Duration(config.UpTime) * time.Second,
-			FlipUpTime: time.Duration(config.FlipTime) * time.Second,
-			FlipDownTime: time.Duration(config.FlipTime) * time.Second, 
+		deadtime := DefaultDeadTime
+		if config.DeadTime > 0 {
+			deadtime = time.Duration(config.DeadTime) * time.Millisecond
+		}
+		instance := NewShutter(shutter.Name, NewRelayPair(gpioup, gpiodown, deadtime, clock), clock)
+		instance.UpTime, instance.DownTime, instance.FlipUpTime, instance.FlipDownTime = shutter.Timings(config)
+		instance.CalibrationMode = shutter.CalibrationMode(config)
+		if shutter.TiltMode != "" && shutter.TiltMode != TiltModeOff {
+			instance.Azimuth = *shutter.Azimuth
+			instance.TiltMode = shutter.TiltMode
+			instance.shade = true
+		}
+		instance.Store = state.Store
+		instance.Events = state.Events
+		instance.restore()
+		state.Shutters[shutter.Name] = instance
+		if shutter.InputUp != "" {
+			input, err := NewGpio(shutter.InputUp, false, shutter.InputUpActiveLow)
+			if err != nil {
+				return nil, err
+			}
+			state.Inputs.Add(shutter.Name, DirectionUp, input)
 		}
+		if shutter.InputDown != "" {
+			input, err := NewGpio(shutter.InputDown, false, shutter.InputDownActiveLow)
+			if err != nil {
+				return nil, err
+			}
+			state.Inputs.Add(shutter.Name, DirectionDown, input)
+		}
+		go instance.run()
+	}
+	schedules, err := NewScheduler(state, clock, config.ScheduleFile, config.Schedules)
+	if err != nil {
+		return nil, err
+	}
+	state.Schedules = schedules
+	interval := DefaultShadeInterval
+	if config.ShadeInterval > 0 {
+		interval = time.Duration(config.ShadeInterval) * time.Minute
 	}
+	state.Shade = NewShadeController(state, clock, interval)
+	complete = true
 	return state, nil
 }
 
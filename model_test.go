@@ -0,0 +1,479 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testEpoch is the start time of the fake clock in all tests.
+var testEpoch = time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// newTestState creates shutters on simulated lines, with a fake clock.
+// Each shutter needs 10s for the full travel and 1s to turn the slats, and
+// starts out calibrated at the open position. The lines of shutter n are
+// called nu and nd.
+func newTestState(t *testing.T, names ...string) (*ShutterState, *FakeClock) {
+	clock := NewFakeClock(testEpoch)
+	SimReset(clock)
+	config := &Configuration{
+		UpTime: 10,
+		DownTime: 10,
+		FlipTime: 1,
+		DeadTime: 500,
+		Calibration: CalibrationAssume,
+	}
+	for _, name := range names {
+		config.Shutters = append(config.Shutters, ShutterConfiguration{
+			Name: name,
+			GpioUp: "sim:" + name + "u",
+			GpioDown: "sim:" + name + "d",
+		})
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	state, err := NewShutterState(config, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shutter := range state.Shutters {
+		if err := shutter.Init(); err != nil {
+			t.Fatal(err)
+		}
+		shutter.calibrate()
+	}
+	t.Cleanup(func() {
+		for _, shutter := range state.Shutters {
+			shutter.Shutdown()
+		}
+	})
+	return state, clock
+}
+
+// waitFor waits until a condition that depends on the shutter workers is met.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// energised waits until a simulated line is switched on.
+func energised(t *testing.T, line string) {
+	t.Helper()
+	waitFor(t, line + " is energised", func() bool {
+		return SimLine(line).Value()
+	})
+}
+
+// reversing waits until a relay pair waits for the dead time, after the
+// line of the previous direction was switched off.
+func reversing(t *testing.T, clock *FakeClock, previous string) {
+	t.Helper()
+	waitFor(t, previous + " is released before reversing", func() bool {
+		return !SimLine(previous).Value() && clock.Pending() == 1
+	})
+}
+
+// finished waits until a job is done, or fails the test.
+func finished(t *testing.T, job *Job) {
+	t.Helper()
+	select {
+		case <-job.Done():
+		case <-time.After(2 * time.Second):
+			t.Fatalf("job %d did not finish", job.ID)
+	}
+}
+
+// timelineEntry is an expected change of a simulated line, relative to
+// testEpoch.
+type timelineEntry struct {
+	At time.Duration
+	Line string
+	Value bool
+}
+
+func (entry timelineEntry) String() string {
+	return fmt.Sprintf("%s %s=%t", entry.At, entry.Line, entry.Value)
+}
+
+// checkTimeline compares the changes of the simulated lines, starting at the
+// given index, with the expected ones.
+func checkTimeline(t *testing.T, from int, expected []timelineEntry) {
+	t.Helper()
+	timeline := SimTimeline()[from:]
+	actual := make([]timelineEntry, len(timeline))
+	for i, event := range timeline {
+		actual[i] = timelineEntry{
+			At: event.Time.Sub(testEpoch),
+			Line: event.Line,
+			Value: event.Value,
+		}
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("timeline is %v, expected %v", actual, expected)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("timeline is %v, expected %v", actual, expected)
+		}
+	}
+}
+
+func TestValidPosition(t *testing.T) {
+	tests := []struct {
+		position float32
+		valid bool
+	}{
+		{ 0, true },
+		{ 40, true },
+		{ 100, true },
+		{ -0.1, false },
+		{ 100.1, false },
+		{ 1000, false },
+	}
+	for _, test := range tests {
+		if valid := ValidPosition(test.position); valid != test.valid {
+			t.Errorf("ValidPosition(%f) is %t, expected %t", test.position, valid, test.valid)
+		}
+	}
+}
+
+func TestTravelTime(t *testing.T) {
+	shutter := &Shutter{
+		UpTime: 20 * time.Second,
+		DownTime: 10 * time.Second,
+	}
+	tests := []struct {
+		direction Direction
+		distance float32
+		duration time.Duration
+	}{
+		{ DirectionUp, 100, 20 * time.Second },
+		{ DirectionUp, 50, 10 * time.Second },
+		{ DirectionDown, 100, 10 * time.Second },
+		{ DirectionDown, 25, 2500 * time.Millisecond },
+		{ DirectionDown, 0, 0 },
+		{ DirectionNone, 50, 0 },
+	}
+	for _, test := range tests {
+		duration := shutter.travelTime(test.direction, test.distance)
+		if duration != test.duration {
+			t.Errorf("travel time of %f%% %s is %s, expected %s", test.distance, test.direction, duration, test.duration)
+		}
+		if test.direction == DirectionNone {
+			continue
+		}
+		// travel is the inverse of travelTime
+		if distance := shutter.travel(test.direction, duration); distance != test.distance {
+			t.Errorf("travel of %s %s is %f%%, expected %f%%", duration, test.direction, distance, test.distance)
+		}
+	}
+}
+
+func TestMoveOutOfRange(t *testing.T) {
+	shutter := &Shutter{
+		UpTime: 20 * time.Second,
+		DownTime: 20 * time.Second,
+	}
+	for _, position := range []float32{ -1, 101 } {
+		if err := shutter.Move(position); err != ErrPositionRange {
+			t.Errorf("Move(%f) returned %v, expected %v", position, err, ErrPositionRange)
+		}
+	}
+	for _, angle := range []float32{ -0.5, 1.5 } {
+		if err := shutter.Flip(angle); err != ErrAngleRange {
+			t.Errorf("Flip(%f) returned %v, expected %v", angle, err, ErrAngleRange)
+		}
+	}
+}
+
+func TestMoveTimeline(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	mark := len(SimTimeline())
+
+	job, err := state.Dispatch("1", Command{ Action: ActionMove, Position: 40 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	energised(t, "1d")
+	clock.Advance(4 * time.Second)
+	finished(t, job)
+
+	job, err = state.Dispatch("1", Command{ Action: ActionMove, Position: 10 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	reversing(t, clock, "1d")
+	clock.Advance(500 * time.Millisecond)
+	energised(t, "1u")
+	clock.Advance(3 * time.Second)
+	finished(t, job)
+
+	checkTimeline(t, mark, []timelineEntry{
+		{ 0, "1d", true },
+		{ 4 * time.Second, "1d", false },
+		{ 4500 * time.Millisecond, "1u", true },
+		{ 7500 * time.Millisecond, "1u", false },
+	})
+	if status := state.Shutters["1"].Status(); status.Position != 10 {
+		t.Errorf("position is %f, expected 10", status.Position)
+	}
+}
+
+func TestFlipTimeline(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	mark := len(SimTimeline())
+
+	// the slats are opened by moving up, then closed to the angle
+	job, err := state.Dispatch("1", Command{ Action: ActionFlip, Angle: 0.5 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	energised(t, "1u")
+	clock.Advance(time.Second)
+	reversing(t, clock, "1u")
+	clock.Advance(500 * time.Millisecond)
+	energised(t, "1d")
+	clock.Advance(500 * time.Millisecond)
+	finished(t, job)
+
+	checkTimeline(t, mark, []timelineEntry{
+		{ 0, "1u", true },
+		{ time.Second, "1u", false },
+		{ 1500 * time.Millisecond, "1d", true },
+		{ 2 * time.Second, "1d", false },
+	})
+	if status := state.Shutters["1"].Status(); status.Angle != 0.5 {
+		t.Errorf("angle is %f, expected 0.5", status.Angle)
+	}
+}
+
+func TestMoveInterpolation(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	shutter := state.Shutters["1"]
+
+	job, err := state.Dispatch("1", Command{ Action: ActionMove, Position: 100 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	energised(t, "1d")
+	tests := []struct {
+		step time.Duration
+		position float32
+		remaining time.Duration
+	}{
+		{ 0, 0, 10 * time.Second },
+		{ 2500 * time.Millisecond, 25, 7500 * time.Millisecond },
+		{ 5 * time.Second, 75, 2500 * time.Millisecond },
+	}
+	for _, test := range tests {
+		clock.Advance(test.step)
+		status := shutter.Status()
+		if !status.Moving || status.Direction != DirectionDown || status.Position != test.position || status.Remaining != test.remaining {
+			t.Errorf("status after %s is %+v, expected position %f and %s remaining", test.step, status, test.position, test.remaining)
+		}
+	}
+	clock.Advance(2500 * time.Millisecond)
+	finished(t, job)
+	if status := shutter.Status(); status.Moving || status.Position != 100 {
+		t.Errorf("status at the end is %+v, expected position 100 at rest", status)
+	}
+}
+
+func TestStopMidTravel(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	shutter := state.Shutters["1"]
+	mark := len(SimTimeline())
+
+	first, err := state.Dispatch("1", Command{ Action: ActionMove, Position: 80 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err := state.Dispatch("1", Command{ Action: ActionMove, Position: 0 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	energised(t, "1d")
+	clock.Advance(2500 * time.Millisecond)
+	if _, err := state.Dispatch("1", Command{ Action: ActionStop }); err != nil {
+		t.Fatal(err)
+	}
+	finished(t, first)
+	finished(t, queued)
+	if first.Status() != JobCancelled || queued.Status() != JobCancelled {
+		t.Errorf("jobs are %s and %s, expected both to be cancelled", first.Status(), queued.Status())
+	}
+	if status := shutter.Status(); status.Moving || status.Position != 25 || status.Queued != 0 {
+		t.Errorf("status is %+v, expected position 25 at rest", status)
+	}
+
+	// the shutter accepts commands again
+	job, err := state.Dispatch("1", Command{ Action: ActionMove, Position: 50 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	energised(t, "1d")
+	clock.Advance(2500 * time.Millisecond)
+	finished(t, job)
+	checkTimeline(t, mark, []timelineEntry{
+		{ 0, "1d", true },
+		{ 2500 * time.Millisecond, "1d", false },
+		{ 2500 * time.Millisecond, "1d", true },
+		{ 5 * time.Second, "1d", false },
+	})
+}
+
+func TestQueueOrder(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	shutter := state.Shutters["1"]
+	mark := len(SimTimeline())
+
+	commands := []Command{
+		{ Action: ActionMove, Position: 20 },
+		{ Action: ActionMove, Position: 60 },
+		{ Action: ActionFlip, Angle: 1 },
+	}
+	jobs := make([]*Job, len(commands))
+	for i, command := range commands {
+		job, err := state.Dispatch("1", command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs[i] = job
+	}
+	energised(t, "1d")
+	if status := shutter.Status(); status.Queued != 2 {
+		t.Errorf("%d jobs are queued, expected 2", status.Queued)
+	}
+	clock.Advance(2 * time.Second)
+	finished(t, jobs[0])
+	if jobs[1].Status() == JobDone || jobs[2].Status() == JobDone {
+		t.Fatal("jobs finished out of order")
+	}
+	// same direction, no dead time
+	energised(t, "1d")
+	clock.Advance(4 * time.Second)
+	finished(t, jobs[1])
+	reversing(t, clock, "1d")
+	clock.Advance(500 * time.Millisecond)
+	energised(t, "1u")
+	clock.Advance(time.Second)
+	reversing(t, clock, "1u")
+	clock.Advance(500 * time.Millisecond)
+	energised(t, "1d")
+	clock.Advance(time.Second)
+	finished(t, jobs[2])
+
+	for i, job := range jobs {
+		if job.Status() != JobDone {
+			t.Errorf("job %d is %s, expected %s", i, job.Status(), JobDone)
+		}
+	}
+	checkTimeline(t, mark, []timelineEntry{
+		{ 0, "1d", true },
+		{ 2 * time.Second, "1d", false },
+		{ 2 * time.Second, "1d", true },
+		{ 6 * time.Second, "1d", false },
+		{ 6500 * time.Millisecond, "1u", true },
+		{ 7500 * time.Millisecond, "1u", false },
+		{ 8 * time.Second, "1d", true },
+		{ 9 * time.Second, "1d", false },
+	})
+	if status := shutter.Status(); status.Position != 60 || status.Angle != 1 {
+		t.Errorf("status is %+v, expected position 60 and angle 1", status)
+	}
+}
+
+func TestStopDuringReversal(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	shutter := state.Shutters["1"]
+	mark := len(SimTimeline())
+
+	job, err := state.Dispatch("1", Command{ Action: ActionMove, Position: 50 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	energised(t, "1d")
+	clock.Advance(5 * time.Second)
+	finished(t, job)
+
+	job, err = state.Dispatch("1", Command{ Action: ActionMove, Position: 0 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	reversing(t, clock, "1d")
+	// stopping must not wait for the dead time, and must not energise the
+	// reverse relay
+	if _, err := state.Dispatch("1", Command{ Action: ActionStop }); err != nil {
+		t.Fatal(err)
+	}
+	finished(t, job)
+	clock.Advance(time.Second)
+	if job.Status() != JobCancelled {
+		t.Errorf("job is %s, expected %s", job.Status(), JobCancelled)
+	}
+	checkTimeline(t, mark, []timelineEntry{
+		{ 0, "1d", true },
+		{ 5 * time.Second, "1d", false },
+	})
+	if status := shutter.Status(); status.Position != 50 {
+		t.Errorf("position is %f, expected 50", status.Position)
+	}
+}
+
+func TestNewShutterStateFailure(t *testing.T) {
+	SimReset(NewFakeClock(testEpoch))
+	path := filepath.Join(t.TempDir(), "state.json")
+	config := &Configuration{
+		UpTime: 10,
+		DownTime: 10,
+		StateFile: path,
+		Shutters: []ShutterConfiguration{
+			{ Name: "1", GpioUp: "sim:1u", GpioDown: "sim:1d" },
+			{ Name: "2", GpioUp: "sim:2u", GpioDown: "mcp23017:1:0x20:C9" },
+		},
+	}
+	if _, err := NewShutterState(config, NewFakeClock(testEpoch)); err == nil {
+		t.Fatal("invalid line was accepted")
+	}
+	// shutting down saves the position
+	store, err := LoadStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Get("1"); !ok {
+		t.Error("shutter 1 was not shut down")
+	}
+}
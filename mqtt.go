@@ -0,0 +1,613 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT defaults, used when the configuration leaves them out.
+const (
+	DefaultMqttTopic = "shudder"
+	DefaultMqttDiscovery = "homeassistant"
+	DefaultMqttKeepAlive = 60
+)
+
+// MqttReconnectInterval is the pause before reconnecting to the broker
+// after the connection was lost.
+const MqttReconnectInterval = 5 * time.Second
+
+// Payloads of the availability topic.
+const (
+	MqttOnline = "online"
+	MqttOffline = "offline"
+)
+
+// Payloads of the command topic, as sent by Home Assistant.
+const (
+	MqttOpen = "OPEN"
+	MqttClose = "CLOSE"
+	MqttStop = "STOP"
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	mqttConnect = 1
+	mqttConnack = 2
+	mqttPublish = 3
+	mqttPuback = 4
+	mqttSubscribe = 8
+	mqttSuback = 9
+	mqttPingreq = 12
+	mqttPingresp = 13
+	mqttDisconnect = 14
+)
+
+var (
+	ErrMqttProtocol = errors.New("MQTT protocol error")
+	ErrMqttRefused = errors.New("MQTT connection refused")
+)
+
+// MqttConfiguration connects the shutters to an MQTT broker.
+type MqttConfiguration struct {
+	// Broker is the host:port of the broker
+	Broker string
+	ClientId string
+	Username string
+	Password string
+	// Topic is the prefix of all state and command topics
+	Topic string
+	// Discovery is the Home Assistant discovery prefix
+	Discovery string
+	// KeepAlive is the MQTT keepalive interval, in seconds
+	KeepAlive int
+}
+
+// mqttClient is a minimal MQTT 3.1.1 client connection.
+// Only QoS 0 is used, which needs no session state.
+type mqttClient struct {
+	conn net.Conn
+	reader *bufio.Reader
+	// lock serialises writes
+	lock sync.Mutex
+	packetId uint16
+}
+
+// mqttWill is the message that the broker publishes when the client
+// disappears.
+type mqttWill struct {
+	Topic string
+	Payload string
+	Retain bool
+}
+
+// mqttMessage is a message received from the broker.
+type mqttMessage struct {
+	Topic string
+	Payload []byte
+}
+
+func appendMqttString(buffer []byte, value string) []byte {
+	buffer = append(buffer, byte(len(value) >> 8), byte(len(value)))
+	return append(buffer, value...)
+}
+
+func readMqttString(buffer []byte) (string, []byte, error) {
+	if len(buffer) < 2 {
+		return "", nil, ErrMqttProtocol
+	}
+	length := int(binary.BigEndian.Uint16(buffer))
+	if len(buffer) < 2 + length {
+		return "", nil, ErrMqttProtocol
+	}
+	return string(buffer[2:2 + length]), buffer[2 + length:], nil
+}
+
+// dialMqtt connects and logs in to a broker.
+func dialMqtt(config *MqttConfiguration, will *mqttWill) (*mqttClient, error) {
+	conn, err := net.DialTimeout("tcp", config.Broker, MqttReconnectInterval)
+	if err != nil {
+		return nil, err
+	}
+	client := &mqttClient{
+		conn: conn,
+		reader: bufio.NewReader(conn),
+	}
+
+	// clean session, we don't keep subscriptions across connections
+	flags := byte(0x02)
+	body := appendMqttString(nil, "MQTT")
+	payload := appendMqttString(nil, config.ClientId)
+	if will != nil {
+		// will with QoS 1
+		flags |= 0x04 | 0x08
+		if will.Retain {
+			flags |= 0x20
+		}
+		payload = appendMqttString(payload, will.Topic)
+		payload = appendMqttString(payload, will.Payload)
+	}
+	if config.Username != "" {
+		flags |= 0x80
+		payload = appendMqttString(payload, config.Username)
+		if config.Password != "" {
+			flags |= 0x40
+			payload = appendMqttString(payload, config.Password)
+		}
+	}
+	body = append(body, 4, flags, byte(config.KeepAlive >> 8), byte(config.KeepAlive))
+	body = append(body, payload...)
+
+	conn.SetDeadline(time.Now().Add(MqttReconnectInterval))
+	if err := client.writePacket(mqttConnect << 4, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	kind, body, err := client.readPacket()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if kind >> 4 != mqttConnack || len(body) != 2 {
+		conn.Close()
+		return nil, ErrMqttProtocol
+	}
+	if body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("%s: return code %d", ErrMqttRefused, body[1])
+	}
+	conn.SetDeadline(time.Time{})
+	return client, nil
+}
+
+func (client *mqttClient) writePacket(header byte, body []byte) error {
+	packet := []byte{ header }
+	// remaining length, 7 bits per byte
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	_, err := client.conn.Write(packet)
+	return err
+}
+
+func (client *mqttClient) readPacket() (byte, []byte, error) {
+	header, err := client.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return 0, nil, ErrMqttProtocol
+		}
+		digit, err := client.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(digit & 0x7f) << shift
+		if digit & 0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(client.reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// Publish sends a message with QoS 0.
+func (client *mqttClient) Publish(topic string, payload []byte, retain bool) error {
+	header := byte(mqttPublish << 4)
+	if retain {
+		header |= 0x01
+	}
+	body := appendMqttString(nil, topic)
+	body = append(body, payload...)
+	return client.writePacket(header, body)
+}
+
+// Subscribe requests messages on a set of topic filters with QoS 0.
+// The acknowledgement is received by Receive.
+func (client *mqttClient) Subscribe(topics ...string) error {
+	client.packetId++
+	if client.packetId == 0 {
+		client.packetId++
+	}
+	body := []byte{ byte(client.packetId >> 8), byte(client.packetId) }
+	for _, topic := range topics {
+		body = appendMqttString(body, topic)
+		body = append(body, 0)
+	}
+	return client.writePacket(mqttSubscribe << 4 | 0x02, body)
+}
+
+// Ping sends a keepalive request.
+func (client *mqttClient) Ping() error {
+	return client.writePacket(mqttPingreq << 4, nil)
+}
+
+// Receive waits for the next message, while handling acknowledgements.
+// The connection is considered dead when nothing arrives before the timeout.
+func (client *mqttClient) Receive(timeout time.Duration) (*mqttMessage, error) {
+	for {
+		client.conn.SetReadDeadline(time.Now().Add(timeout))
+		header, body, err := client.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		switch header >> 4 {
+			case mqttPublish:
+				topic, rest, err := readMqttString(body)
+				if err != nil {
+					return nil, err
+				}
+				if qos := (header >> 1) & 0x03; qos > 0 {
+					if len(rest) < 2 {
+						return nil, ErrMqttProtocol
+					}
+					if qos == 1 {
+						client.writePacket(mqttPuback << 4, rest[:2])
+					}
+					rest = rest[2:]
+				}
+				return &mqttMessage{
+					Topic: topic,
+					Payload: rest,
+				}, nil
+			case mqttSuback:
+				if len(body) < 2 {
+					return nil, ErrMqttProtocol
+				}
+				for _, code := range body[2:] {
+					if code == 0x80 {
+						return nil, errors.New("MQTT subscription rejected")
+					}
+				}
+			case mqttPingresp:
+			default:
+				return nil, ErrMqttProtocol
+		}
+	}
+}
+
+// Disconnect ends the session cleanly, without triggering the will.
+func (client *mqttClient) Disconnect() error {
+	client.writePacket(mqttDisconnect << 4, nil)
+	return client.conn.Close()
+}
+
+func (client *mqttClient) Close() error {
+	return client.conn.Close()
+}
+
+// MqttBridge publishes the shutters as Home Assistant cover entities and
+// accepts commands from MQTT. It keeps reconnecting to the broker until it
+// is closed.
+//
+// Topics are laid out as follows, below the configured prefix:
+//   status                availability, online or offline
+//   <name>/state          open, opening, closed, closing or stopped
+//   <name>/position       position in percent, 0 is open
+//   <name>/tilt           slat angle in percent, 0 is open
+//   <name>/set            OPEN, CLOSE or STOP
+//   <name>/position/set   move to a position
+//   <name>/tilt/set       flip to a slat angle
+type MqttBridge struct {
+	config MqttConfiguration
+	state *ShutterState
+	lock sync.Mutex
+	client *mqttClient
+	closed bool
+	closing chan struct{}
+	finished chan struct{}
+}
+
+// NewMqttBridge creates a bridge for a configuration, filling in defaults.
+func NewMqttBridge(config *MqttConfiguration, state *ShutterState) *MqttBridge {
+	bridge := &MqttBridge{
+		config: *config,
+		state: state,
+		closing: make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	if bridge.config.Topic == "" {
+		bridge.config.Topic = DefaultMqttTopic
+	}
+	if bridge.config.Discovery == "" {
+		bridge.config.Discovery = DefaultMqttDiscovery
+	}
+	if bridge.config.ClientId == "" {
+		bridge.config.ClientId = bridge.config.Topic
+	}
+	if bridge.config.KeepAlive <= 0 {
+		bridge.config.KeepAlive = DefaultMqttKeepAlive
+	}
+	return bridge
+}
+
+func (bridge *MqttBridge) topic(parts ...string) string {
+	return bridge.config.Topic + "/" + strings.Join(parts, "/")
+}
+
+// Run maintains the connection to the broker. It returns after Close.
+// Close must not be called before Run.
+func (bridge *MqttBridge) Run() {
+	defer close(bridge.finished)
+	for {
+		err := bridge.session()
+		bridge.lock.Lock()
+		closed := bridge.closed
+		bridge.client = nil
+		bridge.lock.Unlock()
+		if closed {
+			return
+		}
+		log.Printf("MQTT connection to %s lost: %s\n", bridge.config.Broker, err)
+		select {
+			case <-time.After(MqttReconnectInterval):
+			case <-bridge.closing:
+				return
+		}
+	}
+}
+
+// session runs a single connection to the broker.
+func (bridge *MqttBridge) session() error {
+	client, err := dialMqtt(&bridge.config, &mqttWill{
+		Topic: bridge.topic("status"),
+		Payload: MqttOffline,
+		Retain: true,
+	})
+	if err != nil {
+		return err
+	}
+	bridge.lock.Lock()
+	if bridge.closed {
+		bridge.lock.Unlock()
+		client.Close()
+		return nil
+	}
+	bridge.client = client
+	bridge.lock.Unlock()
+	defer client.Close()
+	log.Printf("Connected to MQTT broker %s\n", bridge.config.Broker)
+
+	// subscribe before taking the snapshot, so no change is lost in between
+	sub := bridge.state.Events.Subscribe("")
+	defer bridge.state.Events.Unsubscribe(sub)
+	if err := client.Subscribe(bridge.topic("+", "set"), bridge.topic("+", "position", "set"), bridge.topic("+", "tilt", "set")); err != nil {
+		return err
+	}
+	for name, shutter := range bridge.state.Shutters {
+		if err := bridge.announce(client, name); err != nil {
+			return err
+		}
+		if err := bridge.publishStatus(client, name, shutter.Status()); err != nil {
+			return err
+		}
+	}
+	if err := client.Publish(bridge.topic("status"), []byte(MqttOnline), true); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go bridge.forward(client, sub, done)
+
+	keepalive := time.Duration(bridge.config.KeepAlive) * time.Second
+	for {
+		// the broker answers pings, so a silent connection is dead
+		message, err := client.Receive(keepalive * 3 / 2)
+		if err != nil {
+			return err
+		}
+		bridge.handle(message)
+	}
+}
+
+// forward publishes shutter events and sends keepalive pings, until done is
+// closed.
+func (bridge *MqttBridge) forward(client *mqttClient, sub *Subscription, done <-chan struct{}) {
+	ping := time.NewTicker(time.Duration(bridge.config.KeepAlive) * time.Second / 2)
+	defer ping.Stop()
+	for {
+		select {
+			case event, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				if err := bridge.publishStatus(client, event.Shutter, event.Status); err != nil {
+					client.Close()
+					return
+				}
+			case <-ping.C:
+				if err := client.Ping(); err != nil {
+					client.Close()
+					return
+				}
+			case <-done:
+				return
+		}
+	}
+}
+
+// announce publishes the Home Assistant discovery configuration of a shutter.
+func (bridge *MqttBridge) announce(client *mqttClient, name string) error {
+	config, err := json.Marshal(map[string]interface{}{
+		"name": name,
+		"unique_id": bridge.config.ClientId + "_" + name,
+		"device_class": "shutter",
+		"availability_topic": bridge.topic("status"),
+		"payload_available": MqttOnline,
+		"payload_not_available": MqttOffline,
+		"state_topic": bridge.topic(name, "state"),
+		"command_topic": bridge.topic(name, "set"),
+		"payload_open": MqttOpen,
+		"payload_close": MqttClose,
+		"payload_stop": MqttStop,
+		"position_topic": bridge.topic(name, "position"),
+		"set_position_topic": bridge.topic(name, "position", "set"),
+		// positions count from the top, Home Assistant counts from the bottom
+		"position_open": PositionMin,
+		"position_closed": PositionMax,
+		"tilt_status_topic": bridge.topic(name, "tilt"),
+		"tilt_command_topic": bridge.topic(name, "tilt", "set"),
+		"tilt_min": 0,
+		"tilt_max": 100,
+		"tilt_opened_value": 0,
+		"tilt_closed_value": 100,
+		"optimistic": false,
+		"device": map[string]interface{}{
+			"identifiers": []string{ bridge.config.ClientId },
+			"name": bridge.config.ClientId,
+			"model": "shudder",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	topic := bridge.config.Discovery + "/cover/" + bridge.config.ClientId + "_" + name + "/config"
+	return client.Publish(topic, config, true)
+}
+
+// mqttState maps a shutter status to a Home Assistant cover state.
+func mqttState(status ShutterStatus) string {
+	if status.Moving {
+		switch status.Direction {
+			case DirectionUp:
+				return "opening"
+			case DirectionDown:
+				return "closing"
+		}
+	}
+	switch {
+		case status.Position <= PositionMin:
+			return "open"
+		case status.Position >= PositionMax:
+			return "closed"
+	}
+	return "stopped"
+}
+
+// publishStatus publishes the state, position and tilt of a shutter.
+func (bridge *MqttBridge) publishStatus(client *mqttClient, name string, status ShutterStatus) error {
+	if err := client.Publish(bridge.topic(name, "state"), []byte(mqttState(status)), true); err != nil {
+		return err
+	}
+	position := strconv.FormatFloat(float64(status.Position), 'f', 0, 32)
+	if err := client.Publish(bridge.topic(name, "position"), []byte(position), true); err != nil {
+		return err
+	}
+	tilt := strconv.FormatFloat(float64(status.Angle * 100), 'f', 0, 32)
+	return client.Publish(bridge.topic(name, "tilt"), []byte(tilt), true)
+}
+
+// handle dispatches a command received from the broker.
+func (bridge *MqttBridge) handle(message *mqttMessage) {
+	if !strings.HasPrefix(message.Topic, bridge.config.Topic + "/") {
+		return
+	}
+	path := strings.Split(strings.TrimPrefix(message.Topic, bridge.config.Topic + "/"), "/")
+	name := path[0]
+	if bridge.state.Shutters[name] == nil {
+		log.Printf("MQTT command for unknown shutter %s\n", name)
+		return
+	}
+	payload := strings.TrimSpace(string(message.Payload))
+
+	var command Command
+	switch strings.Join(path[1:], "/") {
+		case "set":
+			switch payload {
+				case MqttOpen:
+					command = Command{ Action: ActionMove, Position: PositionMin }
+				case MqttClose:
+					command = Command{ Action: ActionMove, Position: PositionMax }
+				case MqttStop:
+					command = Command{ Action: ActionStop }
+				default:
+					log.Printf("Unknown MQTT command %s for shutter %s\n", payload, name)
+					return
+			}
+		case "position/set":
+			position, err := strconv.ParseFloat(payload, 32)
+			if err != nil {
+				log.Printf("Invalid MQTT position %s for shutter %s\n", payload, name)
+				return
+			}
+			command = Command{ Action: ActionMove, Position: float32(position) }
+		case "tilt/set":
+			tilt, err := strconv.ParseFloat(payload, 32)
+			if err != nil {
+				log.Printf("Invalid MQTT tilt %s for shutter %s\n", payload, name)
+				return
+			}
+			command = Command{ Action: ActionFlip, Angle: float32(tilt / 100) }
+		default:
+			return
+	}
+	if _, err := bridge.state.Dispatch(name, command); err != nil {
+		log.Printf("MQTT command for shutter %s failed: %s\n", name, err)
+	}
+}
+
+// Close marks the shutters as unavailable and disconnects from the broker.
+func (bridge *MqttBridge) Close() {
+	bridge.lock.Lock()
+	bridge.closed = true
+	close(bridge.closing)
+	client := bridge.client
+	bridge.lock.Unlock()
+	if client != nil {
+		client.Publish(bridge.topic("status"), []byte(MqttOffline), true)
+		client.Disconnect()
+	}
+	<-bridge.finished
+}
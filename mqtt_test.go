@@ -0,0 +1,267 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeBroker accepts a single MQTT connection on the loopback interface.
+// It reuses the packet framing of the client.
+type fakeBroker struct {
+	listener net.Listener
+	conn *mqttClient
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	return &fakeBroker{
+		listener: listener,
+	}
+}
+
+func (broker *fakeBroker) Address() string {
+	return broker.listener.Addr().String()
+}
+
+// accept waits for the client and reads its CONNECT packet.
+func (broker *fakeBroker) accept(t *testing.T) []byte {
+	t.Helper()
+	conn, err := broker.listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	broker.conn = &mqttClient{
+		conn: conn,
+		reader: bufio.NewReader(conn),
+	}
+	return broker.expect(t, mqttConnect)
+}
+
+// expect reads the next packet, which must be of the given type.
+func (broker *fakeBroker) expect(t *testing.T, kind byte) []byte {
+	t.Helper()
+	header, body, err := broker.conn.readPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header >> 4 != kind {
+		t.Fatalf("packet type is %d, expected %d", header >> 4, kind)
+	}
+	return body
+}
+
+// publish sends a message to the client.
+func (broker *fakeBroker) publish(t *testing.T, topic string, payload string) {
+	t.Helper()
+	if err := broker.conn.Publish(topic, []byte(payload), false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readMqttStrings decodes a sequence of strings.
+func readMqttStrings(t *testing.T, body []byte, count int) ([]string, []byte) {
+	t.Helper()
+	values := make([]string, count)
+	for i := range values {
+		var err error
+		values[i], body, err = readMqttString(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return values, body
+}
+
+func TestMqttConnectWithWill(t *testing.T) {
+	broker := newFakeBroker(t)
+	connected := make(chan error, 1)
+	go func() {
+		client, err := dialMqtt(&MqttConfiguration{
+			Broker: broker.Address(),
+			ClientId: "house",
+			Username: "shudder",
+			Password: "secret",
+			KeepAlive: 30,
+		}, &mqttWill{
+			Topic: "shudder/status",
+			Payload: MqttOffline,
+			Retain: true,
+		})
+		if err == nil {
+			client.Close()
+		}
+		connected <- err
+	}()
+
+	body := broker.accept(t)
+	protocol, body := readMqttStrings(t, body, 1)
+	if protocol[0] != "MQTT" || len(body) < 4 || body[0] != 4 {
+		t.Fatalf("invalid protocol %s level %v", protocol[0], body)
+	}
+	// clean session, will with QoS 1 and retain, username and password
+	if flags := body[1]; flags != 0x02 | 0x04 | 0x08 | 0x20 | 0x80 | 0x40 {
+		t.Errorf("connect flags are %08b", flags)
+	}
+	if keepalive := int(body[2]) << 8 | int(body[3]); keepalive != 30 {
+		t.Errorf("keepalive is %d, expected 30", keepalive)
+	}
+	payload, rest := readMqttStrings(t, body[4:], 5)
+	expected := []string{ "house", "shudder/status", MqttOffline, "shudder", "secret" }
+	for i := range expected {
+		if payload[i] != expected[i] {
+			t.Errorf("connect payload is %q, expected %q", payload, expected)
+			break
+		}
+	}
+	if len(rest) != 0 {
+		t.Errorf("%d bytes left in connect packet", len(rest))
+	}
+	broker.conn.writePacket(mqttConnack << 4, []byte{ 0, 0 })
+	if err := <-connected; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMqttShortSuback(t *testing.T) {
+	server, conn := net.Pipe()
+	defer server.Close()
+	client := &mqttClient{
+		conn: conn,
+		reader: bufio.NewReader(conn),
+	}
+	defer client.Close()
+	go server.Write([]byte{ mqttSuback << 4, 1, 0 })
+	if _, err := client.Receive(time.Second); err != ErrMqttProtocol {
+		t.Errorf("short SUBACK returned %v, expected %v", err, ErrMqttProtocol)
+	}
+}
+
+func TestMqttBridge(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	broker := newFakeBroker(t)
+	bridge := NewMqttBridge(&MqttConfiguration{
+		Broker: broker.Address(),
+	}, state)
+	go bridge.Run()
+
+	broker.accept(t)
+	broker.conn.writePacket(mqttConnack << 4, []byte{ 0, 0 })
+	body := broker.expect(t, mqttSubscribe)
+	topics := []string{}
+	for rest := body[2:]; len(rest) > 0; rest = rest[1:] {
+		var topic string
+		var err error
+		if topic, rest, err = readMqttString(rest); err != nil || len(rest) == 0 {
+			t.Fatalf("invalid subscription %v", body)
+		}
+		topics = append(topics, topic)
+	}
+	expected := []string{ "shudder/+/set", "shudder/+/position/set", "shudder/+/tilt/set" }
+	if len(topics) != len(expected) || topics[0] != expected[0] || topics[1] != expected[1] || topics[2] != expected[2] {
+		t.Errorf("subscriptions are %v, expected %v", topics, expected)
+	}
+	broker.conn.writePacket(mqttSuback << 4, []byte{ body[0], body[1], 0, 0, 0 })
+
+	// the bridge announces the shutter, publishes its state and goes online
+	published := map[string]string{}
+	for published["shudder/status"] != MqttOnline {
+		topic, payload := readMqttStrings(t, broker.expect(t, mqttPublish), 1)
+		published[topic[0]] = string(payload)
+	}
+	discovery := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(published["homeassistant/cover/shudder_1/config"]), &discovery); err != nil {
+		t.Fatalf("invalid discovery payload: %s", err)
+	}
+	checks := map[string]interface{}{
+		"unique_id": "shudder_1",
+		"device_class": "shutter",
+		"availability_topic": "shudder/status",
+		"command_topic": "shudder/1/set",
+		"set_position_topic": "shudder/1/position/set",
+		"tilt_command_topic": "shudder/1/tilt/set",
+		"position_open": 0.0,
+		"position_closed": 100.0,
+	}
+	for key, value := range checks {
+		if discovery[key] != value {
+			t.Errorf("discovery %s is %v, expected %v", key, discovery[key], value)
+		}
+	}
+	if published["shudder/1/state"] != "open" || published["shudder/1/position"] != "0" || published["shudder/1/tilt"] != "0" {
+		t.Errorf("initial state is %v", published)
+	}
+
+	// commands are dispatched to the shutter
+	broker.publish(t, "shudder/1/position/set", "40")
+	energised(t, "1d")
+	clock.Advance(time.Second)
+	broker.publish(t, "shudder/1/set", MqttStop)
+	waitFor(t, "the shutter is stopped", func() bool {
+		return !SimLine("1d").Value()
+	})
+	if position := state.Shutters["1"].Status().Position; position != 10 {
+		t.Errorf("position is %f, expected 10", position)
+	}
+	broker.publish(t, "shudder/1/set", MqttOpen)
+	reversing(t, clock, "1d")
+	clock.Advance(500 * time.Millisecond)
+	energised(t, "1u")
+
+	// the bridge goes offline cleanly when it is closed
+	status := make(chan string, 1)
+	go func() {
+		last := ""
+		for {
+			header, body, err := broker.conn.readPacket()
+			if err != nil || header >> 4 == mqttDisconnect {
+				status <- last
+				return
+			}
+			if topic, payload, err := readMqttString(body); err == nil && header >> 4 == mqttPublish && topic == "shudder/status" {
+				last = string(payload)
+			}
+		}
+	}()
+	bridge.Close()
+	if last := <-status; last != MqttOffline {
+		t.Errorf("status is %s after closing, expected %s", last, MqttOffline)
+	}
+}
@@ -0,0 +1,161 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+)
+
+// SavedShutter is the persistent state of a single shutter.
+type SavedShutter struct {
+	Position float32
+	Angle float32
+	// Moving is set while a movement is in progress. If it is still set when
+	// the state is loaded, the daemon was interrupted and the position is
+	// uncertain.
+	Moving bool
+}
+
+// StateFile keeps the positions of all shutters on disk, so they survive
+// a restart of the daemon.
+// The file is replaced atomically on every update.
+type StateFile struct {
+	path string
+	lock sync.Mutex
+	Shutters map[string]SavedShutter
+}
+
+// LoadStateFile reads the saved state from a file.
+// A missing file is not an error, an empty state is returned instead.
+func LoadStateFile(path string) (*StateFile, error) {
+	file := &StateFile{
+		path: path,
+		Shutters: make(map[string]SavedShutter),
+	}
+	input, err := os.Open(path)
+	if os.IsNotExist(err) {
+		log.Printf("State file %s does not exist yet\n", path)
+		return file, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	decoder := json.NewDecoder(input)
+	if err := decoder.Decode(file); err != nil {
+		return nil, err
+	}
+	if file.Shutters == nil {
+		file.Shutters = make(map[string]SavedShutter)
+	}
+	return file, nil
+}
+
+// Get returns the saved state of a shutter, if there is one.
+func (file *StateFile) Get(name string) (SavedShutter, bool) {
+	file.lock.Lock()
+	defer file.lock.Unlock()
+	saved, ok := file.Shutters[name]
+	return saved, ok
+}
+
+// Update changes the saved state of a shutter and writes the file.
+func (file *StateFile) Update(name string, saved SavedShutter) error {
+	file.lock.Lock()
+	defer file.lock.Unlock()
+	file.Shutters[name] = saved
+	return file.write()
+}
+
+// write replaces the state file.
+// The caller must hold the lock.
+func (file *StateFile) write() error {
+	return writeJSONFile(file.path, file)
+}
+
+// writeJSONFile replaces a file with the JSON encoding of a value atomically,
+// by writing to a temporary file and renaming it over the old one.
+func writeJSONFile(path string, data interface{}) error {
+	temp := path + ".tmp"
+	output, err := os.OpenFile(temp, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(output)
+	if err := encoder.Encode(data); err != nil {
+		output.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := output.Sync(); err != nil {
+		output.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := output.Close(); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// save records the state of the shutter in the state file, if there is one.
+func (shutter *Shutter) save(moving bool) {
+	if shutter.Store == nil {
+		return
+	}
+	status := shutter.Status()
+	err := shutter.Store.Update(shutter.Name, SavedShutter{
+		Position: status.Position,
+		Angle: status.Angle,
+		Moving: moving,
+	})
+	if err != nil {
+		log.Printf("Can't save state of shutter %s: %s\n", shutter.Name, err)
+	}
+}
+
+// restore loads the state of the shutter from the state file.
+// If the shutter was moving when the state was saved, the position is marked
+// as uncertain.
+func (shutter *Shutter) restore() {
+	if shutter.Store == nil {
+		return
+	}
+	saved, ok := shutter.Store.Get(shutter.Name)
+	if !ok {
+		return
+	}
+	shutter.setPosition(clampPosition(saved.Position), saved.Angle)
+	if saved.Moving {
+		log.Printf("Shutter %s was moving when the state was saved\n", shutter.Name)
+		shutter.setCalibration(CalibrationUncertain)
+	} else {
+		shutter.setCalibration(CalibrationRestored)
+	}
+}
@@ -0,0 +1,183 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ActionMove = "move"
+	ActionFlip = "flip"
+	ActionReset = "reset"
+	// ActionStop is never queued, it interrupts the queue instead
+	ActionStop = "stop"
+)
+
+// Command sources, to tell manual commands from automatic ones.
+// Commands are manual unless they say otherwise.
+const (
+	SourceManual = ""
+	SourceSchedule = "schedule"
+	SourceShade = "shade"
+)
+
+const (
+	JobQueued = "queued"
+	JobRunning = "running"
+	JobDone = "done"
+	JobFailed = "failed"
+	JobCancelled = "cancelled"
+)
+
+var (
+	ErrQueueFull = errors.New("command queue is full")
+	ErrUnknownAction = errors.New("unknown action")
+	ErrUnknownShutter = errors.New("unknown shutter")
+)
+
+// lastJobId is the most recently assigned job ID, shared by all shutters.
+// IDs are unique for the lifetime of the process.
+var lastJobId uint64
+
+// Command describes a single action that should be carried out on a shutter.
+// Only the arguments relevant to the action are used.
+type Command struct {
+	Action string
+	Position float32
+	Angle float32
+	// Source tells who issued the command
+	Source string
+}
+
+// Job is a command that has been submitted to a shutter's queue.
+// Its status is updated by the shutter's worker as the command progresses.
+type Job struct {
+	ID uint64
+	Shutter string
+	Command Command
+	Created time.Time
+	lock sync.Mutex
+	status string
+	started time.Time
+	finished time.Time
+	err error
+	done chan struct{}
+	clock Clock
+}
+
+func newJob(shutter string, command Command, clock Clock) *Job {
+	return &Job{
+		ID: atomic.AddUint64(&lastJobId, 1),
+		Shutter: shutter,
+		Command: command,
+		Created: clock.Now(),
+		clock: clock,
+		status: JobQueued,
+		done: make(chan struct{}),
+	}
+}
+
+// Status returns the current state of the job.
+func (job *Job) Status() string {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.status
+}
+
+// Done returns a channel that is closed when the job has finished.
+func (job *Job) Done() <-chan struct{} {
+	return job.done
+}
+
+// Wait blocks until the job has finished.
+func (job *Job) Wait() {
+	<-job.done
+}
+
+// Report returns a serialisable summary of the job.
+func (job *Job) Report() map[string]interface{} {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	report := map[string]interface{}{
+		"id": job.ID,
+		"shutter": job.Shutter,
+		"action": job.Command.Action,
+		"status": job.status,
+		"created": job.Created,
+	}
+	switch job.Command.Action {
+		case ActionMove:
+			report["position"] = job.Command.Position
+		case ActionFlip:
+			report["angle"] = job.Command.Angle
+	}
+	if job.Command.Source != SourceManual {
+		report["source"] = job.Command.Source
+	}
+	if !job.started.IsZero() {
+		report["started"] = job.started
+	}
+	if !job.finished.IsZero() {
+		report["finished"] = job.finished
+	}
+	if job.err != nil {
+		report["error"] = job.err.Error()
+	}
+	return report
+}
+
+func (job *Job) start() {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.status = JobRunning
+	job.started = job.clock.Now()
+}
+
+func (job *Job) finish(status string) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.status = status
+	job.finished = job.clock.Now()
+	close(job.done)
+}
+
+func (job *Job) fail(err error) {
+	job.lock.Lock()
+	job.err = err
+	job.lock.Unlock()
+	job.finish(JobFailed)
+}
+
+// Err returns the error that caused the job to fail, if any.
+func (job *Job) Err() error {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.err
+}
@@ -0,0 +1,214 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultDeadTime is the pause that is enforced before a motor is reversed,
+// unless configured otherwise.
+const DefaultDeadTime = 500 * time.Millisecond
+
+var ErrInvalidDirection = errors.New("invalid direction")
+
+// Direction is the direction of travel of a shutter motor.
+type Direction int
+
+const (
+	DirectionNone Direction = iota
+	DirectionUp
+	DirectionDown
+)
+
+func (direction Direction) String() string {
+	switch direction {
+		case DirectionUp:
+			return "up"
+		case DirectionDown:
+			return "down"
+		default:
+			return "none"
+	}
+}
+
+// RelayPair guards the two GPIO lines that drive a shutter motor.
+// At most one of the lines is energised at any time: The active line is
+// always switched off before the other one is switched on, and all changes
+// are serialised. When the direction is reversed, the motor is given at least
+// DeadTime to come to a standstill.
+type RelayPair struct {
+	DeadTime time.Duration
+	Clock Clock
+	up Gpio
+	down Gpio
+	lock sync.Mutex
+	// active is the currently energised direction
+	active Direction
+	// last is the direction that was most recently energised
+	last Direction
+	// released is the moment when the last direction was de-energised
+	released time.Time
+}
+
+func NewRelayPair(up Gpio, down Gpio, deadtime time.Duration, clock Clock) *RelayPair {
+	return &RelayPair{
+		DeadTime: deadtime,
+		Clock: clock,
+		up: up,
+		down: down,
+	}
+}
+
+func (relay *RelayPair) line(direction Direction) Gpio {
+	switch direction {
+		case DirectionUp:
+			return relay.up
+		case DirectionDown:
+			return relay.down
+		default:
+			return nil
+	}
+}
+
+// Init sets up both GPIO lines and switches them off.
+func (relay *RelayPair) Init() error {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	for _, gpio := range []Gpio{ relay.up, relay.down } {
+		if err := gpio.Init(); err != nil {
+			return err
+		}
+		if err := gpio.Set(false); err != nil {
+			return err
+		}
+	}
+	relay.active = DirectionNone
+	return nil
+}
+
+// Active returns the direction that is currently energised.
+func (relay *RelayPair) Active() Direction {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	return relay.active
+}
+
+// Drive energises the line for the given direction.
+// If the other line is active, it is switched off first. Reversing the
+// direction blocks until the dead time has elapsed.
+// DirectionNone switches both lines off.
+func (relay *RelayPair) Drive(direction Direction) error {
+	return relay.DriveCancel(direction, nil)
+}
+
+// DriveCancel is like Drive, but gives up waiting for the dead time when
+// cancel is closed, and returns ErrStopped without energising the line.
+// The lock is not held while waiting, so the relays can be released in the
+// meantime.
+func (relay *RelayPair) DriveCancel(direction Direction, cancel <-chan struct{}) error {
+	if direction != DirectionNone && relay.line(direction) == nil {
+		return ErrInvalidDirection
+	}
+
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+
+	for {
+		if direction == relay.active {
+			return nil
+		}
+
+		if relay.active != DirectionNone {
+			if err := relay.line(relay.active).Set(false); err != nil {
+				// the state of the line is unknown, never energise the other one
+				log.Printf("Can't release %s relay: %s\n", relay.active, err)
+				return err
+			}
+			relay.last = relay.active
+			relay.released = relay.Clock.Now()
+			relay.active = DirectionNone
+		}
+
+		if direction == DirectionNone {
+			return nil
+		}
+
+		select {
+			case <-cancel:
+				return ErrStopped
+			default:
+		}
+
+		var wait time.Duration
+		if relay.last != DirectionNone && relay.last != direction {
+			wait = relay.DeadTime - relay.Clock.Now().Sub(relay.released)
+		}
+		if wait <= 0 {
+			break
+		}
+
+		log.Printf("Waiting %s before reversing to %s\n", wait, direction)
+		relay.lock.Unlock()
+		timer := relay.Clock.NewTimer(wait)
+		select {
+			case <-timer.C():
+			case <-cancel:
+				timer.Stop()
+		}
+		relay.lock.Lock()
+		// the relays may have been changed while waiting, start over
+	}
+
+	if err := relay.line(direction).Set(true); err != nil {
+		log.Printf("Can't energise %s relay: %s\n", direction, err)
+		relay.line(direction).Set(false)
+		return err
+	}
+	relay.active = direction
+	return nil
+}
+
+// Release switches both lines off.
+func (relay *RelayPair) Release() error {
+	return relay.Drive(DirectionNone)
+}
+
+// Close releases both relays and closes the GPIO lines.
+func (relay *RelayPair) Close() error {
+	err := relay.Release()
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	for _, gpio := range []Gpio{ relay.up, relay.down } {
+		if cerr := gpio.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
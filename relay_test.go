@@ -0,0 +1,218 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// newSimRelayPair creates a relay pair on two fresh simulated lines.
+func newSimRelayPair(t *testing.T, deadtime time.Duration, clock Clock) *RelayPair {
+	SimReset(clock)
+	up, err := NewGpio("sim:up", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	down, err := NewGpio("sim:down", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := NewRelayPair(up, down, deadtime, clock)
+	if err := relay.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return relay
+}
+
+// checkInterlock verifies that both lines were never energised together, and
+// that the motor was given the dead time before every reversal.
+func checkInterlock(t *testing.T, timeline []SimEvent, deadtime time.Duration) {
+	level := map[string]bool{}
+	released := map[string]time.Time{}
+	last := ""
+	for _, event := range timeline {
+		other := map[string]string{"up": "down", "down": "up"}[event.Line]
+		if event.Value {
+			if level[other] {
+				t.Fatalf("%s energised at %s while %s is active", event.Line, event.Time, other)
+			}
+			if last == other {
+				if pause := event.Time.Sub(released[other]); pause < deadtime {
+					t.Fatalf("%s energised %s after %s was released, dead time is %s", event.Line, pause, other, deadtime)
+				}
+			}
+			if !level[event.Line] {
+				last = event.Line
+			}
+		} else if level[event.Line] {
+			released[event.Line] = event.Time
+		}
+		level[event.Line] = event.Value
+	}
+}
+
+func TestRelayPairReversal(t *testing.T) {
+	clock := NewFakeClock(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC))
+	relay := newSimRelayPair(t, 500 * time.Millisecond, clock)
+
+	if err := relay.Drive(DirectionUp); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Second)
+	done := make(chan error)
+	go func() {
+		done <- relay.Drive(DirectionDown)
+	}()
+	// the reversal waits for the dead time
+	clock.BlockUntil(1)
+	if SimLine("down").Value() {
+		t.Fatal("down relay energised before the dead time elapsed")
+	}
+	clock.Advance(500 * time.Millisecond)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if relay.Active() != DirectionDown {
+		t.Fatalf("active direction is %s, expected down", relay.Active())
+	}
+	if err := relay.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := clock.Now().Add(-2500 * time.Millisecond)
+	expected := []SimEvent{
+		{ Time: start, Line: "up", Value: false, Level: false },
+		{ Time: start, Line: "down", Value: false, Level: false },
+		{ Time: start, Line: "up", Value: true, Level: true },
+		{ Time: start.Add(2 * time.Second), Line: "up", Value: false, Level: false },
+		{ Time: start.Add(2500 * time.Millisecond), Line: "down", Value: true, Level: true },
+		{ Time: start.Add(2500 * time.Millisecond), Line: "down", Value: false, Level: false },
+	}
+	timeline := SimTimeline()
+	if len(timeline) != len(expected) {
+		t.Fatalf("timeline has %d events, expected %d: %v", len(timeline), len(expected), timeline)
+	}
+	for i := range expected {
+		if !timeline[i].Time.Equal(expected[i].Time) || timeline[i].Line != expected[i].Line || timeline[i].Value != expected[i].Value || timeline[i].Level != expected[i].Level {
+			t.Errorf("event %d is %v, expected %v", i, timeline[i], expected[i])
+		}
+	}
+}
+
+func TestRelayPairSameDirection(t *testing.T) {
+	clock := NewFakeClock(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC))
+	relay := newSimRelayPair(t, 500 * time.Millisecond, clock)
+
+	// driving the same direction again after a release needs no dead time
+	if err := relay.Drive(DirectionUp); err != nil {
+		t.Fatal(err)
+	}
+	if err := relay.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := relay.Drive(DirectionUp); err != nil {
+		t.Fatal(err)
+	}
+	if clock.Pending() != 0 {
+		t.Fatal("relay waited for the dead time without reversing")
+	}
+	if !SimLine("up").Value() || SimLine("down").Value() {
+		t.Fatal("up relay is not the only energised one")
+	}
+}
+
+func TestRelayPairCancelDeadTime(t *testing.T) {
+	clock := NewFakeClock(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC))
+	relay := newSimRelayPair(t, 500 * time.Millisecond, clock)
+
+	if err := relay.Drive(DirectionUp); err != nil {
+		t.Fatal(err)
+	}
+	cancel := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- relay.DriveCancel(DirectionDown, cancel)
+	}()
+	clock.BlockUntil(1)
+	// a release during the dead time must not wait for it
+	if err := relay.Release(); err != nil {
+		t.Fatal(err)
+	}
+	close(cancel)
+	if err := <-done; err != ErrStopped {
+		t.Fatalf("reversal returned %v, expected %v", err, ErrStopped)
+	}
+	clock.Advance(time.Second)
+	if SimLine("down").Value() || relay.Active() != DirectionNone {
+		t.Fatal("down relay energised after the reversal was cancelled")
+	}
+}
+
+func TestRelayPairConcurrent(t *testing.T) {
+	deadtime := 2 * time.Millisecond
+	relay := newSimRelayPair(t, deadtime, SystemClock)
+
+	var wait sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			for j := 0; j < 50; j++ {
+				var err error
+				switch (i + j) % 3 {
+					case 0:
+						err = relay.Drive(DirectionUp)
+					case 1:
+						err = relay.Drive(DirectionDown)
+					case 2:
+						err = relay.Release()
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wait.Wait()
+	if err := relay.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	timeline := SimTimeline()
+	checkInterlock(t, timeline, deadtime)
+	energised := 0
+	for _, event := range timeline {
+		if event.Value {
+			energised++
+		}
+	}
+	if energised == 0 {
+		t.Fatal("no relay was ever energised")
+	}
+}
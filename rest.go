@@ -0,0 +1,964 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RestEndpoint is a node in the versioned REST API.
+// Unlike the legacy Endpoint, it distinguishes between HTTP methods, so that
+// reads and actions can be told apart.
+type RestEndpoint interface {
+	// Resolve finds the endpoint that is responsible for a sub-path.
+	// An empty path refers to the endpoint itself.
+	// Returns nil if the path does not exist.
+	Resolve(path []string) RestEndpoint
+	// Methods returns the HTTP methods that the endpoint supports.
+	Methods() []string
+	// Serve handles a request. The method is always one of Methods().
+	Serve(method string, query url.Values, body []byte) ([]byte, int)
+}
+
+// isSelf checks if a path refers to the endpoint itself.
+func isSelf(path []string) bool {
+	return len(path) == 0 || (len(path) == 1 && path[0] == "")
+}
+
+// resolveLeaf is the Resolve implementation of endpoints without children.
+func resolveLeaf(ep RestEndpoint, path []string) RestEndpoint {
+	if isSelf(path) {
+		return ep
+	}
+	return nil
+}
+
+// resolveChildren is the Resolve implementation of endpoints with a fixed set
+// of children.
+func resolveChildren(ep RestEndpoint, children map[string]RestEndpoint, path []string) RestEndpoint {
+	if isSelf(path) {
+		return ep
+	}
+	child := children[path[0]]
+	if child == nil {
+		return nil
+	}
+	return child.Resolve(path[1:])
+}
+
+func sortedKeys(children map[string]RestEndpoint) []string {
+	keys := make([]string, 0, len(children))
+	for key := range children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CommandArguments is the JSON request body of commands.
+// Absent arguments are nil.
+type CommandArguments struct {
+	Position *float32
+	Angle *float32
+}
+
+// Command builds a command for an action from the arguments.
+// A missing argument is reported like an out-of-range one.
+func (args *CommandArguments) Command(action string) (Command, error) {
+	command := Command{
+		Action: action,
+	}
+	switch action {
+		case ActionMove:
+			if args.Position == nil {
+				return command, ErrPositionRange
+			}
+			command.Position = *args.Position
+		case ActionFlip:
+			if args.Angle == nil {
+				return command, ErrAngleRange
+			}
+			command.Angle = *args.Angle
+	}
+	return command, nil
+}
+
+// parseArguments decodes a JSON request body. An empty body has no arguments.
+func parseArguments(body []byte) (*CommandArguments, error) {
+	args := &CommandArguments{}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return args, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+func notFound() ([]byte, int) {
+	return jsonResponse(map[string]interface{}{
+		"error": ErrInvalidObject,
+	}, http.StatusNotFound)
+}
+
+func malformedBody(err error) ([]byte, int) {
+	log.Print(err)
+	return jsonResponse(map[string]interface{}{
+		"error": ErrInvalidArgument,
+		"message": err.Error(),
+	}, http.StatusBadRequest)
+}
+
+// RestTree is an endpoint that only lists its children.
+type RestTree struct {
+	children map[string]RestEndpoint
+}
+
+func NewRestTree() *RestTree {
+	return &RestTree{
+		children: make(map[string]RestEndpoint),
+	}
+}
+
+func (ep *RestTree) Resolve(path []string) RestEndpoint {
+	return resolveChildren(ep, ep.children, path)
+}
+
+func (ep *RestTree) Methods() []string {
+	return []string{ http.MethodGet }
+}
+
+func (ep *RestTree) Serve(method string, query url.Values, body []byte) ([]byte, int) {
+	return jsonResponse(map[string]interface{}{
+		"children": sortedKeys(ep.children),
+	}, http.StatusOK)
+}
+
+// NewRestApi creates the tree of the versioned API, rooted at /api/v1/.
+func NewRestApi(state *ShutterState) *RestTree {
+	api := NewRestTree()
+	api.children["shutters"] = NewRestShuttersEndpoint(state)
+	api.children["groups"] = NewRestGroupsEndpoint(state)
+	api.children["scenes"] = NewRestScenesEndpoint(state)
+	api.children["schedules"] = NewRestSchedulesEndpoint(state)
+	if state.Coordinates != nil {
+		api.children["sun"] = NewRestSunEndpoint(state)
+	}
+	return api
+}
+
+type RestShuttersEndpoint struct {
+	state *ShutterState
+	children map[string]RestEndpoint
+}
+
+func NewRestShuttersEndpoint(state *ShutterState) *RestShuttersEndpoint {
+	ep := &RestShuttersEndpoint{
+		state: state,
+		children: make(map[string]RestEndpoint),
+	}
+	for name := range state.Shutters {
+		ep.children[name] = NewRestShutterEndpoint(state, name)
+	}
+	return ep
+}
+
+func (ep *RestShuttersEndpoint) Resolve(path []string) RestEndpoint {
+	return resolveChildren(ep, ep.children, path)
+}
+
+func (ep *RestShuttersEndpoint) Methods() []string {
+	return []string{ http.MethodGet }
+}
+
+func (ep *RestShuttersEndpoint) Serve(method string, query url.Values, body []byte) ([]byte, int) {
+	shutters := make([]interface{}, 0, len(ep.children))
+	for _, name := range sortedKeys(ep.children) {
+		shutters = append(shutters, shutterReport(ep.state.Shutters[name]))
+	}
+	return jsonResponse(map[string]interface{}{
+		"shutters": shutters,
+	}, http.StatusOK)
+}
+
+// RestShutterEndpoint reports the state of a shutter with GET, and moves it
+// to a new position and slat angle with PUT.
+type RestShutterEndpoint struct {
+	state *ShutterState
+	name string
+	children map[string]RestEndpoint
+}
+
+func NewRestShutterEndpoint(state *ShutterState, name string) *RestShutterEndpoint {
+	ep := &RestShutterEndpoint{
+		state: state,
+		name: name,
+		children: make(map[string]RestEndpoint),
+	}
+	ep.children["move"] = NewRestCommandEndpoint(state, name, ActionMove)
+	ep.children["flip"] = NewRestCommandEndpoint(state, name, ActionFlip)
+	ep.children["stop"] = NewRestCommandEndpoint(state, name, ActionStop)
+	ep.children["jobs"] = NewRestJobsEndpoint(state, name)
+	if state.Shutters[name].TiltMode != TiltModeOff {
+		ep.children["shade"] = NewRestShadeEndpoint(state, name)
+	}
+	return ep
+}
+
+func (ep *RestShutterEndpoint) Resolve(path []string) RestEndpoint {
+	return resolveChildren(ep, ep.children, path)
+}
+
+func (ep *RestShutterEndpoint) Methods() []string {
+	return []string{ http.MethodGet, http.MethodPut }
+}
+
+func (ep *RestShutterEndpoint) Serve(method string, query url.Values, body []byte) ([]byte, int) {
+	if method == http.MethodGet {
+		report := shutterReport(ep.state.Shutters[ep.name])
+		report["children"] = sortedKeys(ep.children)
+		return jsonResponse(report, http.StatusOK)
+	}
+
+	args, err := parseArguments(body)
+	if err != nil {
+		return malformedBody(err)
+	}
+	if args.Position == nil && args.Angle == nil {
+		return argumentError("position", PositionMin, PositionMax)
+	}
+	if args.Position != nil && !ValidPosition(*args.Position) {
+		return argumentError("position", PositionMin, PositionMax)
+	}
+	if args.Angle != nil && !ValidAngle(*args.Angle) {
+		return argumentError("angle", AngleMin, AngleMax)
+	}
+	jobs := make([]interface{}, 0, 2)
+	if args.Position != nil {
+		job, err := ep.state.Dispatch(ep.name, Command{
+			Action: ActionMove,
+			Position: *args.Position,
+		})
+		if err != nil {
+			return jobResponse(job, err)
+		}
+		jobs = append(jobs, job.ID)
+	}
+	if args.Angle != nil {
+		job, err := ep.state.Dispatch(ep.name, Command{
+			Action: ActionFlip,
+			Angle: *args.Angle,
+		})
+		if err != nil && len(jobs) == 0 {
+			return jobResponse(job, err)
+		}
+		if err != nil {
+			// the move is already queued, the client needs its job to
+			// follow or stop it
+			log.Print(err)
+			code := ErrInternal
+			if err == ErrQueueFull || err == ErrShutdown {
+				code = ErrBusy
+			}
+			return jsonResponse(map[string]interface{}{
+				"name": ep.name,
+				"jobs": jobs,
+				"error": code,
+			}, http.StatusAccepted)
+		}
+		jobs = append(jobs, job.ID)
+	}
+	return jsonResponse(map[string]interface{}{
+		"name": ep.name,
+		"jobs": jobs,
+	}, http.StatusAccepted)
+}
+
+// RestCommandEndpoint carries out a single action on a shutter with POST.
+type RestCommandEndpoint struct {
+	state *ShutterState
+	name string
+	action string
+}
+
+func NewRestCommandEndpoint(state *ShutterState, name string, action string) *RestCommandEndpoint {
+	return &RestCommandEndpoint{
+		state: state,
+		name: name,
+		action: action,
+	}
+}
+
+func (ep *RestCommandEndpoint) Resolve(path []string) RestEndpoint {
+	return resolveLeaf(ep, path)
+}
+
+func (ep *RestCommandEndpoint) Methods() []string {
+	return []string{ http.MethodPost }
+}
+
+func (ep *RestCommandEndpoint) Serve(method string, query url.Values, body []byte) ([]byte, int) {
+	args, err := parseArguments(body)
+	if err != nil {
+		return malformedBody(err)
+	}
+	command, err := args.Command(ep.action)
+	if err != nil {
+		return jobResponse(nil, err)
+	}
+	job, err := ep.state.Dispatch(ep.name, command)
+	if ep.action == ActionStop {
+		return stopResponse(ep.state.Shutters[ep.name], err)
+	}
+	return jobResponse(job, err)
+}
+
+// ShadeArguments is the JSON request body of the shade endpoint.
+type ShadeArguments struct {
+	Enabled *bool
+}
+
+// RestShadeEndpoint reports the state of the shade automation of a shutter
+// with GET, and enables or disables it with PUT.
+type RestShadeEndpoint struct {
+	state *ShutterState
+	name string
+}
+
+func NewRestShadeEndpoint(state *ShutterState, name string) *RestShadeEndpoint {
+	return &RestShadeEndpoint{
+		state: state,
+		name: name,
+	}
+}
+
+func (ep *RestShadeEndpoint) Resolve(path []string) RestEndpoint {
+	return resolveLeaf(ep, path)
+}
+
+func (ep *RestShadeEndpoint) Methods() []string {
+	return []string{ http.MethodGet, http.MethodPut }
+}
+
+func (ep *RestShadeEndpoint) Serve(method string, query url.Values, body []byte) ([]byte, int) {
+	shutter := ep.state.Shutters[ep.name]
+	if method == http.MethodPut {
+		args := ShadeArguments{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&args); err != nil {
+			return malformedBody(err)
+		}
+		if args.Enabled == nil {
+			return jsonResponse(map[string]interface{}{
+				"error": ErrInvalidArgument,
+				"message": "enabled is required",
+			}, http.StatusBadRequest)
+		}
+		log.Printf("Setting shade automation of shutter %s to %t\n", ep.name, *args.Enabled)
+		shutter.SetShade(*args.Enabled)
+		ep.state.Shade.Wake()
+	}
+	return jsonResponse(shutter.ShadeReport(), http.StatusOK)
+}
+
+type RestJobsEndpoint struct {
+	state *ShutterState
+	name string
+}
+
+func NewRestJobsEndpoint(state *ShutterState, name string) *RestJobsEndpoint {
+	return &RestJobsEndpoint{
+		state: state,
+		name: name,
+	}
+}
+
+func (ep *RestJobsEndpoint) Resolve(path []string) RestEndpoint {
+	if isSelf(path) {
+		return ep
+	}
+	if !isSelf(path[1:]) {
+		return nil
+	}
+	id, err := strconv.ParseUint(path[0], 10, 64)
+	if err != nil {
+		return nil
+	}
+	job := ep.state.Shutters[ep.name].Job(id)
+	if job == nil {
+		return nil
+	}
+	return &RestJobEndpoint{
+		job: job,
+	}
+}
+
+func (ep *RestJobsEndpoint) Methods() []string {
+	return []string{ http.MethodGet }
+}
+
+func (ep *RestJobsEndpoint) Serve(method string, query url.Values, body []byte) ([]byte, int) {
+	return jsonResponse(map[string]interface{}{
+		"name": ep.name,
+		"jobs": ep.state.Shutters[ep.name].Jobs(),
+	}, http.StatusOK)
+}
+
+type RestJobEndpoint struct {
+	job *Job
+}
+
+func (ep *RestJobEndpoint) Resolve(path []string) RestEndpoint {
+	return resolveLeaf(ep, path)
+}
+
+func (ep *RestJobEndpoint) Methods() []string {
+	return []string{ http.MethodGet }
+}
+
+func (ep *RestJobEndpoint) Serve(method string, query url.Values, body []byte) ([]byte, int) {
+	return jsonResponse(ep.job.Report(), http.StatusOK)
+}
+
+type RestGroupsEndpoint struct {
+	state *ShutterState
+	children map[string]RestEndpoint
+}
+
+func NewRestGroupsEndpoint(state *ShutterState) *RestGroupsEndpoint {
+	ep := &RestGroupsEndpoint{
+		state: state,
+		children: make(map[string]RestEndpoint),
+	}
+	for name := range state.Groups {
+		ep.children[name] = NewRestGroupEndpoint(state, name)
+	}
+	return ep
+}
+
+func (ep *RestGroupsEndpoint) Resolve(path []string) RestEndpoint {
+	return resolveChildren(ep, ep.children, path)
+}
+
+func (ep *RestGroupsEndpoint) Methods() []string {
+	return []string{ http.MethodGet }
+}
+
+func (ep *RestGroupsEndpoint) Serve(method string, query url.Values, body []byte) ([]byte, int) {
+	groups := make([]interface{}, 0, len(ep.children))
+	for _, name := range sortedKeys(ep.children) {
+		groups = append(groups, groupReport(ep.state, ep.state.Groups[name]))
+	}
+	return jsonResponse(map[string]interface{}{
+		"groups": groups,
+	}, http.StatusOK)
+}
+
+// RestGroupEndpoint reports the combined state of a group with GET, and
+// moves all of its shutters with PUT, like RestShutterEndpoint.
+type RestGroupEndpoint struct {
+	state *ShutterState
+	name string
+	children map[string]RestEndpoint
+}
+
+func NewRestGroupEndpoint(state *ShutterState, name string) *RestGroupEndpoint {
+	ep := &RestGroupEndpoint{
+		state: state,
+		name: name,
+		children: make(map[string]RestEndpoint),
+	}
+	ep.children["move"] = NewRestGroupCommandEndpoint(state, name, ActionMove)
+	ep.children["flip"] = NewRestGroupCommandEndpoint(state, name, ActionFlip)
+	ep.children["stop"] = NewRestGroupCommandEndpoint(state, name, ActionStop)
+	return ep
+}
+
+func (ep *RestGroupEndpoint) Resolve(path []string) RestEndpoint {
+	return resolveChildren(ep, ep.children, path)
+}
+
+func (ep *RestGroupEndpoint) Methods() []string {
+	return []string{ http.MethodGet, http.MethodPut }
+}
+
+func (ep *RestGroupEndpoint) Serve(method string, query url.Values, body []byte) ([]byte, int) {
+	if method == http.MethodGet {
+		report := groupReport(ep.state, ep.state.Groups[ep.name])
+		report["children"] = sortedKeys(ep.children)
+		return jsonResponse(report, http.StatusOK)
+	}
+
+	args, err := parseArguments(body)
+	if err != nil {
+		return malformedBody(err)
+	}
+	if args.Position == nil && args.Angle == nil {
+		return argumentError("position", PositionMin, PositionMax)
+	}
+	if args.Position != nil && !ValidPosition(*args.Position) {
+		return argumentError("position", PositionMin, PositionMax)
+	}
+	if args.Angle != nil && !ValidAngle(*args.Angle) {
+		return argumentError("angle", AngleMin, AngleMax)
+	}
+	commands := make([]Command, 0, 2)
+	if args.Position != nil {
+		commands = append(commands, Command{
+			Action: ActionMove,
+			Position: *args.Position,
+		})
+	}
+	if args.Angle != nil {
+		commands = append(commands, Command{
+			Action: ActionFlip,
+			Angle: *args.Angle,
+		})
+	}
+	result, err := ep.state.DispatchGroup(ep.name, commands...)
+	return groupResponse(ep.name, result, err, http.StatusAccepted)
+}
+
+// RestGroupCommandEndpoint carries out a single action on all shutters of a
+// group with POST.
+type RestGroupCommandEndpoint struct {
+	state *ShutterState
+	name string
+	action string
+}
+
+func NewRestGroupCommandEndpoint(state *ShutterState, name string, action string) *RestGroupCommandEndpoint {
+	return &RestGroupCommandEndpoint{
+		state: state,
+		name: name,
+		action: action,
+	}
+}
+
+func (ep *RestGroupCommandEndpoint) Resolve(path []string) RestEndpoint {
+	return resolveLeaf(ep, path)
+}
+
+func (ep *RestGroupCommandEndpoint) Methods() []string {
+	return []string{ http.MethodPost }
+}
+
+func (ep *RestGroupCommandEndpoint) Serve(method string, query url.Values, body []byte) ([]byte, int) {
+	args, err := parseArguments(body)
+	if err != nil {
+		return malformedBody(err)
+	}
+	command, err := args.Command(ep.action)
+	if err == nil && ep.action == ActionMove && !ValidPosition(command.Position) {
+		err = ErrPositionRange
+	}
+	if err == nil && ep.action == ActionFlip && !ValidAngle(command.Angle) {
+		err = ErrAngleRange
+	}
+	if err != nil {
+		// reject invalid arguments before any shutter starts moving
+		return jobResponse(nil, err)
+	}
+	result, err := ep.state.DispatchGroup(ep.name, command)
+	if ep.action == ActionStop {
+		return groupResponse(ep.name, result, err, http.StatusOK)
+	}
+	return groupResponse(ep.name, result, err, http.StatusAccepted)
+}
+
+// groupResponse generates the reply to a group command, with the jobs and
+// errors of each shutter. If any shutter failed, the whole request is
+// reported as failed, even though the other shutters carry out the command.
+func groupResponse(name string, result *GroupResult, err error, status int) ([]byte, int) {
+	if err != nil {
+		log.Print(err)
+		return notFound()
+	}
+	jobs := make(map[string][]uint64)
+	for shutter, queued := range result.Jobs {
+		jobs[shutter] = make([]uint64, 0, len(queued))
+		for _, job := range queued {
+			jobs[shutter] = append(jobs[shutter], job.ID)
+		}
+	}
+	report := map[string]interface{}{
+		"name": name,
+		"jobs": jobs,
+	}
+	if len(result.Errors) > 0 {
+		errs := make(map[string]string)
+		report["error"] = ErrBusy
+		status = http.StatusServiceUnavailable
+		for shutter, err := range result.Errors {
+			errs[shutter] = err.Error()
+			if err != ErrQueueFull && err != ErrShutdown {
+				report["error"] = ErrInternal
+				status = http.StatusInternalServerError
+			}
+		}
+		report["errors"] = errs
+	}
+	return jsonResponse(report, status)
+}
+
+// RestScenesEndpoint lists all scenes. Its children are created on demand,
+// so that new scenes can be added with PUT.
+type RestScenesEndpoint struct {
+	state *ShutterState
+}
+
+func NewRestScenesEndpoint(state *ShutterState) *RestScenesEndpoint {
+	return &RestScenesEndpoint{
+		state: state,
+	}
+}
+
+func (ep *RestScenesEndpoint) Resolve(path []string) RestEndpoint {
+	if isSelf(path) {
+		return ep
+	}
+	if ValidSceneName(path[0]) != nil {
+		return nil
+	}
+	return NewRestSceneEndpoint(ep.state, path[0]).Resolve(path[1:])
+}
+
+func (ep *RestScenesEndpoint) Methods() []string {
+	return []string{ http.MethodGet }
+}
+
+func (ep *RestScenesEndpoint) Serve(method string, query url.Values, body []byte) ([]byte, int) {
+	scenes := make([]interface{}, 0)
+	for _, name := range ep.state.Scenes.Names() {
+		if scene, ok := ep.state.Scenes.Get(name); ok {
+			scenes = append(scenes, map[string]interface{}{
+				"name": name,
+				"shutters": scene.Report(),
+			})
+		}
+	}
+	return jsonResponse(map[string]interface{}{
+		"scenes": scenes,
+	}, http.StatusOK)
+}
+
+// RestSceneEndpoint shows a scene with GET, creates or replaces it with PUT
+// and removes it with DELETE.
+type RestSceneEndpoint struct {
+	state *ShutterState
+	name string
+	children map[string]RestEndpoint
+}
+
+func NewRestSceneEndpoint(state *ShutterState, name string) *RestSceneEndpoint {
+	ep := &RestSceneEndpoint{
+		state: state,
+		name: name,
+		children: make(map[string]RestEndpoint),
+	}
+	ep.children["run"] = NewRestRunSceneEndpoint(state, name)
+	return ep
+}
+
+func (ep *RestSceneEndpoint) Resolve(path []string) RestEndpoint {
+	if !isSelf(path) {
+		// only existing scenes can be run
+		if _, ok := ep.state.Scenes.Get(ep.name); !ok {
+			return nil
+		}
+	}
+	return resolveChildren(ep, ep.children, path)
+}
+
+func (ep *RestSceneEndpoint) Methods() []string {
+	return []string{ http.MethodGet, http.MethodPut, http.MethodDelete }
+}
+
+func (ep *RestSceneEndpoint) Serve(method string, query url.Values, body []byte) ([]byte, int) {
+	switch method {
+		case http.MethodPut:
+			scene := make(Scene)
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&scene); err != nil {
+				return malformedBody(err)
+			}
+			if err := ep.state.Scenes.Validate(ep.name, scene); err != nil {
+				return malformedBody(err)
+			}
+			created, err := ep.state.Scenes.Put(ep.name, scene)
+			if err != nil {
+				log.Print(err)
+				return jsonResponse(map[string]interface{}{
+					"error": ErrInternal,
+				}, http.StatusInternalServerError)
+			}
+			status := http.StatusOK
+			if created {
+				status = http.StatusCreated
+			}
+			return jsonResponse(map[string]interface{}{
+				"name": ep.name,
+				"shutters": scene.Report(),
+			}, status)
+		case http.MethodDelete:
+			err := ep.state.Scenes.Delete(ep.name)
+			if err == ErrUnknownScene {
+				return notFound()
+			} else if err != nil {
+				log.Print(err)
+				return jsonResponse(map[string]interface{}{
+					"error": ErrInternal,
+				}, http.StatusInternalServerError)
+			}
+			return jsonResponse(map[string]interface{}{
+				"name": ep.name,
+			}, http.StatusOK)
+	}
+	scene, ok := ep.state.Scenes.Get(ep.name)
+	if !ok {
+		return notFound()
+	}
+	return jsonResponse(map[string]interface{}{
+		"name": ep.name,
+		"shutters": scene.Report(),
+		"children": sortedKeys(ep.children),
+	}, http.StatusOK)
+}
+
+// RestRunSceneEndpoint moves all shutters of a scene with POST.
+type RestRunSceneEndpoint struct {
+	state *ShutterState
+	name string
+}
+
+func NewRestRunSceneEndpoint(state *ShutterState, name string) *RestRunSceneEndpoint {
+	return &RestRunSceneEndpoint{
+		state: state,
+		name: name,
+	}
+}
+
+func (ep *RestRunSceneEndpoint) Resolve(path []string) RestEndpoint {
+	return resolveLeaf(ep, path)
+}
+
+func (ep *RestRunSceneEndpoint) Methods() []string {
+	return []string{ http.MethodPost }
+}
+
+func (ep *RestRunSceneEndpoint) Serve(method string, query url.Values, body []byte) ([]byte, int) {
+	result, err := ep.state.RunScene(ep.name, SourceManual)
+	return groupResponse(ep.name, result, err, http.StatusAccepted)
+}
+
+// RestSchedulesEndpoint lists all schedule rules with their next run. Like
+// scenes, its children are created on demand.
+type RestSchedulesEndpoint struct {
+	state *ShutterState
+}
+
+func NewRestSchedulesEndpoint(state *ShutterState) *RestSchedulesEndpoint {
+	return &RestSchedulesEndpoint{
+		state: state,
+	}
+}
+
+func (ep *RestSchedulesEndpoint) Resolve(path []string) RestEndpoint {
+	if isSelf(path) {
+		return ep
+	}
+	if ValidScheduleName(path[0]) != nil || !isSelf(path[1:]) {
+		return nil
+	}
+	return NewRestScheduleEndpoint(ep.state, path[0])
+}
+
+func (ep *RestSchedulesEndpoint) Methods() []string {
+	return []string{ http.MethodGet }
+}
+
+func (ep *RestSchedulesEndpoint) Serve(method string, query url.Values, body []byte) ([]byte, int) {
+	schedules := make([]interface{}, 0)
+	for _, name := range ep.state.Schedules.Names() {
+		if rule, next, ok := ep.state.Schedules.Get(name); ok {
+			schedules = append(schedules, scheduleReport(name, &rule, next))
+		}
+	}
+	return jsonResponse(map[string]interface{}{
+		"schedules": schedules,
+	}, http.StatusOK)
+}
+
+// scheduleReport returns a serialisable form of a rule with its next run.
+func scheduleReport(name string, rule *ScheduleRule, next time.Time) map[string]interface{} {
+	report := rule.Report()
+	report["name"] = name
+	if next.IsZero() {
+		report["next"] = nil
+	} else {
+		report["next"] = next
+	}
+	return report
+}
+
+// RestScheduleEndpoint shows a rule with GET, including a preview of its
+// upcoming runs, creates or replaces it with PUT and removes it with DELETE.
+// The number of previewed runs can be set with the count parameter.
+type RestScheduleEndpoint struct {
+	state *ShutterState
+	name string
+}
+
+func NewRestScheduleEndpoint(state *ShutterState, name string) *RestScheduleEndpoint {
+	return &RestScheduleEndpoint{
+		state: state,
+		name: name,
+	}
+}
+
+func (ep *RestScheduleEndpoint) Resolve(path []string) RestEndpoint {
+	return resolveLeaf(ep, path)
+}
+
+func (ep *RestScheduleEndpoint) Methods() []string {
+	return []string{ http.MethodGet, http.MethodPut, http.MethodDelete }
+}
+
+func (ep *RestScheduleEndpoint) Serve(method string, query url.Values, body []byte) ([]byte, int) {
+	switch method {
+		case http.MethodPut:
+			rule := ScheduleRule{}
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&rule); err != nil {
+				return malformedBody(err)
+			}
+			if err := ep.state.Schedules.Validate(ep.name, &rule); err != nil {
+				return malformedBody(err)
+			}
+			created, err := ep.state.Schedules.Put(ep.name, rule)
+			if err != nil {
+				log.Print(err)
+				return jsonResponse(map[string]interface{}{
+					"error": ErrInternal,
+				}, http.StatusInternalServerError)
+			}
+			status := http.StatusOK
+			if created {
+				status = http.StatusCreated
+			}
+			_, next, _ := ep.state.Schedules.Get(ep.name)
+			return jsonResponse(scheduleReport(ep.name, &rule, next), status)
+		case http.MethodDelete:
+			err := ep.state.Schedules.Delete(ep.name)
+			if err == ErrUnknownSchedule {
+				return notFound()
+			} else if err != nil {
+				log.Print(err)
+				return jsonResponse(map[string]interface{}{
+					"error": ErrInternal,
+				}, http.StatusInternalServerError)
+			}
+			return jsonResponse(map[string]interface{}{
+				"name": ep.name,
+			}, http.StatusOK)
+	}
+	rule, next, ok := ep.state.Schedules.Get(ep.name)
+	if !ok {
+		return notFound()
+	}
+	count := SchedulePreviewCount
+	if value := query.Get("count"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 || parsed > 100 {
+			return argumentError("count", 0, 100)
+		}
+		count = parsed
+	}
+	preview, err := ep.state.Schedules.Preview(ep.name, count)
+	if err != nil {
+		return notFound()
+	}
+	report := scheduleReport(ep.name, &rule, next)
+	report["preview"] = preview
+	return jsonResponse(report, http.StatusOK)
+}
+
+// RestSunEndpoint reports the solar events of the current day, or of the day
+// given with the date parameter (YYYY-MM-DD).
+type RestSunEndpoint struct {
+	state *ShutterState
+}
+
+func NewRestSunEndpoint(state *ShutterState) *RestSunEndpoint {
+	return &RestSunEndpoint{
+		state: state,
+	}
+}
+
+func (ep *RestSunEndpoint) Resolve(path []string) RestEndpoint {
+	return resolveLeaf(ep, path)
+}
+
+func (ep *RestSunEndpoint) Methods() []string {
+	return []string{ http.MethodGet }
+}
+
+func (ep *RestSunEndpoint) Serve(method string, query url.Values, body []byte) ([]byte, int) {
+	day := ep.state.Clock.Now()
+	if value := query.Get("date"); value != "" {
+		date, err := time.ParseInLocation("2006-01-02", value, day.Location())
+		if err != nil {
+			return malformedBody(err)
+		}
+		day = date
+	}
+	times := SunTimes(day, ep.state.Coordinates)
+	report := map[string]interface{}{
+		"date": day.Format("2006-01-02"),
+		"latitude": ep.state.Coordinates.Latitude,
+		"longitude": ep.state.Coordinates.Longitude,
+	}
+	for _, event := range SunEventNames {
+		if t, ok := times[event]; ok {
+			report[event] = t
+		} else {
+			report[event] = nil
+		}
+	}
+	return jsonResponse(report, http.StatusOK)
+}
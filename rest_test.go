@@ -0,0 +1,241 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer serves the API of simulated shutters, including the legacy
+// API.
+func newTestServer(t *testing.T, names ...string) (*ShutterState, *FakeClock, *httptest.Server) {
+	state, clock := newTestState(t, names...)
+	server := httptest.NewServer(NewShutterServer(state, true))
+	t.Cleanup(server.Close)
+	return state, clock, server
+}
+
+// call sends a request and decodes the JSON reply.
+func call(t *testing.T, server *httptest.Server, method string, path string, body string) (int, map[string]interface{}) {
+	t.Helper()
+	request, err := http.NewRequest(method, server.URL + path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := map[string]interface{}{}
+	if err := json.Unmarshal(data, &reply); err != nil {
+		t.Fatalf("invalid reply %s: %s", data, err)
+	}
+	return response.StatusCode, reply
+}
+
+// replyJob looks up the job with the ID of a reply.
+func replyJob(t *testing.T, state *ShutterState, name string, id interface{}) *Job {
+	t.Helper()
+	number, ok := id.(float64)
+	if !ok {
+		t.Fatalf("invalid job ID %v", id)
+	}
+	job := state.Shutters[name].Job(uint64(number))
+	if job == nil {
+		t.Fatalf("job %v of shutter %s not found", id, name)
+	}
+	return job
+}
+
+func TestRestPutShutter(t *testing.T) {
+	state, clock, server := newTestServer(t, "1")
+	mark := len(SimTimeline())
+
+	code, reply := call(t, server, http.MethodPut, "/api/v1/shutters/1", `{"position": 40, "angle": 0.5}`)
+	if code != http.StatusAccepted {
+		t.Fatalf("status is %d, expected %d: %v", code, http.StatusAccepted, reply)
+	}
+	jobs, ok := reply["jobs"].([]interface{})
+	if !ok || len(jobs) != 2 {
+		t.Fatalf("reply has jobs %v, expected two", reply["jobs"])
+	}
+	energised(t, "1d")
+	clock.Advance(4 * time.Second)
+	reversing(t, clock, "1d")
+	clock.Advance(500 * time.Millisecond)
+	energised(t, "1u")
+	clock.Advance(time.Second)
+	reversing(t, clock, "1u")
+	clock.Advance(500 * time.Millisecond)
+	energised(t, "1d")
+	clock.Advance(500 * time.Millisecond)
+	finished(t, replyJob(t, state, "1", jobs[1]))
+
+	checkTimeline(t, mark, []timelineEntry{
+		{ 0, "1d", true },
+		{ 4 * time.Second, "1d", false },
+		{ 4500 * time.Millisecond, "1u", true },
+		{ 5500 * time.Millisecond, "1u", false },
+		{ 6 * time.Second, "1d", true },
+		{ 6500 * time.Millisecond, "1d", false },
+	})
+
+	code, reply = call(t, server, http.MethodGet, "/api/v1/shutters/1", "")
+	if code != http.StatusOK || reply["position"] != 40.0 || reply["angle"] != 0.5 {
+		t.Errorf("state is %d %v, expected position 40 and angle 0.5", code, reply)
+	}
+}
+
+func TestRestPutShutterPartialFailure(t *testing.T) {
+	state, _, server := newTestServer(t, "1")
+	position := float32(50)
+	for i := 0; i < ShutterQueueSize; i++ {
+		if _, err := state.Dispatch("1", Command{ Action: ActionMove, Position: position }); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			// the first move is taken off the queue
+			energised(t, "1d")
+		}
+		position = 100 - position
+	}
+
+	// the move takes the last place in the queue, the flip fails
+	code, reply := call(t, server, http.MethodPut, "/api/v1/shutters/1", `{"position": 40, "angle": 0.5}`)
+	if code != http.StatusAccepted {
+		t.Fatalf("status is %d, expected %d: %v", code, http.StatusAccepted, reply)
+	}
+	if reply["error"] != ErrBusy {
+		t.Errorf("error is %v, expected %s", reply["error"], ErrBusy)
+	}
+	jobs, ok := reply["jobs"].([]interface{})
+	if !ok || len(jobs) != 1 {
+		t.Fatalf("reply has jobs %v, expected one", reply["jobs"])
+	}
+	if job := replyJob(t, state, "1", jobs[0]); job.Command.Action != ActionMove || job.Command.Position != 40 {
+		t.Errorf("job is %v, expected the move", job.Command)
+	}
+}
+
+func TestRestStop(t *testing.T) {
+	_, clock, server := newTestServer(t, "1")
+	mark := len(SimTimeline())
+
+	code, reply := call(t, server, http.MethodPost, "/api/v1/shutters/1/move", `{"position": 100}`)
+	if code != http.StatusAccepted {
+		t.Fatalf("status is %d, expected %d: %v", code, http.StatusAccepted, reply)
+	}
+	energised(t, "1d")
+	clock.Advance(2500 * time.Millisecond)
+	code, reply = call(t, server, http.MethodPost, "/api/v1/shutters/1/stop", "")
+	if code != http.StatusOK {
+		t.Fatalf("status is %d, expected %d: %v", code, http.StatusOK, reply)
+	}
+	if reply["position"] != 25.0 {
+		t.Errorf("stopped at %v, expected 25", reply["position"])
+	}
+	checkTimeline(t, mark, []timelineEntry{
+		{ 0, "1d", true },
+		{ 2500 * time.Millisecond, "1d", false },
+	})
+}
+
+func TestRestRejectsInvalidCommands(t *testing.T) {
+	_, _, server := newTestServer(t, "1")
+	mark := len(SimTimeline())
+
+	tests := []struct {
+		method string
+		path string
+		body string
+		code int
+		err string
+	}{
+		{ http.MethodPost, "/api/v1/shutters/1/move", `{"position": 150}`, http.StatusBadRequest, ErrInvalidArgument },
+		{ http.MethodPost, "/api/v1/shutters/1/move", `{}`, http.StatusBadRequest, ErrInvalidArgument },
+		{ http.MethodPost, "/api/v1/shutters/1/flip", `{"angle": -1}`, http.StatusBadRequest, ErrInvalidArgument },
+		{ http.MethodPut, "/api/v1/shutters/1", `{"position": 20, "angle": 3}`, http.StatusBadRequest, ErrInvalidArgument },
+		{ http.MethodPost, "/api/v1/shutters/1/move", `{"position": "far"}`, http.StatusBadRequest, "" },
+		{ http.MethodGet, "/api/v1/shutters/1/move", ``, http.StatusMethodNotAllowed, ErrMethodNotAllowed },
+		{ http.MethodPost, "/api/v1/shutters/2/move", `{"position": 10}`, http.StatusNotFound, "" },
+		{ http.MethodGet, "/1/move?position=101", ``, http.StatusBadRequest, ErrInvalidArgument },
+	}
+	for _, test := range tests {
+		code, reply := call(t, server, test.method, test.path, test.body)
+		if code != test.code || (test.err != "" && reply["error"] != test.err) {
+			t.Errorf("%s %s %s: reply is %d %v, expected %d %s", test.method, test.path, test.body, code, reply, test.code, test.err)
+		}
+	}
+	// nothing may have moved
+	checkTimeline(t, mark, []timelineEntry{})
+}
+
+func TestLegacyMove(t *testing.T) {
+	state, clock, server := newTestServer(t, "1")
+	mark := len(SimTimeline())
+
+	code, reply := call(t, server, http.MethodGet, "/1/move?position=30", "")
+	if code != http.StatusAccepted {
+		t.Fatalf("status is %d, expected %d: %v", code, http.StatusAccepted, reply)
+	}
+	energised(t, "1d")
+	clock.Advance(3 * time.Second)
+	finished(t, replyJob(t, state, "1", reply["job"]))
+	checkTimeline(t, mark, []timelineEntry{
+		{ 0, "1d", true },
+		{ 3 * time.Second, "1d", false },
+	})
+}
+
+func TestLegacyDisablesShade(t *testing.T) {
+	state, _, server := newTestServer(t, "1")
+	shutter := state.Shutters["1"]
+	shutter.TiltMode = TiltModeBlock
+	for _, path := range []string{ "/1/move?position=0", "/1/flip?angle=0", "/1/stop" } {
+		shutter.SetShade(true)
+		if !shutter.Shade() {
+			t.Fatal("shade automation can't be enabled")
+		}
+		code, reply := call(t, server, http.MethodGet, path, "")
+		if code != http.StatusAccepted && code != http.StatusOK {
+			t.Fatalf("%s: status is %d: %v", path, code, reply)
+		}
+		if shutter.Shade() {
+			t.Errorf("%s did not disable the shade automation", path)
+		}
+	}
+}
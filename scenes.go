@@ -0,0 +1,258 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrUnknownScene = errors.New("unknown scene")
+
+// SceneTarget is the position and slat angle that a scene moves a shutter
+// to. Either may be absent, to leave it unchanged.
+type SceneTarget struct {
+	Position *float32
+	Angle *float32
+}
+
+// Scene is a preset of targets, by shutter name.
+type Scene map[string]SceneTarget
+
+// ValidSceneName checks if a name can be used for a scene.
+func ValidSceneName(name string) error {
+	if name == "" {
+		return errors.New("scene name cannot be empty")
+	}
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("scene name %s cannot contain /", name)
+	}
+	return nil
+}
+
+// Validate checks that all targets of a scene are in range and refer to
+// existing shutters.
+func (scene Scene) Validate(shutters map[string]bool) error {
+	for name, target := range scene {
+		if !shutters[name] {
+			return fmt.Errorf("unknown shutter %s", name)
+		}
+		if target.Position == nil && target.Angle == nil {
+			return fmt.Errorf("shutter %s needs a position or angle", name)
+		}
+		if target.Position != nil && !ValidPosition(*target.Position) {
+			return fmt.Errorf("position of shutter %s: %s", name, ErrPositionRange)
+		}
+		if target.Angle != nil && !ValidAngle(*target.Angle) {
+			return fmt.Errorf("angle of shutter %s: %s", name, ErrAngleRange)
+		}
+	}
+	return nil
+}
+
+// Commands returns the commands that bring each shutter to its target.
+// The shutter is moved first, then the slats are turned.
+func (scene Scene) Commands(source string) map[string][]Command {
+	targets := make(map[string][]Command)
+	for name, target := range scene {
+		commands := make([]Command, 0, 2)
+		if target.Position != nil {
+			commands = append(commands, Command{
+				Action: ActionMove,
+				Position: *target.Position,
+				Source: source,
+			})
+		}
+		if target.Angle != nil {
+			commands = append(commands, Command{
+				Action: ActionFlip,
+				Angle: *target.Angle,
+				Source: source,
+			})
+		}
+		targets[name] = commands
+	}
+	return targets
+}
+
+// Report returns a serialisable form of the scene.
+func (scene Scene) Report() map[string]interface{} {
+	report := make(map[string]interface{})
+	for name, target := range scene {
+		entry := make(map[string]interface{})
+		if target.Position != nil {
+			entry["position"] = *target.Position
+		}
+		if target.Angle != nil {
+			entry["angle"] = *target.Angle
+		}
+		report[name] = entry
+	}
+	return report
+}
+
+// SceneStore holds all scenes, and saves them to a file when they are
+// changed, if a path is set.
+// The configured scenes are only the initial set: once the file exists, it
+// takes precedence.
+type SceneStore struct {
+	path string
+	shutters map[string]bool
+	lock sync.Mutex
+	Scenes map[string]Scene
+}
+
+// NewSceneStore loads the scenes from a file, or uses the configured ones if
+// the file does not exist or no path is set.
+func NewSceneStore(path string, defaults map[string]Scene, shutters map[string]bool) (*SceneStore, error) {
+	store := &SceneStore{
+		path: path,
+		shutters: shutters,
+		Scenes: make(map[string]Scene),
+	}
+	for name, scene := range defaults {
+		store.Scenes[name] = scene
+	}
+	if path == "" {
+		return store, nil
+	}
+	input, err := os.Open(path)
+	if os.IsNotExist(err) {
+		log.Printf("Scene file %s does not exist yet\n", path)
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	store.Scenes = nil
+	decoder := json.NewDecoder(input)
+	if err := decoder.Decode(store); err != nil {
+		return nil, err
+	}
+	if store.Scenes == nil {
+		store.Scenes = make(map[string]Scene)
+	}
+	// shutters may have been removed from the configuration since
+	for name, scene := range store.Scenes {
+		if err := scene.Validate(shutters); err != nil {
+			log.Printf("Ignoring saved scene %s: %s\n", name, err)
+			delete(store.Scenes, name)
+		}
+	}
+	return store, nil
+}
+
+// Names returns the names of all scenes, sorted.
+func (store *SceneStore) Names() []string {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	names := make([]string, 0, len(store.Scenes))
+	for name := range store.Scenes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns a scene, if it exists.
+func (store *SceneStore) Get(name string) (Scene, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	scene, ok := store.Scenes[name]
+	return scene, ok
+}
+
+// Validate checks if a scene refers to known shutters and valid targets.
+func (store *SceneStore) Validate(name string, scene Scene) error {
+	if err := ValidSceneName(name); err != nil {
+		return err
+	}
+	return scene.Validate(store.shutters)
+}
+
+// Put creates or replaces a scene and saves the file.
+// Returns true if the scene was created.
+func (store *SceneStore) Put(name string, scene Scene) (bool, error) {
+	if err := store.Validate(name, scene); err != nil {
+		return false, err
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	previous, exists := store.Scenes[name]
+	store.Scenes[name] = scene
+	if err := store.write(); err != nil {
+		// the scenes must not change unless they are saved
+		if exists {
+			store.Scenes[name] = previous
+		} else {
+			delete(store.Scenes, name)
+		}
+		return false, err
+	}
+	return !exists, nil
+}
+
+// Delete removes a scene and saves the file.
+func (store *SceneStore) Delete(name string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	previous, ok := store.Scenes[name]
+	if !ok {
+		return ErrUnknownScene
+	}
+	delete(store.Scenes, name)
+	if err := store.write(); err != nil {
+		store.Scenes[name] = previous
+		return err
+	}
+	return nil
+}
+
+// write saves all scenes, if there is a file.
+// The caller must hold the lock.
+func (store *SceneStore) write() error {
+	if store.path == "" {
+		return nil
+	}
+	return writeJSONFile(store.path, store)
+}
+
+// RunScene moves all shutters of a scene to their targets in parallel.
+// The source is passed on to the commands.
+func (state *ShutterState) RunScene(name string, source string) (*GroupResult, error) {
+	scene, ok := state.Scenes.Get(name)
+	if !ok {
+		return nil, ErrUnknownScene
+	}
+	log.Printf("Running scene %s\n", name)
+	return state.dispatchAll("scene " + name, scene.Commands(source)), nil
+}
@@ -0,0 +1,73 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSceneStoreWriteFailure(t *testing.T) {
+	directory := filepath.Join(t.TempDir(), "scenes")
+	if err := os.Mkdir(directory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	closed := float32(100)
+	open := float32(0)
+	store, err := NewSceneStore(filepath.Join(directory, "scenes.json"), map[string]Scene{
+		"night": Scene{ "1": SceneTarget{ Position: &closed } },
+	}, map[string]bool{ "1": true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put("morning", Scene{ "1": SceneTarget{ Position: &open } }); err != nil {
+		t.Fatal(err)
+	}
+
+	// without the directory, the file can't be written
+	if err := os.RemoveAll(directory); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put("day", Scene{ "1": SceneTarget{ Position: &open } }); err == nil {
+		t.Fatal("creating a scene succeeded without saving it")
+	}
+	if _, ok := store.Get("day"); ok {
+		t.Error("scene was created although it wasn't saved")
+	}
+	if _, err := store.Put("night", Scene{ "1": SceneTarget{ Position: &open } }); err == nil {
+		t.Fatal("replacing a scene succeeded without saving it")
+	}
+	if scene, _ := store.Get("night"); *scene["1"].Position != closed {
+		t.Error("scene was replaced although it wasn't saved")
+	}
+	if err := store.Delete("morning"); err == nil {
+		t.Fatal("deleting a scene succeeded without saving it")
+	}
+	if _, ok := store.Get("morning"); !ok {
+		t.Error("scene was deleted although it wasn't saved")
+	}
+}
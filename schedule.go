@@ -0,0 +1,584 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SchedulePreviewCount is the default number of upcoming runs that are
+// shown for a rule.
+const SchedulePreviewCount = 5
+
+// SchedulerMaxWait limits the time that the scheduler sleeps, so that it
+// notices when the system clock is set. This happens on boards without a
+// real-time clock, once the time is synchronised after booting.
+const SchedulerMaxWait = time.Minute
+
+// ScheduleGraceTime is how late a rule may still run. Runs that were missed
+// by more than this, for example because the system clock jumped forward,
+// are skipped.
+const ScheduleGraceTime = 5 * time.Minute
+
+var ErrUnknownSchedule = errors.New("unknown schedule")
+
+// Trigger calculates when a rule runs.
+type Trigger interface {
+	// Next returns the first run after a point in time, in the same time
+	// zone, or the zero time if there is none.
+	Next(after time.Time) time.Time
+}
+
+// ScheduleRule runs a command at certain times.
+// The times are given by a cron expression, a time of day or a solar event,
+// the latter two on selected days of the week. The target is exactly one of
+// a shutter, a group or a scene.
+type ScheduleRule struct {
+	// Cron is a cron expression, see CronSchedule
+	Cron string
+	// Days are the weekdays on which the rule runs at Time or Sun, every day
+	// if empty
+	Days []string
+	// Time is the local time of day, as HH:MM
+	Time string
+	// Sun is a solar event, such as sunrise or civil_dusk
+	Sun string
+	// Offset shifts the solar event, in minutes
+	Offset int
+	// Earliest and Latest limit the time of a solar event, as HH:MM
+	Earliest string
+	Latest string
+	Shutter string
+	Group string
+	Scene string
+	// Action, Position and Angle form the command for a shutter or group
+	Action string
+	Position *float32
+	Angle *float32
+	// Disabled rules are kept, but never run
+	Disabled bool
+}
+
+// ValidScheduleName checks if a name can be used for a schedule rule.
+func ValidScheduleName(name string) error {
+	if name == "" {
+		return errors.New("schedule name cannot be empty")
+	}
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("schedule name %s cannot contain /", name)
+	}
+	return nil
+}
+
+// parseTimeOfDay converts HH:MM to the time since midnight.
+// An empty string is returned as a negative duration.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	if value == "" {
+		return -1, nil
+	}
+	at, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s, must be HH:MM", value)
+	}
+	return time.Duration(at.Hour()) * time.Hour + time.Duration(at.Minute()) * time.Minute, nil
+}
+
+// Schedule returns the times at which the rule runs.
+// Rules with solar events need the coordinates of the shutters.
+func (rule *ScheduleRule) Schedule(coordinates *Coordinates) (Trigger, error) {
+	kinds := 0
+	for _, kind := range []string{ rule.Cron, rule.Time, rule.Sun } {
+		if kind != "" {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return nil, errors.New("exactly one of cron, time or sun is required")
+	}
+	if rule.Sun == "" && (rule.Offset != 0 || rule.Earliest != "" || rule.Latest != "") {
+		return nil, errors.New("offset, earliest and latest only apply to sun")
+	}
+	if rule.Cron != "" {
+		if len(rule.Days) > 0 {
+			return nil, errors.New("cron cannot be combined with days")
+		}
+		return ParseCron(rule.Cron)
+	}
+	days := "*"
+	if len(rule.Days) > 0 {
+		days = strings.Join(rule.Days, ",")
+	}
+	if rule.Time != "" {
+		at, err := parseTimeOfDay(rule.Time)
+		if err != nil {
+			return nil, err
+		}
+		return ParseCron(fmt.Sprintf("%d %d * * %s", at / time.Minute % 60, at / time.Hour, days))
+	}
+	if coordinates == nil {
+		return nil, errors.New("sun needs the latitude and longitude in the configuration")
+	}
+	earliest, err := parseTimeOfDay(rule.Earliest)
+	if err != nil {
+		return nil, err
+	}
+	latest, err := parseTimeOfDay(rule.Latest)
+	if err != nil {
+		return nil, err
+	}
+	return NewSunSchedule(rule.Sun, time.Duration(rule.Offset) * time.Minute, earliest, latest, days, coordinates)
+}
+
+// Command returns the command that the rule carries out on a shutter or
+// group.
+func (rule *ScheduleRule) Command() (Command, error) {
+	args := CommandArguments{
+		Position: rule.Position,
+		Angle: rule.Angle,
+	}
+	command, err := args.Command(rule.Action)
+	if err != nil {
+		return command, err
+	}
+	switch command.Action {
+		case ActionMove:
+			if !ValidPosition(command.Position) {
+				return command, ErrPositionRange
+			}
+		case ActionFlip:
+			if !ValidAngle(command.Angle) {
+				return command, ErrAngleRange
+			}
+		case ActionStop:
+		default:
+			return command, ErrUnknownAction
+	}
+	return command, nil
+}
+
+// Validate checks the times and the target of the rule.
+// Scenes are only checked by name, as they can change at runtime.
+func (rule *ScheduleRule) Validate(shutters map[string]bool, groups map[string]bool, coordinates *Coordinates) error {
+	if _, err := rule.Schedule(coordinates); err != nil {
+		return err
+	}
+	targets := 0
+	for _, target := range []string{ rule.Shutter, rule.Group, rule.Scene } {
+		if target != "" {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return errors.New("exactly one of shutter, group or scene is required")
+	}
+	switch {
+		case rule.Scene != "":
+			if rule.Action != "" || rule.Position != nil || rule.Angle != nil {
+				return errors.New("scenes take no action")
+			}
+			return ValidSceneName(rule.Scene)
+		case rule.Group != "" && !groups[rule.Group]:
+			return fmt.Errorf("unknown group %s", rule.Group)
+		case rule.Shutter != "" && !shutters[rule.Shutter]:
+			return fmt.Errorf("unknown shutter %s", rule.Shutter)
+	}
+	_, err := rule.Command()
+	return err
+}
+
+// Report returns a serialisable form of the rule.
+func (rule *ScheduleRule) Report() map[string]interface{} {
+	report := map[string]interface{}{
+		"disabled": rule.Disabled,
+	}
+	switch {
+		case rule.Cron != "":
+			report["cron"] = rule.Cron
+		case rule.Sun != "":
+			report["sun"] = rule.Sun
+			report["offset"] = rule.Offset
+			if rule.Earliest != "" {
+				report["earliest"] = rule.Earliest
+			}
+			if rule.Latest != "" {
+				report["latest"] = rule.Latest
+			}
+		default:
+			report["time"] = rule.Time
+	}
+	if len(rule.Days) > 0 {
+		report["days"] = rule.Days
+	}
+	switch {
+		case rule.Scene != "":
+			report["scene"] = rule.Scene
+		case rule.Group != "":
+			report["group"] = rule.Group
+		default:
+			report["shutter"] = rule.Shutter
+	}
+	if rule.Action != "" {
+		report["action"] = rule.Action
+	}
+	if rule.Position != nil {
+		report["position"] = *rule.Position
+	}
+	if rule.Angle != nil {
+		report["angle"] = *rule.Angle
+	}
+	return report
+}
+
+// Scheduler runs the schedule rules at their times, and saves them to a
+// file when they are changed, if a path is set.
+// Like scenes, the configured rules are only the initial set: once the file
+// exists, it takes precedence.
+type Scheduler struct {
+	state *ShutterState
+	clock Clock
+	path string
+	shutters map[string]bool
+	groups map[string]bool
+	coordinates *Coordinates
+	lock sync.Mutex
+	Rules map[string]*ScheduleRule
+	// next are the upcoming run times of all enabled rules
+	next map[string]time.Time
+	// last is the time of the last check, to notice when the clock is set back
+	last time.Time
+	started bool
+	closed bool
+	changed chan struct{}
+	closing chan struct{}
+	finished chan struct{}
+}
+
+// NewScheduler loads the rules from a file, or uses the configured ones if
+// the file does not exist or no path is set.
+func NewScheduler(state *ShutterState, clock Clock, path string, defaults map[string]ScheduleRule) (*Scheduler, error) {
+	scheduler := &Scheduler{
+		state: state,
+		clock: clock,
+		path: path,
+		shutters: make(map[string]bool),
+		groups: make(map[string]bool),
+		coordinates: state.Coordinates,
+		Rules: make(map[string]*ScheduleRule),
+		next: make(map[string]time.Time),
+		changed: make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	for name := range state.Shutters {
+		scheduler.shutters[name] = true
+	}
+	for name := range state.Groups {
+		scheduler.groups[name] = true
+	}
+	for name, rule := range defaults {
+		copied := rule
+		scheduler.Rules[name] = &copied
+	}
+	if path != "" {
+		input, err := os.Open(path)
+		if os.IsNotExist(err) {
+			log.Printf("Schedule file %s does not exist yet\n", path)
+		} else if err != nil {
+			return nil, err
+		} else {
+			defer input.Close()
+			scheduler.Rules = nil
+			decoder := json.NewDecoder(input)
+			if err := decoder.Decode(scheduler); err != nil {
+				return nil, err
+			}
+			if scheduler.Rules == nil {
+				scheduler.Rules = make(map[string]*ScheduleRule)
+			}
+		}
+	}
+	for name, rule := range scheduler.Rules {
+		// shutters or groups may have been removed from the configuration
+		if err := rule.Validate(scheduler.shutters, scheduler.groups, scheduler.coordinates); err != nil {
+			log.Printf("Ignoring schedule %s: %s\n", name, err)
+			delete(scheduler.Rules, name)
+		}
+	}
+	scheduler.last = clock.Now()
+	for name := range scheduler.Rules {
+		scheduler.plan(name, scheduler.last)
+	}
+	return scheduler, nil
+}
+
+// plan calculates the next run of a rule after a point in time.
+// The caller must hold the lock.
+func (scheduler *Scheduler) plan(name string, after time.Time) {
+	delete(scheduler.next, name)
+	rule := scheduler.Rules[name]
+	if rule == nil || rule.Disabled {
+		return
+	}
+	schedule, err := rule.Schedule(scheduler.coordinates)
+	if err != nil {
+		log.Printf("Can't schedule %s: %s\n", name, err)
+		return
+	}
+	if next := schedule.Next(after); !next.IsZero() {
+		scheduler.next[name] = next
+	}
+}
+
+// Run waits for rules to become due and carries them out, until the
+// scheduler is closed.
+func (scheduler *Scheduler) Run() {
+	scheduler.lock.Lock()
+	if scheduler.closed {
+		scheduler.lock.Unlock()
+		return
+	}
+	scheduler.started = true
+	scheduler.lock.Unlock()
+	defer close(scheduler.finished)
+
+	for {
+		wait := scheduler.check()
+		timer := scheduler.clock.NewTimer(wait)
+		select {
+			case <-timer.C():
+			case <-scheduler.changed:
+				timer.Stop()
+			case <-scheduler.closing:
+				timer.Stop()
+				return
+		}
+	}
+}
+
+// check runs all rules that are due, and returns the time until the next
+// one.
+func (scheduler *Scheduler) check() time.Duration {
+	now := scheduler.clock.Now()
+	scheduler.lock.Lock()
+	if now.Before(scheduler.last) {
+		log.Printf("System clock was set back, rescheduling\n")
+		for name := range scheduler.Rules {
+			scheduler.plan(name, now)
+		}
+	}
+	scheduler.last = now
+	due := make(map[string]ScheduleRule)
+	for name, next := range scheduler.next {
+		if next.After(now) {
+			continue
+		}
+		if now.Sub(next) <= ScheduleGraceTime {
+			due[name] = *scheduler.Rules[name]
+		} else {
+			log.Printf("Skipping schedule %s, which was due at %s\n", name, next)
+		}
+		scheduler.plan(name, now)
+	}
+	wait := SchedulerMaxWait
+	for _, next := range scheduler.next {
+		if remaining := next.Sub(now); remaining < wait {
+			wait = remaining
+		}
+	}
+	scheduler.lock.Unlock()
+
+	for name, rule := range due {
+		scheduler.execute(name, &rule)
+	}
+	return wait
+}
+
+// execute carries out the command of a rule.
+func (scheduler *Scheduler) execute(name string, rule *ScheduleRule) {
+	log.Printf("Running schedule %s\n", name)
+	var err error
+	if rule.Scene != "" {
+		_, err = scheduler.state.RunScene(rule.Scene, SourceSchedule)
+	} else {
+		var command Command
+		command, err = rule.Command()
+		command.Source = SourceSchedule
+		if err == nil && rule.Group != "" {
+			_, err = scheduler.state.DispatchGroup(rule.Group, command)
+		} else if err == nil {
+			_, err = scheduler.state.Dispatch(rule.Shutter, command)
+		}
+	}
+	if err != nil {
+		log.Printf("Schedule %s failed: %s\n", name, err)
+	}
+}
+
+// Close stops the scheduler and waits until it has finished.
+func (scheduler *Scheduler) Close() {
+	scheduler.lock.Lock()
+	if scheduler.closed {
+		scheduler.lock.Unlock()
+		return
+	}
+	scheduler.closed = true
+	started := scheduler.started
+	close(scheduler.closing)
+	scheduler.lock.Unlock()
+	if started {
+		<-scheduler.finished
+	}
+}
+
+// wake makes the scheduler recalculate its timer after a change.
+func (scheduler *Scheduler) wake() {
+	select {
+		case scheduler.changed <- struct{}{}:
+		default:
+	}
+}
+
+// Names returns the names of all rules, sorted.
+func (scheduler *Scheduler) Names() []string {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	names := make([]string, 0, len(scheduler.Rules))
+	for name := range scheduler.Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns a rule and its next run time, which is zero if the rule is
+// disabled or never runs.
+func (scheduler *Scheduler) Get(name string) (ScheduleRule, time.Time, bool) {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	rule, ok := scheduler.Rules[name]
+	if !ok {
+		return ScheduleRule{}, time.Time{}, false
+	}
+	return *rule, scheduler.next[name], true
+}
+
+// Preview returns the upcoming run times of a rule.
+func (scheduler *Scheduler) Preview(name string, count int) ([]time.Time, error) {
+	rule, _, ok := scheduler.Get(name)
+	if !ok {
+		return nil, ErrUnknownSchedule
+	}
+	schedule, err := rule.Schedule(scheduler.coordinates)
+	if err != nil {
+		return nil, err
+	}
+	runs := make([]time.Time, 0, count)
+	next := scheduler.clock.Now()
+	for len(runs) < count {
+		next = schedule.Next(next)
+		if next.IsZero() {
+			break
+		}
+		runs = append(runs, next)
+	}
+	return runs, nil
+}
+
+// Validate checks a rule before it is added, including that its scene
+// exists.
+func (scheduler *Scheduler) Validate(name string, rule *ScheduleRule) error {
+	if err := ValidScheduleName(name); err != nil {
+		return err
+	}
+	if err := rule.Validate(scheduler.shutters, scheduler.groups, scheduler.coordinates); err != nil {
+		return err
+	}
+	if rule.Scene != "" {
+		if _, ok := scheduler.state.Scenes.Get(rule.Scene); !ok {
+			return fmt.Errorf("unknown scene %s", rule.Scene)
+		}
+	}
+	return nil
+}
+
+// Put creates or replaces a rule and saves the file.
+// Returns true if the rule was created.
+func (scheduler *Scheduler) Put(name string, rule ScheduleRule) (bool, error) {
+	if err := scheduler.Validate(name, &rule); err != nil {
+		return false, err
+	}
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	previous, exists := scheduler.Rules[name]
+	scheduler.Rules[name] = &rule
+	if err := scheduler.write(); err != nil {
+		// the rules must not change unless they are saved
+		if exists {
+			scheduler.Rules[name] = previous
+		} else {
+			delete(scheduler.Rules, name)
+		}
+		return false, err
+	}
+	scheduler.plan(name, scheduler.clock.Now())
+	scheduler.wake()
+	return !exists, nil
+}
+
+// Delete removes a rule and saves the file.
+func (scheduler *Scheduler) Delete(name string) error {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	previous, ok := scheduler.Rules[name]
+	if !ok {
+		return ErrUnknownSchedule
+	}
+	delete(scheduler.Rules, name)
+	if err := scheduler.write(); err != nil {
+		scheduler.Rules[name] = previous
+		return err
+	}
+	scheduler.plan(name, scheduler.clock.Now())
+	scheduler.wake()
+	return nil
+}
+
+// write saves all rules, if there is a file.
+// The caller must hold the lock.
+func (scheduler *Scheduler) write() error {
+	if scheduler.path == "" {
+		return nil
+	}
+	return writeJSONFile(scheduler.path, scheduler)
+}
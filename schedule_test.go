@@ -0,0 +1,237 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestScheduler creates a scheduler without a file for the shutters of a
+// test state.
+func newTestScheduler(t *testing.T, state *ShutterState, clock *FakeClock, rules map[string]ScheduleRule) *Scheduler {
+	scheduler, err := NewScheduler(state, clock, "", rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(scheduler.Close)
+	return scheduler
+}
+
+// closeAt is a rule that closes shutter 1 at a time of day.
+func closeAt(at string) ScheduleRule {
+	closed := float32(100)
+	return ScheduleRule{ Time: at, Shutter: "1", Action: ActionMove, Position: &closed }
+}
+
+func checkNextRun(t *testing.T, scheduler *Scheduler, name string, expected time.Time) {
+	t.Helper()
+	if _, next, _ := scheduler.Get(name); !next.Equal(expected) {
+		t.Errorf("next run of %s is %s, expected %s", name, next, expected)
+	}
+}
+
+func TestSchedulerRun(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	scheduler := newTestScheduler(t, state, clock, map[string]ScheduleRule{
+		"evening": closeAt("12:01"),
+	})
+	go scheduler.Run()
+
+	clock.BlockUntil(1)
+	if SimLine("1d").Value() {
+		t.Fatal("schedule ran too early")
+	}
+	clock.Advance(time.Minute)
+	energised(t, "1d")
+	checkNextRun(t, scheduler, "evening", time.Date(2017, 6, 2, 12, 1, 0, 0, time.UTC))
+}
+
+func TestSchedulerCheck(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	scheduler := newTestScheduler(t, state, clock, map[string]ScheduleRule{
+		"evening": closeAt("12:30"),
+	})
+
+	// the next rule is further away than the longest wait
+	if wait := scheduler.check(); wait != SchedulerMaxWait {
+		t.Errorf("waiting %s, expected %s", wait, SchedulerMaxWait)
+	}
+	clock.Advance(29 * time.Minute)
+	if wait := scheduler.check(); wait != time.Minute {
+		t.Errorf("waiting %s, expected 1m", wait)
+	}
+	clock.Advance(time.Minute)
+	scheduler.check()
+	energised(t, "1d")
+	checkNextRun(t, scheduler, "evening", time.Date(2017, 6, 2, 12, 30, 0, 0, time.UTC))
+}
+
+func TestSchedulerGraceTime(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	scheduler := newTestScheduler(t, state, clock, map[string]ScheduleRule{
+		"late": closeAt("12:01"),
+		"missed": closeAt("12:02"),
+	})
+
+	// late is 4 minutes late and still runs, missed is skipped
+	clock.Advance(ScheduleGraceTime + time.Minute + time.Second)
+	scheduler.check()
+	energised(t, "1d")
+	checkNextRun(t, scheduler, "late", time.Date(2017, 6, 2, 12, 1, 0, 0, time.UTC))
+	checkNextRun(t, scheduler, "missed", time.Date(2017, 6, 2, 12, 2, 0, 0, time.UTC))
+}
+
+func TestSchedulerSkipsMissedRun(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	scheduler := newTestScheduler(t, state, clock, map[string]ScheduleRule{
+		"evening": closeAt("12:01"),
+	})
+	mark := len(SimTimeline())
+
+	clock.Advance(time.Hour)
+	scheduler.check()
+	checkNextRun(t, scheduler, "evening", time.Date(2017, 6, 2, 12, 1, 0, 0, time.UTC))
+	if timeline := SimTimeline()[mark:]; len(timeline) != 0 {
+		t.Errorf("skipped schedule switched %v", timeline)
+	}
+}
+
+func TestSchedulerClockSetBack(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	scheduler := newTestScheduler(t, state, clock, map[string]ScheduleRule{
+		"evening": closeAt("12:30"),
+	})
+
+	// the clock was an hour ahead: the rule is already planned for tomorrow
+	clock.Advance(time.Hour)
+	scheduler.check()
+	checkNextRun(t, scheduler, "evening", time.Date(2017, 6, 2, 12, 30, 0, 0, time.UTC))
+
+	clock.Advance(-time.Hour)
+	if wait := scheduler.check(); wait != SchedulerMaxWait {
+		t.Errorf("waiting %s, expected %s", wait, SchedulerMaxWait)
+	}
+	checkNextRun(t, scheduler, "evening", time.Date(2017, 6, 1, 12, 30, 0, 0, time.UTC))
+}
+
+func TestSchedulerPreview(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	weekdays := closeAt("07:15")
+	weekdays.Days = []string{ "mon", "fri" }
+	scheduler := newTestScheduler(t, state, clock, map[string]ScheduleRule{
+		"weekdays": weekdays,
+		"never": ScheduleRule{ Cron: "0 0 30 feb *", Shutter: "1", Action: ActionStop },
+	})
+
+	runs, err := scheduler.Preview("weekdays", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []time.Time{
+		time.Date(2017, 6, 2, 7, 15, 0, 0, time.UTC),
+		time.Date(2017, 6, 5, 7, 15, 0, 0, time.UTC),
+		time.Date(2017, 6, 9, 7, 15, 0, 0, time.UTC),
+	}
+	if len(runs) != len(expected) {
+		t.Fatalf("preview is %v, expected %v", runs, expected)
+	}
+	for i := range runs {
+		if !runs[i].Equal(expected[i]) {
+			t.Errorf("run %d is %s, expected %s", i, runs[i], expected[i])
+		}
+	}
+	if runs, err := scheduler.Preview("never", 3); err != nil || len(runs) != 0 {
+		t.Errorf("preview of an impossible rule is %v, %v", runs, err)
+	}
+	if _, err := scheduler.Preview("unknown", 3); err != ErrUnknownSchedule {
+		t.Errorf("preview of an unknown rule returned %v", err)
+	}
+}
+
+func TestSchedulerWriteFailure(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	directory := filepath.Join(t.TempDir(), "schedules")
+	if err := os.Mkdir(directory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	scheduler, err := NewScheduler(state, clock, filepath.Join(directory, "schedules.json"), map[string]ScheduleRule{
+		"evening": closeAt("18:00"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer scheduler.Close()
+
+	// without the directory, the file can't be written
+	if err := os.RemoveAll(directory); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scheduler.Put("morning", closeAt("07:00")); err == nil {
+		t.Fatal("creating a rule succeeded without saving it")
+	}
+	if _, _, ok := scheduler.Get("morning"); ok {
+		t.Error("rule was created although it wasn't saved")
+	}
+	if _, err := scheduler.Put("evening", closeAt("20:00")); err == nil {
+		t.Fatal("replacing a rule succeeded without saving it")
+	}
+	if rule, _, _ := scheduler.Get("evening"); rule.Time != "18:00" {
+		t.Error("rule was replaced although it wasn't saved")
+	}
+	if err := scheduler.Delete("evening"); err == nil {
+		t.Fatal("deleting a rule succeeded without saving it")
+	}
+	checkNextRun(t, scheduler, "evening", time.Date(2017, 6, 1, 18, 0, 0, 0, time.UTC))
+}
+
+func TestSchedulerSunrise(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	state.Coordinates = zurichCoordinates
+	late := closeAt("")
+	late.Sun = SunSunrise
+	late.Offset = 30
+	clamped := late
+	clamped.Offset = -30
+	clamped.Earliest = "05:00"
+	scheduler := newTestScheduler(t, state, clock, map[string]ScheduleRule{
+		"late": late,
+		"clamped": clamped,
+	})
+
+	// sunrise in Zurich is at 03:32:36 UTC on the next day
+	checkNextRun(t, scheduler, "late", time.Date(2017, 6, 2, 4, 2, 36, 0, time.UTC))
+	checkNextRun(t, scheduler, "clamped", time.Date(2017, 6, 2, 5, 0, 0, 0, time.UTC))
+
+	clock.Advance(16 * time.Hour + 2 * time.Minute + 36 * time.Second)
+	scheduler.check()
+	energised(t, "1d")
+	sunrise, _ := SunTime(SunSunrise, time.Date(2017, 6, 3, 12, 0, 0, 0, time.UTC), zurichCoordinates)
+	checkNextRun(t, scheduler, "late", sunrise.Add(30 * time.Minute))
+	checkNextRun(t, scheduler, "clamped", time.Date(2017, 6, 2, 5, 0, 0, 0, time.UTC))
+}
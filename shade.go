@@ -0,0 +1,243 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Tilt modes of the shade automation.
+const (
+	// TiltModeOff leaves the slats alone
+	TiltModeOff = "off"
+	// TiltModeTrack turns the slats just far enough to block direct
+	// sunlight, so that as much daylight as possible comes through
+	TiltModeTrack = "track"
+	// TiltModeBlock closes the slats while the sun shines on the window
+	TiltModeBlock = "block"
+)
+
+// DefaultShadeInterval is the time between updates of the shade automation.
+const DefaultShadeInterval = 10 * time.Minute
+
+// ShadeMinElevation is the elevation of the sun in degrees below which it is
+// assumed to be hidden by the surroundings.
+const ShadeMinElevation = 3.0
+
+// ShadeAngleStep is the resolution of the slat angles. Smaller changes are
+// not carried out, so the motor doesn't run on every update.
+const ShadeAngleStep = 0.1
+
+// ValidTiltMode checks if a tilt mode is known.
+func ValidTiltMode(mode string) bool {
+	switch mode {
+		case TiltModeOff, TiltModeTrack, TiltModeBlock:
+			return true
+	}
+	return false
+}
+
+// shadeAngle calculates the slat angle that keeps direct sunlight out of a
+// window facing the given azimuth, for a position of the sun.
+// Returns false if the sun does not shine on the window.
+func shadeAngle(mode string, facing float64, azimuth float64, elevation float64) (float32, bool) {
+	// horizontal angle between the sun and the normal of the window
+	incidence := math.Mod(azimuth - facing + 540, 360) - 180
+	if elevation < ShadeMinElevation || math.Abs(incidence) >= 90 {
+		return AngleMin, false
+	}
+	if mode == TiltModeBlock {
+		return AngleMax, true
+	}
+	// The profile angle is the elevation of the sun, projected onto the
+	// vertical plane perpendicular to the window. Slats that are as wide as
+	// their spacing block direct light if they are tilted by 90° minus twice
+	// that angle from horizontal, while AngleMax means vertical.
+	profile := degrees(math.Atan(math.Tan(radians(elevation)) / math.Cos(radians(incidence))))
+	tilt := (90 - 2 * profile) / 90
+	// round up, to err on the side of shade
+	tilt = math.Ceil(tilt / ShadeAngleStep - 1e-9) * ShadeAngleStep
+	return float32(math.Max(AngleMin, math.Min(AngleMax, tilt))), true
+}
+
+// Shade checks if the shade automation of the shutter is enabled.
+func (shutter *Shutter) Shade() bool {
+	shutter.lock.Lock()
+	defer shutter.lock.Unlock()
+	return shutter.shade
+}
+
+// SetShade enables or disables the shade automation of the shutter.
+// It can't be enabled if the shutter has no tilt mode.
+func (shutter *Shutter) SetShade(enabled bool) {
+	shutter.lock.Lock()
+	defer shutter.lock.Unlock()
+	shutter.shade = enabled && shutter.TiltMode != TiltModeOff
+	shutter.shading = false
+}
+
+// ShadeReport returns a serialisable summary of the shade automation of the
+// shutter.
+func (shutter *Shutter) ShadeReport() map[string]interface{} {
+	shutter.lock.Lock()
+	defer shutter.lock.Unlock()
+	return map[string]interface{}{
+		"name": shutter.Name,
+		"mode": shutter.TiltMode,
+		"azimuth": shutter.Azimuth,
+		"enabled": shutter.shade,
+		"shading": shutter.shading,
+	}
+}
+
+// ShadeController turns the slats of all shutters with a tilt mode against
+// the sun, while it shines on their windows. When the sun has moved on, the
+// slats are opened again.
+// Shutters that are raised, or moving, are left alone. Any manual command
+// disables the automation of a shutter, until it is enabled again.
+type ShadeController struct {
+	state *ShutterState
+	clock Clock
+	Interval time.Duration
+	lock sync.Mutex
+	started bool
+	closed bool
+	changed chan struct{}
+	closing chan struct{}
+	finished chan struct{}
+}
+
+func NewShadeController(state *ShutterState, clock Clock, interval time.Duration) *ShadeController {
+	return &ShadeController{
+		state: state,
+		clock: clock,
+		Interval: interval,
+		changed: make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+}
+
+// Run updates the slats periodically, until the controller is closed.
+func (controller *ShadeController) Run() {
+	controller.lock.Lock()
+	if controller.closed {
+		controller.lock.Unlock()
+		return
+	}
+	controller.started = true
+	controller.lock.Unlock()
+	defer close(controller.finished)
+
+	for {
+		controller.update()
+		timer := controller.clock.NewTimer(controller.Interval)
+		select {
+			case <-timer.C():
+			case <-controller.changed:
+				timer.Stop()
+			case <-controller.closing:
+				timer.Stop()
+				return
+		}
+	}
+}
+
+// Wake makes the controller update the slats right away.
+func (controller *ShadeController) Wake() {
+	select {
+		case controller.changed <- struct{}{}:
+		default:
+	}
+}
+
+// Close stops the controller and waits until it has finished.
+func (controller *ShadeController) Close() {
+	controller.lock.Lock()
+	if controller.closed {
+		controller.lock.Unlock()
+		return
+	}
+	controller.closed = true
+	started := controller.started
+	close(controller.closing)
+	controller.lock.Unlock()
+	if started {
+		<-controller.finished
+	}
+}
+
+// update turns the slats of all shutters for the current position of the sun.
+func (controller *ShadeController) update() {
+	if controller.state.Coordinates == nil {
+		return
+	}
+	azimuth, elevation := SunPosition(controller.clock.Now(), controller.state.Coordinates)
+	for _, shutter := range controller.state.Shutters {
+		if shutter.TiltMode != TiltModeOff {
+			controller.track(shutter, azimuth, elevation)
+		}
+	}
+}
+
+// track turns the slats of a shutter for a position of the sun.
+func (controller *ShadeController) track(shutter *Shutter, azimuth float64, elevation float64) {
+	status := shutter.Status()
+	if status.Moving || status.Queued > 0 || status.Position <= PositionMin {
+		return
+	}
+	angle, sunny := shadeAngle(shutter.TiltMode, shutter.Azimuth, azimuth, elevation)
+
+	shutter.lock.Lock()
+	if !shutter.shade {
+		shutter.lock.Unlock()
+		return
+	}
+	shading := shutter.shading
+	shutter.shading = sunny
+	shutter.lock.Unlock()
+
+	// only open the slats once when the sun is gone, in case someone
+	// closed them for other reasons
+	if !sunny && !shading {
+		return
+	}
+	if math.Abs(float64(angle - status.Angle)) < ShadeAngleStep / 2 {
+		return
+	}
+	log.Printf("Turning slats of shutter %s to %f for the sun at %.1f° azimuth, %.1f° elevation\n", shutter.Name, angle, azimuth, elevation)
+	_, err := controller.state.Dispatch(shutter.Name, Command{
+		Action: ActionFlip,
+		Angle: angle,
+		Source: SourceShade,
+	})
+	if err != nil {
+		log.Printf("Can't turn slats of shutter %s: %s\n", shutter.Name, err)
+	}
+}
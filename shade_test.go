@@ -0,0 +1,115 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestShadeAngle(t *testing.T) {
+	tests := []struct {
+		mode string
+		facing float64
+		azimuth float64
+		elevation float64
+		angle float32
+		sunny bool
+	}{
+		// the sun is behind the facade
+		{ TiltModeTrack, 180, 0, 30, AngleMin, false },
+		{ TiltModeTrack, 180, 270, 30, AngleMin, false },
+		{ TiltModeBlock, 180, 85, 30, AngleMin, false },
+		// the sun is below the horizon, or hidden by the surroundings
+		{ TiltModeTrack, 180, 180, -5, AngleMin, false },
+		{ TiltModeTrack, 180, 180, ShadeMinElevation - 1, AngleMin, false },
+		{ TiltModeBlock, 180, 180, -5, AngleMin, false },
+		// block closes the slats whenever the sun shines on the window
+		{ TiltModeBlock, 180, 180, 30, AngleMax, true },
+		{ TiltModeBlock, 180, 260, 60, AngleMax, true },
+		// track turns the slats just far enough, rounded up
+		{ TiltModeTrack, 180, 180, 10, 0.8, true },
+		{ TiltModeTrack, 180, 180, 30, 0.4, true },
+		{ TiltModeTrack, 180, 180, 45, AngleMin, true },
+		{ TiltModeTrack, 180, 180, 60, AngleMin, true },
+		// light from the side needs less tilt
+		{ TiltModeTrack, 180, 240, 30, AngleMin, true },
+		// facing north, the incidence wraps around
+		{ TiltModeTrack, 350, 10, 30, 0.3, true },
+	}
+	for _, test := range tests {
+		angle, sunny := shadeAngle(test.mode, test.facing, test.azimuth, test.elevation)
+		if sunny != test.sunny || math.Abs(float64(angle - test.angle)) > 1e-6 {
+			t.Errorf("%s facing %.0f° with the sun at %.0f°, %.0f° is %f, %t, expected %f, %t", test.mode, test.facing, test.azimuth, test.elevation, angle, sunny, test.angle, test.sunny)
+		}
+	}
+}
+
+func TestShadeManualCommand(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	state.Coordinates = zurichCoordinates
+	shutter := state.Shutters["1"]
+	shutter.TiltMode = TiltModeTrack
+	// west-south-west, where the sun is in the afternoon
+	shutter.Azimuth = 250
+	controller := NewShadeController(state, clock, time.Hour)
+
+	job, err := state.Dispatch("1", Command{ Action: ActionMove, Position: 100, Source: SourceSchedule })
+	if err != nil {
+		t.Fatal(err)
+	}
+	energised(t, "1d")
+	clock.Advance(10 * time.Second)
+	finished(t, job)
+	clock.Advance(4 * time.Hour - 10 * time.Second)
+	shutter.SetShade(true)
+
+	azimuth, elevation := SunPosition(clock.Now(), state.Coordinates)
+	angle, sunny := shadeAngle(TiltModeTrack, shutter.Azimuth, azimuth, elevation)
+	if !sunny || angle == shutter.Status().Angle {
+		t.Fatalf("sun at %.1f°, %.1f° calls for no change, the test needs one", azimuth, elevation)
+	}
+	controller.update()
+	jobs := shutter.Jobs()
+	flip := shutter.Job(jobs[len(jobs) - 1])
+	if flip.Command.Action != ActionFlip || flip.Command.Angle != angle || flip.Command.Source != SourceShade {
+		t.Fatalf("shade automation queued %v, expected a flip to %f", flip.Command, angle)
+	}
+
+	// someone stops the slats by hand, and the automation leaves them alone
+	if _, err := state.Dispatch("1", Command{ Action: ActionStop }); err != nil {
+		t.Fatal(err)
+	}
+	finished(t, flip)
+	if shutter.Shade() {
+		t.Error("manual command did not disable the shade automation")
+	}
+	controller.update()
+	if after := shutter.Jobs(); len(after) != len(jobs) {
+		t.Errorf("shade automation queued job %d after a manual command", after[len(after) - 1])
+	}
+}
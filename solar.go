@@ -0,0 +1,300 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Solar events that can be calculated.
+// Dawn and dusk are when the centre of the sun is 6° (civil), 12° (nautical)
+// or 18° (astronomical) below the horizon.
+const (
+	SunAstronomicalDawn = "astronomical_dawn"
+	SunNauticalDawn = "nautical_dawn"
+	SunCivilDawn = "civil_dawn"
+	SunSunrise = "sunrise"
+	SunNoon = "noon"
+	SunSunset = "sunset"
+	SunCivilDusk = "civil_dusk"
+	SunNauticalDusk = "nautical_dusk"
+	SunAstronomicalDusk = "astronomical_dusk"
+)
+
+// sunEvents are the zenith angles of the sun at each event, in degrees, and
+// whether it happens in the morning.
+var sunEvents = map[string]struct{
+	zenith float64
+	rising bool
+}{
+	SunAstronomicalDawn: { 108, true },
+	SunNauticalDawn: { 102, true },
+	SunCivilDawn: { 96, true },
+	// refraction and the size of the solar disc
+	SunSunrise: { 90.833, true },
+	SunSunset: { 90.833, false },
+	SunCivilDusk: { 96, false },
+	SunNauticalDusk: { 102, false },
+	SunAstronomicalDusk: { 108, false },
+}
+
+// SunEventNames lists all solar events in the order they happen.
+var SunEventNames = []string{
+	SunAstronomicalDawn,
+	SunNauticalDawn,
+	SunCivilDawn,
+	SunSunrise,
+	SunNoon,
+	SunSunset,
+	SunCivilDusk,
+	SunNauticalDusk,
+	SunAstronomicalDusk,
+}
+
+var ErrUnknownSunEvent = errors.New("unknown solar event")
+
+// Coordinates is a location on Earth, in degrees. North and east are
+// positive.
+type Coordinates struct {
+	Latitude float64
+	Longitude float64
+}
+
+// Validate checks that the coordinates are in range.
+func (coordinates *Coordinates) Validate() error {
+	if coordinates.Latitude < -90 || coordinates.Latitude > 90 {
+		return fmt.Errorf("latitude %f out of range", coordinates.Latitude)
+	}
+	if coordinates.Longitude < -180 || coordinates.Longitude > 180 {
+		return fmt.Errorf("longitude %f out of range", coordinates.Longitude)
+	}
+	return nil
+}
+
+// ValidSunEvent checks if an event can be calculated.
+func ValidSunEvent(event string) bool {
+	_, ok := sunEvents[event]
+	return ok || event == SunNoon
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func degrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
+
+// julianDay converts a point in time to a Julian day number.
+func julianDay(t time.Time) float64 {
+	return float64(t.Unix()) / 86400 + 2440587.5
+}
+
+// solarParameters calculates the declination of the sun, in degrees, and the
+// equation of time, in minutes, with the equations of the NOAA solar
+// calculator. They are accurate to about a minute between 1800 and 2100.
+func solarParameters(t time.Time) (float64, float64) {
+	// Julian centuries since J2000.0
+	century := (julianDay(t) - 2451545) / 36525
+	meanLongitude := math.Mod(280.46646 + century * (36000.76983 + century * 0.0003032), 360)
+	meanAnomaly := 357.52911 + century * (35999.05029 - 0.0001537 * century)
+	eccentricity := 0.016708634 - century * (0.000042037 + 0.0000001267 * century)
+	m := radians(meanAnomaly)
+	centre := math.Sin(m) * (1.914602 - century * (0.004817 + 0.000014 * century)) +
+		math.Sin(2 * m) * (0.019993 - 0.000101 * century) +
+		math.Sin(3 * m) * 0.000289
+	trueLongitude := meanLongitude + centre
+	omega := radians(125.04 - 1934.136 * century)
+	apparentLongitude := trueLongitude - 0.00569 - 0.00478 * math.Sin(omega)
+	meanObliquity := 23 + (26 + (21.448 - century * (46.815 + century * (0.00059 - century * 0.001813))) / 60) / 60
+	obliquity := radians(meanObliquity + 0.00256 * math.Cos(omega))
+	declination := degrees(math.Asin(math.Sin(obliquity) * math.Sin(radians(apparentLongitude))))
+	y := math.Pow(math.Tan(obliquity / 2), 2)
+	l := radians(meanLongitude)
+	equation := 4 * degrees(y * math.Sin(2 * l) -
+		2 * eccentricity * math.Sin(m) +
+		4 * eccentricity * y * math.Sin(m) * math.Cos(2 * l) -
+		0.5 * y * y * math.Sin(4 * l) -
+		1.25 * eccentricity * eccentricity * math.Sin(2 * m))
+	return declination, equation
+}
+
+// SunPosition calculates where the sun is in the sky at a point in time.
+// The azimuth is in degrees clockwise from north, the elevation in degrees
+// above the horizon, without correction for atmospheric refraction.
+func SunPosition(t time.Time, coordinates *Coordinates) (float64, float64) {
+	declination, equation := solarParameters(t)
+	utc := t.UTC()
+	minutes := float64(utc.Hour() * 60 + utc.Minute()) + float64(utc.Second()) / 60
+	solarTime := minutes + equation + 4 * coordinates.Longitude
+	hourAngle := radians(solarTime / 4 - 180)
+	latitude := radians(coordinates.Latitude)
+	decl := radians(declination)
+	elevation := math.Asin(math.Sin(latitude) * math.Sin(decl) + math.Cos(latitude) * math.Cos(decl) * math.Cos(hourAngle))
+	azimuth := math.Atan2(math.Sin(hourAngle), math.Cos(hourAngle) * math.Sin(latitude) - math.Tan(decl) * math.Cos(latitude))
+	return math.Mod(degrees(azimuth) + 540, 360), degrees(elevation)
+}
+
+// SunTime calculates when a solar event happens on a calendar day, which is
+// taken in the time zone of the given time. The result is in the same zone.
+// Returns false if the event does not happen on that day, as during the polar
+// day or night.
+func SunTime(event string, day time.Time, coordinates *Coordinates) (time.Time, bool) {
+	// the calendar date at midnight UTC, which all times are relative to
+	midnight := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	at := func(minutes float64) time.Time {
+		return midnight.Add(time.Duration(minutes * float64(time.Minute))).In(day.Location())
+	}
+
+	// start at solar noon, then refine with the parameters at the event time
+	minutes := 720 - 4 * coordinates.Longitude
+	for i := 0; i < 3; i++ {
+		declination, equation := solarParameters(at(minutes))
+		noon := 720 - 4 * coordinates.Longitude - equation
+		if event == SunNoon {
+			minutes = noon
+			continue
+		}
+		parameters, ok := sunEvents[event]
+		if !ok {
+			return time.Time{}, false
+		}
+		latitude := radians(coordinates.Latitude)
+		cosine := math.Cos(radians(parameters.zenith)) / (math.Cos(latitude) * math.Cos(radians(declination))) -
+			math.Tan(latitude) * math.Tan(radians(declination))
+		if cosine < -1 || cosine > 1 {
+			return time.Time{}, false
+		}
+		hourAngle := degrees(math.Acos(cosine))
+		if parameters.rising {
+			minutes = noon - 4 * hourAngle
+		} else {
+			minutes = noon + 4 * hourAngle
+		}
+	}
+	return at(minutes).Round(time.Second), true
+}
+
+// SunTimes calculates all solar events of a day. Events that don't happen
+// are left out.
+func SunTimes(day time.Time, coordinates *Coordinates) map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, event := range SunEventNames {
+		if t, ok := SunTime(event, day, coordinates); ok {
+			times[event] = t
+		}
+	}
+	return times
+}
+
+// SunSchedule runs at a solar event, shifted by an offset and clamped to a
+// range of local times, on selected weekdays.
+type SunSchedule struct {
+	Event string
+	Offset time.Duration
+	// Earliest and Latest are times of day, or negative if not set
+	Earliest time.Duration
+	Latest time.Duration
+	// days is a bit set of weekdays, as in CronSchedule
+	days uint64
+	coordinates Coordinates
+}
+
+// NewSunSchedule creates a schedule for an event. The weekdays are given as
+// in the day of week field of cron expressions, or as * for every day.
+func NewSunSchedule(event string, offset time.Duration, earliest time.Duration, latest time.Duration, days string, coordinates *Coordinates) (*SunSchedule, error) {
+	if !ValidSunEvent(event) {
+		return nil, ErrUnknownSunEvent
+	}
+	if earliest >= 0 && latest >= 0 && latest < earliest {
+		return nil, errors.New("latest time is before earliest time")
+	}
+	field := cronFields[4]
+	bits, err := field.parse(days)
+	if err != nil {
+		return nil, err
+	}
+	if bits & (1 << 7) != 0 {
+		bits |= 1
+	}
+	return &SunSchedule{
+		Event: event,
+		Offset: offset,
+		Earliest: earliest,
+		Latest: latest,
+		days: bits,
+		coordinates: *coordinates,
+	}, nil
+}
+
+// At returns the time of the schedule on a calendar day, in the time zone of
+// the given time. Returns false if the event doesn't happen on that day and
+// there is no clamp to fall back on.
+func (schedule *SunSchedule) At(day time.Time) (time.Time, bool) {
+	clamp := func(offset time.Duration) time.Time {
+		// not added to midnight, which would be off on daylight saving changes
+		return time.Date(day.Year(), day.Month(), day.Day(), int(offset / time.Hour), int(offset % time.Hour / time.Minute), 0, 0, day.Location())
+	}
+	t, ok := SunTime(schedule.Event, day, &schedule.coordinates)
+	if !ok {
+		// close to the poles, the sun may not rise or set for weeks, so run
+		// as late or as early as allowed
+		if schedule.Latest >= 0 {
+			return clamp(schedule.Latest), true
+		}
+		if schedule.Earliest >= 0 {
+			return clamp(schedule.Earliest), true
+		}
+		return time.Time{}, false
+	}
+	t = t.Add(schedule.Offset)
+	if schedule.Earliest >= 0 && t.Before(clamp(schedule.Earliest)) {
+		t = clamp(schedule.Earliest)
+	}
+	if schedule.Latest >= 0 && t.After(clamp(schedule.Latest)) {
+		t = clamp(schedule.Latest)
+	}
+	return t, true
+}
+
+// Next returns the first run after the given time, in the same time zone.
+// If there is none within a year, the zero time is returned.
+func (schedule *SunSchedule) Next(after time.Time) time.Time {
+	// an offset can move the run to the previous day, so start there
+	day := time.Date(after.Year(), after.Month(), after.Day() - 1, 12, 0, 0, 0, after.Location())
+	for i := 0; i < 368; i++ {
+		if schedule.days & (1 << uint(day.Weekday())) != 0 {
+			if t, ok := schedule.At(day); ok && t.After(after) {
+				return t
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return time.Time{}
+}
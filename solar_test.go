@@ -0,0 +1,109 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var (
+	zurichCoordinates = &Coordinates{ Latitude: 47.37, Longitude: 8.54 }
+	tromsoCoordinates = &Coordinates{ Latitude: 69.65, Longitude: 18.96 }
+)
+
+func TestSunTime(t *testing.T) {
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Skip("time zone data is not available: ", err)
+	}
+	solstice := time.Date(2017, 6, 21, 12, 0, 0, 0, zurich)
+	tests := []struct {
+		event string
+		day time.Time
+		coordinates *Coordinates
+		// expected is the local time of the event, to the minute, or empty
+		// if it doesn't happen
+		expected string
+	}{
+		{ SunSunrise, solstice, zurichCoordinates, "05:29" },
+		{ SunNoon, solstice, zurichCoordinates, "13:27" },
+		{ SunSunset, solstice, zurichCoordinates, "21:26" },
+		// the sun doesn't set in the polar day, and doesn't rise in the polar
+		// night, but it still has a noon
+		{ SunSunrise, time.Date(2017, 6, 21, 12, 0, 0, 0, time.UTC), tromsoCoordinates, "" },
+		{ SunSunset, time.Date(2017, 6, 21, 12, 0, 0, 0, time.UTC), tromsoCoordinates, "" },
+		{ SunSunrise, time.Date(2017, 12, 21, 12, 0, 0, 0, time.UTC), tromsoCoordinates, "" },
+		{ SunSunset, time.Date(2017, 12, 21, 12, 0, 0, 0, time.UTC), tromsoCoordinates, "" },
+		{ SunNoon, time.Date(2017, 12, 21, 12, 0, 0, 0, time.UTC), tromsoCoordinates, "10:42" },
+		{ "moonrise", solstice, zurichCoordinates, "" },
+	}
+	for _, test := range tests {
+		at, ok := SunTime(test.event, test.day, test.coordinates)
+		if test.expected == "" {
+			if ok {
+				t.Errorf("%s on %s at %v is at %s, expected none", test.event, test.day.Format("2006-01-02"), *test.coordinates, at)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s on %s at %v does not happen, expected %s", test.event, test.day.Format("2006-01-02"), *test.coordinates, test.expected)
+			continue
+		}
+		if at.Location() != test.day.Location() {
+			t.Errorf("%s is in %s, expected %s", test.event, at.Location(), test.day.Location())
+		}
+		if local := at.Format("15:04"); local != test.expected || at.Day() != test.day.Day() {
+			t.Errorf("%s on %s at %v is at %s, expected %s", test.event, test.day.Format("2006-01-02"), *test.coordinates, at, test.expected)
+		}
+	}
+}
+
+func TestSunPosition(t *testing.T) {
+	tests := []struct {
+		at time.Time
+		azimuth float64
+		elevation float64
+	}{
+		// at solar noon on the solstice, the sun is due south, at 90° minus
+		// the latitude plus the tilt of the earth's axis
+		{ time.Date(2017, 6, 21, 11, 27, 41, 0, time.UTC), 180, 66.07 },
+		// and due north at midnight, below the horizon
+		{ time.Date(2017, 6, 21, 23, 27, 41, 0, time.UTC), 0, -19.2 },
+		{ time.Date(2017, 12, 21, 11, 24, 0, 0, time.UTC), 180, 19.2 },
+		// in the morning, it is in the east
+		{ time.Date(2017, 3, 20, 5, 30, 0, 0, time.UTC), 90, 0 },
+	}
+	for _, test := range tests {
+		azimuth, elevation := SunPosition(test.at, zurichCoordinates)
+		// the azimuth wraps around at north
+		difference := math.Mod(azimuth - test.azimuth + 540, 360) - 180
+		if math.Abs(difference) > 1.5 || math.Abs(elevation - test.elevation) > 1.5 {
+			t.Errorf("sun at %s is at azimuth %.2f, elevation %.2f, expected %.2f, %.2f", test.at, azimuth, elevation, test.azimuth, test.elevation)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// KeepaliveInterval is the time between comments that are sent on idle event
+// streams, to keep proxies from closing the connection.
+const KeepaliveInterval = 15 * time.Second
+
+// EventStream serves shutter events as a stream of Server-Sent Events.
+// All shutters are reported, unless one is selected with the shutter query
+// parameter. The current state of the shutters is sent as "state" events
+// when the stream is opened.
+type EventStream struct {
+	state *ShutterState
+}
+
+func NewEventStream(state *ShutterState) *EventStream {
+	return &EventStream{
+		state: state,
+	}
+}
+
+func (stream *EventStream) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		response, status := jsonResponse(map[string]interface{}{
+			"error": ErrNotImplemented,
+		}, http.StatusInternalServerError)
+		writer.Header().Add("Content-Type", "application/json")
+		writer.WriteHeader(status)
+		writer.Write(response)
+		return
+	}
+
+	name := request.URL.Query().Get("shutter")
+	names := make([]string, 0, len(stream.state.Shutters))
+	if name != "" {
+		if stream.state.Shutters[name] == nil {
+			response, status := notFound()
+			writer.Header().Add("Content-Type", "application/json")
+			writer.WriteHeader(status)
+			writer.Write(response)
+			return
+		}
+		names = append(names, name)
+	} else {
+		for key := range stream.state.Shutters {
+			names = append(names, key)
+		}
+		sort.Strings(names)
+	}
+
+	// subscribe before sending the snapshot, so no change is missed
+	sub := stream.state.Events.Subscribe(name)
+	defer stream.state.Events.Unsubscribe(sub)
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+
+	for _, key := range names {
+		shutter := stream.state.Shutters[key]
+		report := shutterReport(shutter)
+		report["type"] = "state"
+		report["shutter"] = key
+		if err := writeEvent(writer, "state", report); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(KeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+			case event, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				if err := writeEvent(writer, event.Type, event.Report()); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(writer, ": keepalive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-request.Context().Done():
+				return
+		}
+	}
+}
+
+// writeEvent sends a single event in Server-Sent Events format.
+func writeEvent(writer http.ResponseWriter, kind string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Print(err)
+		return err
+	}
+	_, err = fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", kind, payload)
+	return err
+}
@@ -0,0 +1,518 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket protocol constants from RFC 6455.
+const (
+	wsGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText = 0x1
+	wsOpBinary = 0x2
+	wsOpClose = 0x8
+	wsOpPing = 0x9
+	wsOpPong = 0xA
+)
+
+const (
+	// WsMaxMessageSize limits the size of incoming messages.
+	WsMaxMessageSize = 64 * 1024
+	// WsPingInterval is the time between heartbeat pings sent to the client.
+	WsPingInterval = time.Second
+	// WsTimeout is the time after which a client that doesn't answer pings
+	// is considered gone, and its jogging shutters are stopped. It must be
+	// much shorter than the travel time of the shutters.
+	// The connection is also dropped if no frame at all arrives for as long.
+	WsTimeout = 3 * WsPingInterval
+)
+
+// WebSocket control commands that are not shutter actions.
+const (
+	// WsJogStart starts moving in a direction until WsJogEnd is received
+	WsJogStart = "jog_start"
+	// WsJogEnd stops a jog
+	WsJogEnd = "jog_end"
+)
+
+var (
+	ErrWsProtocol = errors.New("websocket protocol error")
+	ErrWsTooLarge = errors.New("websocket message too large")
+)
+
+// wsConn is a server-side WebSocket connection.
+type wsConn struct {
+	conn net.Conn
+	reader *bufio.Reader
+	// lock serialises writes
+	lock sync.Mutex
+	writer *bufio.Writer
+	// pong is when the client last answered a ping
+	pongLock sync.Mutex
+	pong time.Time
+}
+
+// upgradeWebSocket performs the opening handshake and takes over the
+// connection. On failure, an error response is sent to the client.
+func upgradeWebSocket(writer http.ResponseWriter, request *http.Request) (*wsConn, error) {
+	key := request.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(request.Header, "Connection", "upgrade") || !headerContains(request.Header, "Upgrade", "websocket") || key == "" {
+		response, status := jsonResponse(map[string]interface{}{
+			"error": ErrInvalidArgument,
+			"message": "websocket upgrade required",
+		}, http.StatusBadRequest)
+		writer.Header().Add("Content-Type", "application/json")
+		writer.WriteHeader(status)
+		writer.Write(response)
+		return nil, ErrWsProtocol
+	}
+	if !sameOrigin(request) {
+		log.Printf("Rejecting WebSocket client from origin %s\n", request.Header.Get("Origin"))
+		response, status := jsonResponse(map[string]interface{}{
+			"error": ErrForbidden,
+			"message": "cross-origin websocket requests are not allowed",
+		}, http.StatusForbidden)
+		writer.Header().Add("Content-Type", "application/json")
+		writer.WriteHeader(status)
+		writer.Write(response)
+		return nil, ErrWsProtocol
+	}
+	if request.Header.Get("Sec-WebSocket-Version") != "13" {
+		writer.Header().Set("Sec-WebSocket-Version", "13")
+		writer.WriteHeader(http.StatusUpgradeRequired)
+		return nil, ErrWsProtocol
+	}
+	hijacker, ok := writer.(http.Hijacker)
+	if !ok {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return nil, errors.New("connection can't be taken over")
+	}
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + wsGuid))
+	buffer.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	buffer.WriteString("Upgrade: websocket\r\n")
+	buffer.WriteString("Connection: Upgrade\r\n")
+	buffer.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n")
+	if err := buffer.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(WsTimeout))
+	return &wsConn{
+		conn: conn,
+		reader: buffer.Reader,
+		writer: buffer.Writer,
+		pong: time.Now(),
+	}, nil
+}
+
+// sameOrigin checks that a browser opened the connection from a page of
+// this server. Browsers don't apply CORS to WebSockets, so any page could
+// connect otherwise. Clients that aren't browsers send no Origin.
+func sameOrigin(request *http.Request) bool {
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(parsed.Host, request.Host)
+}
+
+// headerContains checks if a comma-separated header contains a token,
+// ignoring case.
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, element := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(element), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readFrame reads a single frame from the client.
+// Every complete frame extends the read deadline by WsTimeout.
+func (ws *wsConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(ws.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0] & 0x80 != 0
+	opcode := header[0] & 0x0f
+	masked := header[1] & 0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	switch length {
+		case 126:
+			extended := make([]byte, 2)
+			if _, err := io.ReadFull(ws.reader, extended); err != nil {
+				return false, 0, nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(extended))
+		case 127:
+			extended := make([]byte, 8)
+			if _, err := io.ReadFull(ws.reader, extended); err != nil {
+				return false, 0, nil, err
+			}
+			length = binary.BigEndian.Uint64(extended)
+	}
+	// clients must always mask their frames
+	if !masked {
+		return false, 0, nil, ErrWsProtocol
+	}
+	if length > WsMaxMessageSize {
+		return false, 0, nil, ErrWsTooLarge
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(ws.reader, mask); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i % 4]
+	}
+	ws.conn.SetReadDeadline(time.Now().Add(WsTimeout))
+	return fin, opcode, payload, nil
+}
+
+// ReadMessage returns the next complete data message.
+// Control frames are handled internally. io.EOF is returned when the client
+// closes the connection.
+func (ws *wsConn) ReadMessage() ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+			case wsOpPing:
+				if err := ws.WriteFrame(wsOpPong, payload); err != nil {
+					return nil, err
+				}
+			case wsOpPong:
+				ws.pongLock.Lock()
+				ws.pong = time.Now()
+				ws.pongLock.Unlock()
+			case wsOpClose:
+				ws.WriteFrame(wsOpClose, payload)
+				return nil, io.EOF
+			case wsOpText, wsOpBinary, wsOpContinuation:
+				if (opcode == wsOpContinuation) != (message != nil) {
+					return nil, ErrWsProtocol
+				}
+				if len(message) + len(payload) > WsMaxMessageSize {
+					return nil, ErrWsTooLarge
+				}
+				message = append(message, payload...)
+				if message == nil {
+					message = []byte{}
+				}
+				if fin {
+					return message, nil
+				}
+			default:
+				return nil, ErrWsProtocol
+		}
+	}
+}
+
+// WriteFrame sends a single unfragmented frame.
+func (ws *wsConn) WriteFrame(opcode byte, payload []byte) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	header := []byte{ 0x80 | opcode }
+	length := len(payload)
+	switch {
+		case length < 126:
+			header = append(header, byte(length))
+		case length <= 0xffff:
+			header = append(header, 126, byte(length >> 8), byte(length))
+		default:
+			header = append(header, 127, 0, 0, 0, 0, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length))
+	}
+	ws.conn.SetWriteDeadline(time.Now().Add(WsTimeout))
+	if _, err := ws.writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := ws.writer.Write(payload); err != nil {
+		return err
+	}
+	return ws.writer.Flush()
+}
+
+// WriteJSON sends a value as a JSON text message.
+func (ws *wsConn) WriteJSON(data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return ws.WriteFrame(wsOpText, payload)
+}
+
+// SincePong returns the time since the client last answered a ping, or since
+// it connected.
+func (ws *wsConn) SincePong() time.Duration {
+	ws.pongLock.Lock()
+	defer ws.pongLock.Unlock()
+	return time.Since(ws.pong)
+}
+
+func (ws *wsConn) Close() error {
+	return ws.conn.Close()
+}
+
+// WsRequest is a command sent by a WebSocket client.
+// Id is echoed back in the reply, so clients can match them up.
+// If Shutter is empty, the shutter selected when connecting is used.
+type WsRequest struct {
+	Id interface{}
+	Command string
+	Shutter string
+	// Direction is "up" or "down", for jog_start
+	Direction string
+	CommandArguments
+}
+
+// WebSocketEndpoint is a bidirectional control channel for interactive
+// clients. It accepts JSON commands and pushes state changes as they happen.
+// Commands are dispatched like those of the REST API.
+// While a jog is in progress, the connection is monitored with pings, and the
+// shutter is stopped if the client disappears.
+type WebSocketEndpoint struct {
+	state *ShutterState
+}
+
+func NewWebSocketEndpoint(state *ShutterState) *WebSocketEndpoint {
+	return &WebSocketEndpoint{
+		state: state,
+	}
+}
+
+// wsSession is the state of a single WebSocket client.
+type wsSession struct {
+	state *ShutterState
+	conn *wsConn
+	// shutter is the default shutter for commands
+	shutter string
+	// jogging are the jobs of shutters that are moving until the client says
+	// stop, by shutter
+	jogging map[string]uint64
+}
+
+func (ep *WebSocketEndpoint) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	name := request.URL.Query().Get("shutter")
+	if name != "" && ep.state.Shutters[name] == nil {
+		response, status := notFound()
+		writer.Header().Add("Content-Type", "application/json")
+		writer.WriteHeader(status)
+		writer.Write(response)
+		return
+	}
+
+	conn, err := upgradeWebSocket(writer, request)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer conn.Close()
+	log.Printf("WebSocket client %s connected\n", conn.conn.RemoteAddr())
+
+	session := &wsSession{
+		state: ep.state,
+		conn: conn,
+		shutter: name,
+		jogging: make(map[string]uint64),
+	}
+
+	sub := ep.state.Events.Subscribe(name)
+	defer ep.state.Events.Unsubscribe(sub)
+	done := make(chan struct{})
+	defer close(done)
+	go session.push(sub, done)
+
+	for {
+		message, err := conn.ReadMessage()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("WebSocket client %s failed: %s\n", conn.conn.RemoteAddr(), err)
+			}
+			break
+		}
+		if err := conn.WriteJSON(session.handle(message)); err != nil {
+			log.Print(err)
+			break
+		}
+	}
+
+	log.Printf("WebSocket client %s disconnected\n", conn.conn.RemoteAddr())
+	for shutter, id := range session.jogging {
+		// a jog that has ended must not stop what others started since
+		job := session.state.Shutters[shutter].Job(id)
+		if job == nil || job.Status() != JobRunning {
+			continue
+		}
+		log.Printf("Stopping jog of shutter %s\n", shutter)
+		session.state.Dispatch(shutter, Command{ Action: ActionStop })
+	}
+}
+
+// push forwards events to the client and sends heartbeat pings, until done
+// is closed or the connection fails.
+// If the client stops answering the pings, the connection is closed, which
+// ends the session and stops its jogs.
+func (session *wsSession) push(sub *Subscription, done <-chan struct{}) {
+	ping := time.NewTicker(WsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+			case event, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				if err := session.conn.WriteJSON(event.Report()); err != nil {
+					return
+				}
+			case <-ping.C:
+				if session.conn.SincePong() > WsTimeout {
+					log.Printf("WebSocket client %s stopped answering pings\n", session.conn.conn.RemoteAddr())
+					session.conn.Close()
+					return
+				}
+				if err := session.conn.WriteFrame(wsOpPing, nil); err != nil {
+					return
+				}
+			case <-done:
+				return
+		}
+	}
+}
+
+// handle executes a command message and returns the reply.
+func (session *wsSession) handle(message []byte) map[string]interface{} {
+	request := WsRequest{}
+	if err := json.Unmarshal(message, &request); err != nil {
+		return wsError(nil, ErrInvalidArgument, err.Error())
+	}
+	name := request.Shutter
+	if name == "" {
+		name = session.shutter
+	}
+	if session.state.Shutters[name] == nil {
+		return wsError(request.Id, ErrInvalidObject, "unknown shutter")
+	}
+
+	var command Command
+	var err error
+	switch request.Command {
+		case WsJogStart:
+			command = Command{
+				Action: ActionMove,
+			}
+			switch request.Direction {
+				case DirectionUp.String():
+					command.Position = PositionMin
+				case DirectionDown.String():
+					command.Position = PositionMax
+				default:
+					return wsError(request.Id, ErrInvalidArgument, "direction must be up or down")
+			}
+		case WsJogEnd:
+			command = Command{
+				Action: ActionStop,
+			}
+		case ActionMove, ActionFlip, ActionStop:
+			command, err = request.CommandArguments.Command(request.Command)
+			if err != nil {
+				return wsError(request.Id, ErrInvalidArgument, err.Error())
+			}
+		default:
+			// recalibration and the like are left to the REST API
+			return wsError(request.Id, ErrInvalidArgument, "unknown command " + request.Command)
+	}
+
+	job, err := session.state.Dispatch(name, command)
+	switch {
+		case err == ErrQueueFull || err == ErrShutdown:
+			return wsError(request.Id, ErrBusy, err.Error())
+		case err == ErrUnknownAction || err == ErrPositionRange || err == ErrAngleRange:
+			return wsError(request.Id, ErrInvalidArgument, err.Error())
+		case err != nil:
+			return wsError(request.Id, ErrInternal, err.Error())
+	}
+
+	if request.Command == WsJogStart {
+		session.jogging[name] = job.ID
+	} else if command.Action == ActionStop {
+		delete(session.jogging, name)
+	}
+
+	reply := map[string]interface{}{
+		"type": "reply",
+		"id": request.Id,
+		"shutter": name,
+		"command": request.Command,
+	}
+	if job != nil {
+		reply["job"] = job.ID
+	}
+	return reply
+}
+
+func wsError(id interface{}, code string, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "reply",
+		"id": id,
+		"error": code,
+		"message": message,
+	}
+}
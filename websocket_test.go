@@ -0,0 +1,292 @@
+/* Copyright (c) 2017-2018, Gregor Riepl <onitake@gmail.com>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification,
+ * are permitted provided that the following conditions are met:
+ *
+ *     Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *
+ *     Redistributions in binary form must reproduce the above copyright notice,
+ *     this list of conditions and the following disclaimer in the documentation
+ *     and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+ * ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// wsClient is the client side of a WebSocket connection, for tests.
+type wsClient struct {
+	conn net.Conn
+	reader *bufio.Reader
+}
+
+// newWsServer serves the WebSocket endpoint of a test state.
+func newWsServer(t *testing.T, state *ShutterState) *httptest.Server {
+	server := httptest.NewServer(NewWebSocketEndpoint(state))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// wsHandshake sends an upgrade request, with an Origin header unless origin
+// is empty, and returns the response. If the upgrade succeeded, the client
+// is returned too.
+func wsHandshake(t *testing.T, server *httptest.Server, origin string) (*http.Response, *wsClient) {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := http.NewRequest(http.MethodGet, server.URL + "/api/v1/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	if origin != "" {
+		request.Header.Set("Origin", origin)
+	}
+	if err := request.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return response, nil
+	}
+	client := &wsClient{
+		conn: conn,
+		reader: reader,
+	}
+	t.Cleanup(func() {
+		client.conn.Close()
+	})
+	return response, client
+}
+
+// dialWs connects to the WebSocket endpoint.
+func dialWs(t *testing.T, server *httptest.Server) *wsClient {
+	t.Helper()
+	response, client := wsHandshake(t, server, "")
+	if client == nil {
+		t.Fatalf("upgrade failed with status %d", response.StatusCode)
+	}
+	return client
+}
+
+// send writes a JSON text message, masked as clients must.
+func (client *wsClient) send(t *testing.T, data interface{}) {
+	t.Helper()
+	payload, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask := []byte{ 0x12, 0x34, 0x56, 0x78 }
+	frame := []byte{ 0x80 | wsOpText }
+	if len(payload) < 126 {
+		frame = append(frame, 0x80 | byte(len(payload)))
+	} else {
+		frame = append(frame, 0x80 | 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	}
+	frame = append(frame, mask...)
+	for i, value := range payload {
+		frame = append(frame, value ^ mask[i % 4])
+	}
+	if _, err := client.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reply waits for the reply to a command, skipping events and pings.
+func (client *wsClient) reply(t *testing.T) map[string]interface{} {
+	t.Helper()
+	client.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(client.reader, header); err != nil {
+			t.Fatal(err)
+		}
+		length := int(header[1] & 0x7f)
+		if length == 126 {
+			extended := make([]byte, 2)
+			if _, err := io.ReadFull(client.reader, extended); err != nil {
+				t.Fatal(err)
+			}
+			length = int(binary.BigEndian.Uint16(extended))
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(client.reader, payload); err != nil {
+			t.Fatal(err)
+		}
+		if header[0] & 0x0f != wsOpText {
+			continue
+		}
+		message := map[string]interface{}{}
+		if err := json.Unmarshal(payload, &message); err != nil {
+			t.Fatalf("invalid message %s: %s", payload, err)
+		}
+		if message["type"] == "reply" {
+			return message
+		}
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	state, _ := newTestState(t, "1")
+	server := newWsServer(t, state)
+	host := server.Listener.Addr().String()
+	tests := []struct {
+		origin string
+		status int
+	}{
+		{ "", http.StatusSwitchingProtocols },
+		{ "http://" + host, http.StatusSwitchingProtocols },
+		{ "https://" + host, http.StatusSwitchingProtocols },
+		{ "http://evil.example.com", http.StatusForbidden },
+		{ "http://" + host + ".example.com", http.StatusForbidden },
+		{ "null", http.StatusForbidden },
+	}
+	for _, test := range tests {
+		response, client := wsHandshake(t, server, test.origin)
+		if response.StatusCode != test.status {
+			t.Errorf("origin %q: status is %d, expected %d", test.origin, response.StatusCode, test.status)
+		}
+		if client != nil {
+			client.conn.Close()
+		}
+	}
+}
+
+// disconnected waits until the server has ended all sessions.
+func disconnected(t *testing.T, state *ShutterState) {
+	t.Helper()
+	waitFor(t, "the sessions ended", func() bool {
+		state.Events.lock.Lock()
+		defer state.Events.lock.Unlock()
+		return len(state.Events.subscribers) == 0
+	})
+}
+
+func TestWebSocketJogStopsOnDisconnect(t *testing.T) {
+	state, _ := newTestState(t, "1")
+	server := newWsServer(t, state)
+	client := dialWs(t, server)
+
+	client.send(t, map[string]interface{}{ "id": 1, "command": WsJogStart, "shutter": "1", "direction": "down" })
+	reply := client.reply(t)
+	if reply["error"] != nil {
+		t.Fatalf("jog failed: %v", reply)
+	}
+	energised(t, "1d")
+	job := replyJob(t, state, "1", reply["job"])
+
+	client.conn.Close()
+	disconnected(t, state)
+	finished(t, job)
+	if status := job.Status(); status != JobCancelled {
+		t.Errorf("jog is %s, expected %s", status, JobCancelled)
+	}
+	if SimLine("1d").Value() {
+		t.Error("shutter is still moving")
+	}
+}
+
+func TestWebSocketFinishedJogOnDisconnect(t *testing.T) {
+	state, clock := newTestState(t, "1")
+	server := newWsServer(t, state)
+	client := dialWs(t, server)
+
+	// the jog reaches the end by itself
+	client.send(t, map[string]interface{}{ "id": 1, "command": WsJogStart, "shutter": "1", "direction": "down" })
+	reply := client.reply(t)
+	energised(t, "1d")
+	clock.Advance(10 * time.Second)
+	finished(t, replyJob(t, state, "1", reply["job"]))
+
+	// then someone else moves the shutter
+	job, err := state.Dispatch("1", Command{ Action: ActionMove, Position: 50, Source: SourceSchedule })
+	if err != nil {
+		t.Fatal(err)
+	}
+	reversing(t, clock, "1d")
+	clock.Advance(500 * time.Millisecond)
+	energised(t, "1u")
+
+	client.conn.Close()
+	disconnected(t, state)
+	if status := job.Status(); status != JobRunning {
+		t.Errorf("move is %s after the client disconnected, expected %s", status, JobRunning)
+	}
+	if !SimLine("1u").Value() {
+		t.Error("shutter was stopped")
+	}
+}
+
+func TestWebSocketCommands(t *testing.T) {
+	state, _ := newTestState(t, "1")
+	server := newWsServer(t, state)
+	client := dialWs(t, server)
+	tests := []struct {
+		message map[string]interface{}
+		err string
+	}{
+		{ map[string]interface{}{ "command": ActionMove, "shutter": "1", "position": 40 }, "" },
+		{ map[string]interface{}{ "command": ActionFlip, "shutter": "1", "angle": 0.5 }, "" },
+		{ map[string]interface{}{ "command": ActionStop, "shutter": "1" }, "" },
+		{ map[string]interface{}{ "command": WsJogStart, "shutter": "1", "direction": "up" }, "" },
+		{ map[string]interface{}{ "command": WsJogEnd, "shutter": "1" }, "" },
+		{ map[string]interface{}{ "command": ActionMove, "shutter": "1", "position": 140 }, ErrInvalidArgument },
+		{ map[string]interface{}{ "command": WsJogStart, "shutter": "1", "direction": "left" }, ErrInvalidArgument },
+		{ map[string]interface{}{ "command": ActionReset, "shutter": "1" }, ErrInvalidArgument },
+		{ map[string]interface{}{ "command": "dance", "shutter": "1" }, ErrInvalidArgument },
+		{ map[string]interface{}{ "command": ActionStop, "shutter": "2" }, ErrInvalidObject },
+	}
+	for i, test := range tests {
+		test.message["id"] = i
+		client.send(t, test.message)
+		reply := client.reply(t)
+		if reply["id"] != float64(i) {
+			t.Fatalf("reply %v does not belong to %v", reply, test.message)
+		}
+		if test.err == "" && reply["error"] != nil {
+			t.Errorf("%v failed: %v", test.message, reply)
+		} else if test.err != "" && reply["error"] != test.err {
+			t.Errorf("%v: error is %v, expected %s", test.message, reply["error"], test.err)
+		}
+	}
+	shutter := state.Shutters["1"]
+	for _, id := range shutter.Jobs() {
+		if job := shutter.Job(id); job != nil && job.Command.Action == ActionReset {
+			t.Errorf("job %d recalibrates the shutter", id)
+		}
+	}
+}